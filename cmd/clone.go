@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	linkedClone bool
+)
+
+var cloneCommand = &cobra.Command{
+	Use:               "clone <source> <name>",
+	Short:             "Clones a stopped instance into a new one",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Load the instance data
+		instance := getInstance(args[0])
+
+		// Create the files of the new instance
+		fmt.Printf("Cloning instance %q into %q\n", args[0], args[1])
+		clone, err := instance.Clone(args[1], linkedClone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error cloning the instance: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Create and start instance %q\n", clone.Name)
+		// Call the Create method that will create and start the instance
+		err = clone.Create()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating instance\n")
+			os.Exit(1)
+		}
+
+		fmt.Printf("Waiting for the instance %q to become ready\n", clone.Name)
+		// Call the Wait method that will wait until the VM reaches running state
+		err = clone.Wait()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "The instance appears to be stuck in a starting state\n")
+		}
+
+		fmt.Printf("Done!\n")
+	},
+}
+
+func init() {
+	cloneCommand.PersistentFlags().BoolVarP(&linkedClone, "linked", "l", false, "create the disk as an overlay of the source disk instead of a copy")
+	rootCommand.AddCommand(cloneCommand)
+}
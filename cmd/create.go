@@ -57,9 +57,9 @@ var createCommand = &cobra.Command{
 			fmt.Printf("\nCreating machine %q\n", machine.Name)
 			fmt.Printf("Downloading image\n")
 			// Call the DownloadImage method that will download the distro image needed to boot the instance
-			err = machine.DownloadImage()
+			err = downloadImage(machine)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error downloading images\n")
+				fmt.Fprintf(os.Stderr, "Error downloading images: %s\n", err)
 				os.Exit(1)
 			}
 
@@ -83,7 +83,7 @@ var createCommand = &cobra.Command{
 			// Call the Wait methid that will wait until the VM reaches running state
 			err = machine.Wait()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "The instance appears to be stuck in a starting state\n")
+				fmt.Fprintf(os.Stderr, "The instance appears to be stuck in a starting state, check its boot log with 'machina logs --console %s'\n", machine.Name)
 			}
 
 			fmt.Printf("Running install scripts in instance %q\n", machine.Name)
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/enkodr/machina/internal/hypvsr"
+	"github.com/spf13/cobra"
+)
+
+var (
+	execAll     bool
+	execCluster string
+)
+
+var execCommand = &cobra.Command{
+	Use:   "exec [instance] -- <command>...",
+	Short: "Runs a command inside one or more instances",
+	Args: func(cmd *cobra.Command, args []string) error {
+		// Split the instance name from the command to run
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 || dash == len(args) {
+			return fmt.Errorf("the command to run must be passed after --")
+		}
+		if execAll && execCluster != "" {
+			return fmt.Errorf("--all and --cluster cannot be used together")
+		}
+		if execAll || execCluster != "" {
+			if dash != 0 {
+				return fmt.Errorf("no instance can be passed with --all or --cluster")
+			}
+			return nil
+		}
+		if dash != 1 {
+			return fmt.Errorf("exactly one instance must be passed before --")
+		}
+		return nil
+	},
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		dash := cmd.ArgsLenAtDash()
+		command := args[dash:]
+
+		// Run the command in a single instance, exiting with its exit code
+		if dash == 1 {
+			instance := getInstance(args[0])
+			code, err := instance.Exec(command, os.Stdout, os.Stderr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error running the command in instance %q: %s\n", args[0], err)
+				os.Exit(1)
+			}
+			os.Exit(code)
+		}
+
+		// Get the selected instances
+		machines, err := hypvsr.GetMachines()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading the instances: %s\n", err)
+			os.Exit(1)
+		}
+		if execCluster != "" {
+			machines = slices.DeleteFunc(machines, func(machine *hypvsr.Machine) bool {
+				return machine.ClusterName != execCluster
+			})
+		}
+		if len(machines) == 0 {
+			fmt.Fprintf(os.Stderr, "No instances found\n")
+			os.Exit(1)
+		}
+
+		// Run the command in all the running instances, prefixing the output
+		// with the instance name and exiting with the first failed exit code,
+		// or with 1 when any instance is skipped
+		exitCode := 0
+		skipped := 0
+		for _, machine := range machines {
+			status, err := machine.Status()
+			if err != nil || status != "running" {
+				fmt.Fprintf(os.Stderr, "Skipping instance %q as it is not running\n", machine.Name)
+				skipped++
+				continue
+			}
+
+			stdout := newPrefixWriter(os.Stdout, machine.Name)
+			stderr := newPrefixWriter(os.Stderr, machine.Name)
+			code, err := machine.Exec(command, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error running the command in instance %q: %s\n", machine.Name, err)
+				code = 1
+			}
+			if code != 0 && exitCode == 0 {
+				exitCode = code
+			}
+		}
+
+		if skipped == len(machines) {
+			fmt.Fprintf(os.Stderr, "No running instances found\n")
+			os.Exit(1)
+		}
+		if skipped > 0 && exitCode == 0 {
+			exitCode = 1
+		}
+		os.Exit(exitCode)
+	},
+}
+
+// Writer that prefixes every line written with the name of an instance
+type prefixWriter struct {
+	out    io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(out io.Writer, name string) *prefixWriter {
+	return &prefixWriter{
+		out:    out,
+		prefix: []byte(fmt.Sprintf("[%s] ", name)),
+	}
+}
+
+// Writes the complete lines, keeping the last incomplete line until more data arrives
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		_, err := w.out.Write(append(slices.Clone(w.prefix), w.buf[:i+1]...))
+		if err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Writes the remaining incomplete line
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.out.Write(append(append(slices.Clone(w.prefix), w.buf...), '\n'))
+	w.buf = nil
+	return err
+}
+
+// Get's the names of the clusters of the created instances for auto-completion
+func bashCompleteClusterNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	machines, err := hypvsr.GetMachines()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var clusters []string
+	for _, machine := range machines {
+		if machine.ClusterName != "" && !slices.Contains(clusters, machine.ClusterName) {
+			clusters = append(clusters, machine.ClusterName)
+		}
+	}
+
+	return clusters, cobra.ShellCompDirectiveNoFileComp
+}
+
+func init() {
+	execCommand.Flags().BoolVarP(&execAll, "all", "a", false, "run the command in all the running instances")
+	execCommand.Flags().StringVarP(&execCluster, "cluster", "c", "", "run the command in all the running instances of the cluster")
+	execCommand.RegisterFlagCompletionFunc("cluster", bashCompleteClusterNames)
+	rootCommand.AddCommand(execCommand)
+}
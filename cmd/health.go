@@ -21,6 +21,9 @@ var healthCommand = &cobra.Command{
 		fmt.Printf("Checking if dependencies are installed...\n")
 
 		var deps []string
+		// Dependencies only needed by some features, which are reported
+		// without failing the check
+		optional := map[string]string{}
 
 		// Identify the OS and define the dependencies per OS
 		if runtime.GOOS == "linux" {
@@ -28,14 +31,13 @@ var healthCommand = &cobra.Command{
 			deps = []string{
 				"cloud-localds",
 				"genisoimage",
+				"gpg",
 				"qemu-img",
 				"qemu-system-x86_64",
-				"rsync",
-				"scp",
-				"ssh",
-				"virt-install",
-				"virsh",
+				"swtpm",
 			}
+			optional["gpg"] = "verifies signed checksum files"
+			optional["swtpm"] = "runs the TPM of the machines"
 		} else {
 			// Dependenciesfor MacOS
 			deps = []string{
@@ -44,11 +46,15 @@ var healthCommand = &cobra.Command{
 		}
 
 		// Check if the dependencies are installed and show the outcome
+		missing := false
 		for _, dep := range deps {
 			if packageInstalled(dep) {
 				fmt.Fprintln(w, fmt.Sprintf("%s\tinstalled", dep))
+			} else if reason, ok := optional[dep]; ok {
+				fmt.Fprintln(w, fmt.Sprintf("%s\tnot installed (optional, %s)", dep, reason))
 			} else {
 				fmt.Fprintln(w, fmt.Sprintf("%s\tnot installed", dep))
+				missing = true
 			}
 		}
 		err := w.Flush()
@@ -56,6 +62,9 @@ var healthCommand = &cobra.Command{
 			fmt.Fprintln(os.Stderr, "Error presenting information")
 			os.Exit(1)
 		}
+		if missing {
+			os.Exit(1)
+		}
 	},
 }
 
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/enkodr/machina/internal/hypvsr"
+	"github.com/spf13/cobra"
+)
+
+var (
+	imageOutput string
+)
+
+var imageCommand = &cobra.Command{
+	Use:   "image",
+	Short: "Manages the base images of the image cache",
+}
+
+var imageListCommand = &cobra.Command{
+	Use:     "list",
+	Short:   "Lists the cached images and the instances that use them",
+	Aliases: []string{"ls"},
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		images, err := hypvsr.ListImages()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing the images: %s\n", err)
+			os.Exit(1)
+		}
+
+		if imageOutput != outputTable {
+			err = printData(imageOutput, images)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error printing the images: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		// Create a new visual table and set the header titles
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Align: simpletable.AlignCenter, Text: "IMAGE"},
+				{Align: simpletable.AlignCenter, Text: "SIZE"},
+				{Align: simpletable.AlignCenter, Text: "CHECKSUM"},
+				{Align: simpletable.AlignCenter, Text: "URL"},
+				{Align: simpletable.AlignCenter, Text: "INSTANCES"},
+			},
+		}
+
+		// Add the content for all the rows
+		for _, image := range images {
+			r := []*simpletable.Cell{
+				{Text: image.Name},
+				{Align: simpletable.AlignRight, Text: formatBytes(image.Size)},
+				{Text: image.Checksum},
+				{Text: image.URL},
+				{Text: strings.Join(image.Instances, ", ")},
+			}
+			table.Body.Cells = append(table.Body.Cells, r)
+		}
+
+		// Print the table
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Println(table.String())
+	},
+}
+
+var imagePullCommand = &cobra.Command{
+	Use:   "pull [template]",
+	Short: "Downloads the images of a template to the image cache",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := "default"
+		switch {
+		case len(args) == 1:
+			name = args[0]
+		case file != "":
+			name = file
+		}
+
+		instance, err := hypvsr.NewInstance(hypvsr.NewTemplate(name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading template %q: %s\n", name, err)
+			os.Exit(1)
+		}
+
+		// Download each image once, even when several machines use it
+		pulled := []string{}
+		for _, machine := range instance.Machines {
+			if slices.Contains(pulled, machine.Image.URL) {
+				continue
+			}
+
+			fmt.Printf("Downloading image %s\n", machine.Image.URL)
+			err = downloadImage(machine)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error downloading the image: %s\n", err)
+				os.Exit(1)
+			}
+			pulled = append(pulled, machine.Image.URL)
+		}
+
+		fmt.Printf("Done!\n")
+	},
+}
+
+var imageRemoveCommand = &cobra.Command{
+	Use:     "rm <image>...",
+	Short:   "Removes images from the image cache unless instances use them",
+	Aliases: []string{"remove"},
+	Args:    cobra.MinimumNArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		images, _ := hypvsr.ListImages()
+		names := []string{}
+		for _, image := range images {
+			names = append(names, image.Name)
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, name := range args {
+			fmt.Printf("Removing image %q\n", name)
+			err := hypvsr.RemoveImage(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing the image: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("Done!\n")
+	},
+}
+
+var imagePruneCommand = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes the cached images that no instance uses",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		removed, err := hypvsr.PruneImages()
+		for _, name := range removed {
+			fmt.Printf("Removed image %q\n", name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error pruning the images: %s\n", err)
+			os.Exit(1)
+		}
+		if len(removed) == 0 {
+			fmt.Printf("No unused images\n")
+		}
+		fmt.Printf("Done!\n")
+	},
+}
+
+func init() {
+	addOutputFlag(imageListCommand, &imageOutput, outputTable, outputTable, outputJSON, outputYAML)
+	imagePullCommand.Flags().StringVarP(&file, "file", "f", "", "path to the template file with the images to download")
+	imageCommand.AddCommand(imageListCommand)
+	imageCommand.AddCommand(imagePullCommand)
+	imageCommand.AddCommand(imageRemoveCommand)
+	imageCommand.AddCommand(imagePruneCommand)
+	rootCommand.AddCommand(imageCommand)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/enkodr/machina/internal/hypvsr"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectOutput string
+)
+
+// Holds the stored configuration of an instance along with its live status
+type instanceDetails struct {
+	hypvsr.Machine `yaml:",inline"`
+	State          string `yaml:"status"`
+}
+
+var inspectCommand = &cobra.Command{
+	Use:               "inspect <instance>",
+	Short:             "Shows the configuration and status of an instance",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Load the instance data
+		instance := getInstance(args[0])
+
+		status, err := instance.Status()
+		if err != nil {
+			status = "error"
+		}
+
+		err = printData(inspectOutput, instanceDetails{
+			Machine: *instance,
+			State:   status,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error printing the instance: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	addOutputFlag(inspectCommand, &inspectOutput, outputYAML, outputJSON, outputYAML)
+	rootCommand.AddCommand(inspectCommand)
+}
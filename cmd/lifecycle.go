@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/enkodr/machina/internal/hypvsr"
+	"github.com/spf13/cobra"
+)
+
+var pauseCommand = &cobra.Command{
+	Use:               "pause <instance>...",
+	Short:             "Pauses the CPUs of running instances",
+	Args:              cobra.MinimumNArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		runLifecycle(args, "Pausing", (*hypvsr.Machine).Pause)
+	},
+}
+
+var resumeCommand = &cobra.Command{
+	Use:               "resume <instance>...",
+	Short:             "Resumes paused instances or restores suspended ones",
+	Args:              cobra.MinimumNArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		runLifecycle(args, "Resuming", (*hypvsr.Machine).Resume)
+	},
+}
+
+var restartCommand = &cobra.Command{
+	Use:               "restart <instance>...",
+	Short:             "Reboots running instances",
+	Args:              cobra.MinimumNArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		runLifecycle(args, "Restarting", (*hypvsr.Machine).Restart)
+	},
+}
+
+var suspendCommand = &cobra.Command{
+	Use:               "suspend <instance>...",
+	Short:             "Saves the state of running instances to disk and stops them until they are resumed or started",
+	Args:              cobra.MinimumNArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		runLifecycle(args, "Suspending", (*hypvsr.Machine).Suspend)
+	},
+}
+
+// runLifecycle runs the lifecycle operation on each of the instances
+func runLifecycle(names []string, action string, operation func(*hypvsr.Machine) error) {
+	for _, name := range names {
+		instance := getInstance(name)
+
+		fmt.Printf("%s instance %q\n", action, name)
+		err := operation(instance)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error on instance %q: %s\n", name, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Done!\n")
+}
+
+func init() {
+	rootCommand.AddCommand(pauseCommand)
+	rootCommand.AddCommand(resumeCommand)
+	rootCommand.AddCommand(restartCommand)
+	rootCommand.AddCommand(suspendCommand)
+}
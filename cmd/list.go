@@ -11,6 +11,23 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	listOutput string
+)
+
+// Holds the details of an instance printed by the list command
+type instanceSummary struct {
+	Name       string `yaml:"name"`
+	IPAddress  string `yaml:"ipAddress"`
+	MacAddress string `yaml:"macAddress"`
+	Status     string `yaml:"status"`
+	CPUs       string `yaml:"cpus"`
+	Memory     string `yaml:"memory"`
+	Disk       string `yaml:"disk"`
+	Variant    string `yaml:"variant"`
+	Image      string `yaml:"image"`
+}
+
 var listCommand = &cobra.Command{
 	Use:     "list",
 	Short:   "Lists all created instances",
@@ -32,23 +49,13 @@ var listCommand = &cobra.Command{
 		dirs, _ := os.ReadDir(cfg.Directories.Instances)
 		instances = append(instances, dirs...)
 
-		// Create a new visual table and set the header titles
-		table := simpletable.New()
-		table.Header = &simpletable.Header{
-			Cells: []*simpletable.Cell{
-				{Align: simpletable.AlignCenter, Text: "VM NAME"},
-				{Align: simpletable.AlignCenter, Text: "IP ADDRESS"},
-				{Align: simpletable.AlignCenter, Text: "STATUS"},
-				{Align: simpletable.AlignCenter, Text: "CPUS"},
-				{Align: simpletable.AlignCenter, Text: "MEMORY"},
-				{Align: simpletable.AlignCenter, Text: "DISK"},
-				{Align: simpletable.AlignCenter, Text: "LABELS"},
-			},
-		}
-
-		// Add the content for all the rows
+		// Get the details of all the instances
+		summaries := []instanceSummary{}
 		for _, instance := range instances {
-			kind, _ := hypvsr.GetMachine(instance.Name())
+			kind, err := hypvsr.GetMachine(instance.Name())
+			if err != nil {
+				continue
+			}
 			vms := kind.GetVMs()
 			for _, vm := range vms {
 				status, err := vm.Status()
@@ -56,25 +63,85 @@ var listCommand = &cobra.Command{
 					status = "error"
 				}
 
-				r := []*simpletable.Cell{
-					{Text: vm.Name},
-					{Text: vm.Network.IPAddress},
-					{Text: status},
-					{Align: simpletable.AlignCenter, Text: vm.Resources.CPUs},
-					{Align: simpletable.AlignCenter, Text: vm.Resources.Memory},
-					{Align: simpletable.AlignCenter, Text: vm.Resources.Disk},
-					{Text: vm.Variant},
-				}
-				table.Body.Cells = append(table.Body.Cells, r)
+				summaries = append(summaries, instanceSummary{
+					Name:       vm.Name,
+					IPAddress:  vm.Network.IPAddress,
+					MacAddress: vm.Network.MacAddress,
+					Status:     status,
+					CPUs:       vm.Resources.CPUs,
+					Memory:     vm.Resources.Memory,
+					Disk:       vm.Resources.Disk,
+					Variant:    vm.Variant,
+					Image:      vm.Image.URL,
+				})
 			}
 		}
 
-		// Print the table
-		table.SetStyle(simpletable.StyleDefault)
-		fmt.Println(table.String())
+		switch listOutput {
+		case outputJSON, outputYAML:
+			err = printData(listOutput, summaries)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error printing the instances: %s\n", err)
+				os.Exit(1)
+			}
+		case outputName:
+			for _, summary := range summaries {
+				fmt.Println(summary.Name)
+			}
+		default:
+			printInstanceTable(summaries, listOutput == outputWide)
+		}
 	},
 }
 
+// Prints the instances in a visual table, with extra columns when wide
+func printInstanceTable(summaries []instanceSummary, wide bool) {
+	// Create a new visual table and set the header titles
+	table := simpletable.New()
+	table.Header = &simpletable.Header{
+		Cells: []*simpletable.Cell{
+			{Align: simpletable.AlignCenter, Text: "VM NAME"},
+			{Align: simpletable.AlignCenter, Text: "IP ADDRESS"},
+			{Align: simpletable.AlignCenter, Text: "STATUS"},
+			{Align: simpletable.AlignCenter, Text: "CPUS"},
+			{Align: simpletable.AlignCenter, Text: "MEMORY"},
+			{Align: simpletable.AlignCenter, Text: "DISK"},
+			{Align: simpletable.AlignCenter, Text: "LABELS"},
+		},
+	}
+	if wide {
+		table.Header.Cells = append(table.Header.Cells,
+			&simpletable.Cell{Align: simpletable.AlignCenter, Text: "MAC ADDRESS"},
+			&simpletable.Cell{Align: simpletable.AlignCenter, Text: "IMAGE"},
+		)
+	}
+
+	// Add the content for all the rows
+	for _, summary := range summaries {
+		r := []*simpletable.Cell{
+			{Text: summary.Name},
+			{Text: summary.IPAddress},
+			{Text: summary.Status},
+			{Align: simpletable.AlignCenter, Text: summary.CPUs},
+			{Align: simpletable.AlignCenter, Text: summary.Memory},
+			{Align: simpletable.AlignCenter, Text: summary.Disk},
+			{Text: summary.Variant},
+		}
+		if wide {
+			r = append(r,
+				&simpletable.Cell{Text: summary.MacAddress},
+				&simpletable.Cell{Text: summary.Image},
+			)
+		}
+		table.Body.Cells = append(table.Body.Cells, r)
+	}
+
+	// Print the table
+	table.SetStyle(simpletable.StyleDefault)
+	fmt.Println(table.String())
+}
+
 func init() {
+	addOutputFlag(listCommand, &listOutput, outputTable, outputTable, outputWide, outputName, outputJSON, outputYAML)
 	rootCommand.AddCommand(listCommand)
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	logsConsole   bool
+	logsForwarder bool
+)
+
+var logsCommand = &cobra.Command{
+	Use:               "logs <instance>",
+	Short:             "Prints the boot console or, with --forwarder, the port forwarder logs of an instance",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		var err error
+		if logsForwarder {
+			err = instance.ForwarderLog(os.Stdout)
+		} else {
+			err = instance.ConsoleLog(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading the logs of instance %q: %s\n", args[0], err)
+			os.Exit(1)
+		}
+	},
+}
+
+var consoleCommand = &cobra.Command{
+	Use:               "console <instance>",
+	Short:             "Attaches to the serial console of an instance, press Ctrl+] to detach",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		fmt.Printf("Attached to the console of instance %q, press Ctrl+] to detach\n", args[0])
+		err := instance.Console()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error attaching to the console of instance %q: %s\n", args[0], err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	logsCommand.Flags().BoolVar(&logsConsole, "console", false, "print the output of the serial console since the instance was created, printed by default")
+	logsCommand.Flags().BoolVar(&logsForwarder, "forwarder", false, "print the logs of the port forwarder instead of the serial console")
+	logsCommand.MarkFlagsMutuallyExclusive("console", "forwarder")
+	rootCommand.AddCommand(logsCommand)
+	rootCommand.AddCommand(consoleCommand)
+}
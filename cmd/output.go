@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/enkodr/machina/internal/hypvsr"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats supported by the commands
+const (
+	outputTable = "table"
+	outputWide  = "wide"
+	outputName  = "name"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// Adds the output flag to the command, accepting only the given formats
+func addOutputFlag(cmd *cobra.Command, output *string, value string, formats ...string) {
+	usage := fmt.Sprintf("output format, one of: %s", strings.Join(formats, "|"))
+	cmd.Flags().StringVarP(output, "output", "o", value, usage)
+
+	// Validate the format before running the command
+	cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if !slices.Contains(formats, *output) {
+			return fmt.Errorf("invalid output format %q, must be one of: %s", *output, strings.Join(formats, "|"))
+		}
+		return nil
+	}
+	cmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return formats, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+// Prints the data encoded in the given format.
+// The data is always encoded through YAML so that the JSON keys match the
+// keys used in the instance and template files.
+func printData(format string, data any) error {
+	out, err := yaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if format == outputYAML {
+		fmt.Print(string(out))
+		return nil
+	}
+
+	var value any
+	err = yaml.Unmarshal(out, &value)
+	if err != nil {
+		return err
+	}
+
+	out, err = json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	return nil
+}
+
+// Formats the bytes in the largest binary unit below them
+func formatBytes(bytes int64) string {
+	size := float64(bytes)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if size < 1024 {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return fmt.Sprintf("%.1f TiB", size)
+}
+
+// Downloads the image of the machine, redrawing the progress on a single line
+// of the terminal, or printing it now and then when the output is redirected
+func downloadImage(machine hypvsr.Machine) error {
+	interval, end := 5*time.Second, "\n"
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		interval, end = 200*time.Millisecond, "\r"
+	}
+
+	last := time.Time{}
+	printed := false
+	err := machine.DownloadImage(func(downloaded, total int64) {
+		if time.Since(last) < interval && downloaded != total {
+			return
+		}
+		last = time.Now()
+		printed = true
+
+		if total > 0 {
+			fmt.Printf("  %s of %s (%d%%)  %s", formatBytes(downloaded), formatBytes(total), downloaded*100/total, end)
+		} else {
+			fmt.Printf("  %s  %s", formatBytes(downloaded), end)
+		}
+	})
+
+	// Keep the last progress line on the terminal
+	if printed && end == "\r" {
+		fmt.Println()
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/enkodr/machina/internal/hypvsr"
+	"github.com/spf13/cobra"
+)
+
+var portCommand = &cobra.Command{
+	Use:   "port",
+	Short: "Manages the ports of an instance forwarded from the host",
+}
+
+var portListCommand = &cobra.Command{
+	Use:               "list <instance>",
+	Short:             "Lists the ports of an instance forwarded from the host",
+	Aliases:           []string{"ls"},
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		// Create a new visual table and set the header titles
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Align: simpletable.AlignCenter, Text: "HOST"},
+				{Align: simpletable.AlignCenter, Text: "GUEST PORT"},
+				{Align: simpletable.AlignCenter, Text: "PROTOCOL"},
+			},
+		}
+
+		// Add the content for all the rows
+		for _, port := range instance.Ports {
+			r := []*simpletable.Cell{
+				{Text: net.JoinHostPort(port.HostAddress, strconv.Itoa(port.HostPort))},
+				{Text: strconv.Itoa(port.GuestPort)},
+				{Text: port.Protocol},
+			}
+			table.Body.Cells = append(table.Body.Cells, r)
+		}
+
+		// Print the table
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Println(table.String())
+	},
+}
+
+var portAddCommand = &cobra.Command{
+	Use:               "add <instance> [host-address:][host-port:]<guest-port>[/protocol]",
+	Short:             "Forwards a port of an instance from the host",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		port, err := hypvsr.ParsePort(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing the port: %s\n", err)
+			os.Exit(1)
+		}
+
+		port, err = instance.AddPort(port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error forwarding the port: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Forwarding %s/%s to port %d of instance %q\n", net.JoinHostPort(port.HostAddress, strconv.Itoa(port.HostPort)), port.Protocol, port.GuestPort, args[0])
+	},
+}
+
+var portRemoveCommand = &cobra.Command{
+	Use:               "remove <instance> <host-port>[/protocol]",
+	Short:             "Stops forwarding a port of an instance from the host",
+	Aliases:           []string{"rm"},
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		// Split the protocol from the host port
+		hostPort, protocol, found := strings.Cut(args[1], "/")
+		if !found {
+			protocol = "tcp"
+		}
+		port, err := strconv.Atoi(hostPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid host port %q\n", hostPort)
+			os.Exit(1)
+		}
+
+		err = instance.RemovePort(port, protocol)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing the port: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Done!\n")
+	},
+}
+
+// Runs the forwarder started in the background by the hypervisor
+var portForwardCommand = &cobra.Command{
+	Use:    "forward <instance>",
+	Short:  "Forwards the ports of an instance through SSH until it is shut off",
+	Args:   cobra.ExactArgs(1),
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		err := instance.ForwardPorts(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error forwarding the ports of instance %q: %s\n", args[0], err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	portCommand.AddCommand(portListCommand)
+	portCommand.AddCommand(portAddCommand)
+	portCommand.AddCommand(portRemoveCommand)
+	portCommand.AddCommand(portForwardCommand)
+	rootCommand.AddCommand(portCommand)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	resizeCPUs   string
+	resizeMemory string
+	resizeDisk   string
+)
+
+var resizeCommand = &cobra.Command{
+	Use:               "resize <instance>",
+	Short:             "Changes the CPUs, memory and disk size of a stopped instance",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		if resizeCPUs == "" && resizeMemory == "" && resizeDisk == "" {
+			fmt.Fprintf(os.Stderr, "Set at least one of --cpus, --memory or --disk\n")
+			os.Exit(1)
+		}
+
+		instance := getInstance(args[0])
+
+		fmt.Printf("Resizing instance %q\n", args[0])
+		err := instance.Resize(resizeCPUs, resizeMemory, resizeDisk)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error resizing the instance: %s\n", err)
+			os.Exit(1)
+		}
+
+		if resizeDisk != "" {
+			fmt.Printf("The root filesystem grows to the new disk size on the next boot\n")
+		}
+		fmt.Printf("Done!\n")
+	},
+}
+
+func init() {
+	resizeCommand.Flags().StringVar(&resizeCPUs, "cpus", "", "number of CPUs")
+	resizeCommand.Flags().StringVar(&resizeMemory, "memory", "", "amount of RAM, e.g. 8G or 512M")
+	resizeCommand.Flags().StringVar(&resizeDisk, "disk", "", "disk size, e.g. 60G, or +20G to grow it by that amount")
+	rootCommand.AddCommand(resizeCommand)
+}
@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/enkodr/machina/internal/hypvsr"
 	"github.com/spf13/cobra"
 )
 
@@ -26,3 +30,13 @@ func validateName(cmd *cobra.Command, args []string) error {
 	}
 	return nil
 }
+
+// Loads the instance data or exits if the instance does not exist
+func getInstance(name string) *hypvsr.Machine {
+	instance, err := hypvsr.GetMachine(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Instance %q does not exist\n", name)
+		os.Exit(1)
+	}
+	return instance
+}
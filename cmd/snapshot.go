@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alexeyco/simpletable"
+	"github.com/spf13/cobra"
+)
+
+var snapshotCommand = &cobra.Command{
+	Use:     "snapshot",
+	Short:   "Manages the snapshots of an instance",
+	Aliases: []string{"snap"},
+}
+
+var snapshotCreateCommand = &cobra.Command{
+	Use:               "create <instance> [name]",
+	Short:             "Creates a snapshot of an instance",
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		// Name the snapshot after the current time if no name was passed
+		snapshot := fmt.Sprintf("snapshot-%s", time.Now().Format("20060102150405"))
+		if len(args) == 2 {
+			snapshot = args[1]
+		}
+
+		fmt.Printf("Creating snapshot %q of instance %q\n", snapshot, args[0])
+		err := instance.CreateSnapshot(snapshot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating the snapshot: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Done!\n")
+	},
+}
+
+var snapshotListCommand = &cobra.Command{
+	Use:               "list <instance>",
+	Short:             "Lists the snapshots of an instance",
+	Aliases:           []string{"ls"},
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		snapshots, err := instance.ListSnapshots()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing the snapshots: %s\n", err)
+			os.Exit(1)
+		}
+
+		// Create a new visual table and set the header titles
+		table := simpletable.New()
+		table.Header = &simpletable.Header{
+			Cells: []*simpletable.Cell{
+				{Align: simpletable.AlignCenter, Text: "SNAPSHOT NAME"},
+				{Align: simpletable.AlignCenter, Text: "CREATED"},
+			},
+		}
+
+		// Add the content for all the rows
+		for _, snapshot := range snapshots {
+			r := []*simpletable.Cell{
+				{Text: snapshot.Name},
+				{Text: snapshot.CreatedAt.Local().Format(time.DateTime)},
+			}
+			table.Body.Cells = append(table.Body.Cells, r)
+		}
+
+		// Print the table
+		table.SetStyle(simpletable.StyleDefault)
+		fmt.Println(table.String())
+	},
+}
+
+var snapshotRevertCommand = &cobra.Command{
+	Use:               "revert <instance> <name>",
+	Short:             "Reverts an instance to a snapshot",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		fmt.Printf("Reverting instance %q to snapshot %q\n", args[0], args[1])
+		err := instance.RevertSnapshot(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reverting the snapshot: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Done!\n")
+	},
+}
+
+var snapshotDeleteCommand = &cobra.Command{
+	Use:               "delete <instance> <name>",
+	Short:             "Deletes a snapshot of an instance",
+	Aliases:           []string{"rm"},
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: bashCompleteInstanceNames,
+	Run: func(cmd *cobra.Command, args []string) {
+		instance := getInstance(args[0])
+
+		fmt.Printf("Deleting snapshot %q of instance %q\n", args[1], args[0])
+		err := instance.DeleteSnapshot(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting the snapshot: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Done!\n")
+	},
+}
+
+func init() {
+	snapshotCommand.AddCommand(snapshotCreateCommand)
+	snapshotCommand.AddCommand(snapshotListCommand)
+	snapshotCommand.AddCommand(snapshotRevertCommand)
+	snapshotCommand.AddCommand(snapshotDeleteCommand)
+	rootCommand.AddCommand(snapshotCommand)
+}
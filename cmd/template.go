@@ -7,8 +7,19 @@ import (
 	"github.com/alexeyco/simpletable"
 	"github.com/enkodr/machina/internal/hypvsr"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
+var (
+	templateOutput string
+)
+
+// Holds the details of a template printed by the template command
+type templateSummary struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
 var templateCommand = &cobra.Command{
 	Use:     "template",
 	Short:   "Lists and gets the available templates",
@@ -18,8 +29,6 @@ var templateCommand = &cobra.Command{
 	},
 	ValidArgsFunction: bashCompleteInstanceNames,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Load the instance data
-
 		// Check if a template name was passed
 		if len(args) == 1 {
 			tpl, err := hypvsr.GetTemplate(args[0])
@@ -27,8 +36,31 @@ var templateCommand = &cobra.Command{
 				fmt.Fprintf(os.Stderr, "Failed to get template %s\n", args[0])
 				os.Exit(1)
 			}
-			fmt.Println(tpl)
-		} else {
+			printTemplate(args[0], tpl)
+			return
+		}
+
+		// Get the template list
+		summaries := []templateSummary{}
+		for _, tpl := range hypvsr.GetTemplateList() {
+			summaries = append(summaries, templateSummary{
+				Name: tpl,
+				URL:  hypvsr.GetTemplateURL(tpl),
+			})
+		}
+
+		switch templateOutput {
+		case outputJSON, outputYAML:
+			err := printData(templateOutput, summaries)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error printing the templates: %s\n", err)
+				os.Exit(1)
+			}
+		case outputName:
+			for _, summary := range summaries {
+				fmt.Println(summary.Name)
+			}
+		default:
 			fmt.Println("Available templates")
 			table := simpletable.New()
 			table.Header = &simpletable.Header{
@@ -36,12 +68,16 @@ var templateCommand = &cobra.Command{
 					{Align: simpletable.AlignCenter, Text: "TEMPLATE NAME"},
 				},
 			}
-			// Get the template list
-			tpls := hypvsr.GetTemplateList()
+			if templateOutput == outputWide {
+				table.Header.Cells = append(table.Header.Cells, &simpletable.Cell{Align: simpletable.AlignCenter, Text: "URL"})
+			}
 
-			for _, tpl := range tpls {
+			for _, summary := range summaries {
 				r := []*simpletable.Cell{
-					{Text: tpl},
+					{Text: summary.Name},
+				}
+				if templateOutput == outputWide {
+					r = append(r, &simpletable.Cell{Text: summary.URL})
 				}
 				table.Body.Cells = append(table.Body.Cells, r)
 			}
@@ -51,10 +87,30 @@ var templateCommand = &cobra.Command{
 
 			fmt.Printf("Use 'machina template <name>' to get a specific template.\n")
 		}
-
 	},
 }
 
+// Prints the content of a template in the selected output format
+func printTemplate(name string, tpl string) {
+	switch templateOutput {
+	case outputJSON:
+		var data any
+		err := yaml.Unmarshal([]byte(tpl), &data)
+		if err == nil {
+			err = printData(templateOutput, data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error printing the template: %s\n", err)
+			os.Exit(1)
+		}
+	case outputName:
+		fmt.Println(name)
+	default:
+		fmt.Println(tpl)
+	}
+}
+
 func init() {
+	addOutputFlag(templateCommand, &templateOutput, outputTable, outputTable, outputWide, outputName, outputJSON, outputYAML)
 	rootCommand.AddCommand(templateCommand)
 }
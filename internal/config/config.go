@@ -18,6 +18,17 @@ const (
 	SeedImageFilename
 	DiskFilename
 	PIDFilename
+	MetadataFilename
+	QMPSocketFilename
+	ForwarderPIDFilename
+	ForwarderLogFilename
+	ConsoleSocketFilename
+	ConsoleLogFilename
+	NVRAMFilename
+	TPMStateFilename
+	TPMSocketFilename
+	TPMLogFilename
+	SavedStateFilename
 )
 
 func GetFilename(fn Filename) string {
@@ -36,6 +47,28 @@ func GetFilename(fn Filename) string {
 		return "disk.img"
 	case PIDFilename:
 		return "vm.pid"
+	case MetadataFilename:
+		return "metadata.yaml"
+	case QMPSocketFilename:
+		return "qmp.sock"
+	case ForwarderPIDFilename:
+		return "forward.pid"
+	case ForwarderLogFilename:
+		return "forward.log"
+	case ConsoleSocketFilename:
+		return "console.sock"
+	case ConsoleLogFilename:
+		return "console.log"
+	case NVRAMFilename:
+		return "nvram.fd"
+	case TPMStateFilename:
+		return "tpm"
+	case TPMSocketFilename:
+		return "swtpm.sock"
+	case TPMLogFilename:
+		return "swtpm.log"
+	case SavedStateFilename:
+		return "state.sav"
 	}
 
 	return ""
@@ -45,14 +78,36 @@ type Config struct {
 	Hypervisor  string      `yaml:"hypervisor,omitempty"`
 	Connection  string      `yaml:"connection,omitempty"`
 	Directories Directories `yaml:"directories,omitempty"`
+	Network     Network     `yaml:"network,omitempty"`
 }
 
 type Directories struct {
 	Images    string `yaml:"images,omitempty"`
 	Instances string `yaml:"instances,omitempty"`
 	Results   string `yaml:"results,omitempty"`
+	Leases    string `yaml:"leases,omitempty"`
+	Remote    string `yaml:"remote,omitempty"` // Directory of the images and disks in remote libvirt hosts
 }
 
+// Network holds the settings of the virtual network the machines are attached to
+type Network struct {
+	Mode    string   `yaml:"mode,omitempty"`    // Networking mode, bridge or user
+	CIDR    string   `yaml:"cidr,omitempty"`    // Subnet of the network, e.g. 192.168.122.0/24
+	Gateway string   `yaml:"gateway,omitempty"` // Gateway of the network
+	Bridge  string   `yaml:"bridge,omitempty"`  // Bridge the machines are attached to
+	DNS     []string `yaml:"dns,omitempty"`     // DNS servers
+	Search  []string `yaml:"search,omitempty"`  // DNS search domains
+}
+
+// Networking modes of the machines
+const (
+	// The machines are attached to a bridge and reached by their IP address
+	NetworkModeBridge = "bridge"
+	// The machines use the user-mode network of the hypervisor, which needs
+	// no privileges, and are reached through ports forwarded from the host
+	NetworkModeUser = "user"
+)
+
 var (
 	baseDir = ".local/share/machina"
 	cfgDir  = ".config/machina"
@@ -120,7 +175,9 @@ func createDefaultConfig(cfgFile string) (*Config, error) {
 			Images:    getDefaultImagePath(),
 			Instances: getDefaultInstancesPath(),
 			Results:   getDefaultResultsPath(),
+			Leases:    getDefaultLeasesPath(),
 		},
+		Network: DefaultNetwork(),
 	}
 
 	// Create the config file
@@ -156,6 +213,23 @@ func getDefaultResultsPath() string {
 	return filepath.Join(home, baseDir, "results")
 }
 
+// getDefaultLeasesPath returns the default path for the IP address leases
+func getDefaultLeasesPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, baseDir, "leases")
+}
+
+// DefaultNetwork returns the settings of the default libvirt network
+func DefaultNetwork() Network {
+	return Network{
+		Mode:    NetworkModeBridge,
+		CIDR:    "192.168.122.0/24",
+		Gateway: "192.168.122.1",
+		Bridge:  "virbr0",
+		DNS:     []string{"1.1.1.1", "8.8.8.8"},
+	}
+}
+
 // GetHypervisor returns the hypervisor to be used
 func getHypervisor() string {
 	// Default hypervisor
@@ -56,6 +56,14 @@ directories:
   instances: /path/to/instances
   clusters: /path/to/clusters
   results: /path/to/results
+network:
+  cidr: 10.10.0.0/16
+  gateway: 10.10.0.254
+  bridge: br-lab
+  dns:
+  - 10.10.0.53
+  search:
+  - lab.internal
 `
 	err = ioutil.WriteFile(tempFile.Name(), []byte(sampleConfig), 0644)
 	assert.NoError(t, err)
@@ -64,6 +72,13 @@ directories:
 		Hypervisor:  "test-hypervisor",
 		Connection:  "test-connection",
 		Directories: Directories{Images: "/path/to/images", Instances: "/path/to/instances", Results: "/path/to/results"},
+		Network: Network{
+			CIDR:    "10.10.0.0/16",
+			Gateway: "10.10.0.254",
+			Bridge:  "br-lab",
+			DNS:     []string{"10.10.0.53"},
+			Search:  []string{"lab.internal"},
+		},
 	}
 
 	actualConfig, err := loadConfigFromFile(tempFile.Name())
@@ -91,7 +106,9 @@ func TestCreateDefaultConfig(t *testing.T) {
 			Images:    getDefaultImagePath(),
 			Instances: getDefaultInstancesPath(),
 			Results:   getDefaultResultsPath(),
+			Leases:    getDefaultLeasesPath(),
 		},
+		Network: DefaultNetwork(),
 	}
 
 	_, err = createDefaultConfig(tempFile)
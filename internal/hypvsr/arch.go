@@ -0,0 +1,138 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+)
+
+// Architectures the machines can run
+const (
+	ArchX86_64  = "x86_64"
+	ArchAArch64 = "aarch64"
+	ArchRISCV64 = "riscv64"
+)
+
+// archSpec holds how the machines of an architecture are run
+type archSpec struct {
+	Binary      string // QEMU binary that runs the architecture
+	MachineType string // Board the machines are run on
+	TPMDevice   string // QEMU device of the TPM, empty when TPMs are not supported
+	TPMModel    string // libvirt model of the TPM
+	UEFIOnly    bool   // Whether the machines can only boot with UEFI
+}
+
+var archSpecs = map[string]archSpec{
+	ArchX86_64:  {Binary: "qemu-system-x86_64", MachineType: "q35", TPMDevice: "tpm-tis", TPMModel: "tpm-crb"},
+	ArchAArch64: {Binary: "qemu-system-aarch64", MachineType: "virt", TPMDevice: "tpm-tis-device", TPMModel: "tpm-tis", UEFIOnly: true},
+	ArchRISCV64: {Binary: "qemu-system-riscv64", MachineType: "virt", UEFIOnly: true},
+}
+
+// getArch returns the architecture of the machine, x86_64 by default
+func (machine *Machine) getArch() (string, error) {
+	if machine.Arch == "" {
+		return ArchX86_64, nil
+	}
+	if _, ok := archSpecs[machine.Arch]; !ok {
+		return "", fmt.Errorf("unsupported architecture %q, must be one of: %s, %s, %s", machine.Arch, ArchX86_64, ArchAArch64, ArchRISCV64)
+	}
+	return machine.Arch, nil
+}
+
+// getArchSpec returns how the machine is run for its architecture
+func (machine *Machine) getArchSpec() (archSpec, error) {
+	arch, err := machine.getArch()
+	if err != nil {
+		return archSpec{}, err
+	}
+	spec := archSpecs[arch]
+
+	if machine.Resources.TPM && spec.TPMDevice == "" {
+		return spec, fmt.Errorf("TPMs are not supported in %s machines", arch)
+	}
+	return spec, nil
+}
+
+// hostArch returns the architecture of the host, named as in QEMU
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return ArchX86_64
+	case "arm64":
+		return ArchAArch64
+	default:
+		return runtime.GOARCH
+	}
+}
+
+// canAccelerate checks if the host runs the machines of the architecture with
+// hardware acceleration, which needs the same architecture and, on Linux, KVM
+var canAccelerate = func(arch string) bool {
+	if arch != hostArch() {
+		return false
+	}
+	if runtime.GOOS == "darwin" {
+		return true
+	}
+
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	kvm.Close()
+	return true
+}
+
+// qemuAccel returns the QEMU accelerator for the architecture, falling back
+// to TCG emulation when the host can't accelerate it
+func qemuAccel(arch string) string {
+	if canAccelerate(arch) {
+		return getHypervisorDriver()
+	}
+	return "tcg"
+}
+
+// capabilitiesXML holds the guests supported by a libvirt host
+type capabilitiesXML struct {
+	XMLName xml.Name `xml:"capabilities"`
+	Guests  []struct {
+		OSType string `xml:"os_type"`
+		Arch   struct {
+			Name    string `xml:"name,attr"`
+			Domains []struct {
+				Type string `xml:"type,attr"`
+			} `xml:"domain"`
+		} `xml:"arch"`
+	} `xml:"guest"`
+}
+
+// parseDomainType returns the domain type that runs the architecture in the
+// libvirt host of the capabilities, kvm when accelerated or qemu when emulated
+func parseDomainType(capabilities string, arch string) (string, error) {
+	caps := capabilitiesXML{}
+	err := xml.Unmarshal([]byte(capabilities), &caps)
+	if err != nil {
+		return "", err
+	}
+
+	for _, guest := range caps.Guests {
+		if guest.OSType != "hvm" || guest.Arch.Name != arch {
+			continue
+		}
+
+		var types []string
+		for _, domain := range guest.Arch.Domains {
+			types = append(types, domain.Type)
+		}
+		if slices.Contains(types, "kvm") {
+			return "kvm", nil
+		}
+		if slices.Contains(types, "qemu") {
+			return "qemu", nil
+		}
+	}
+
+	return "", fmt.Errorf("the libvirt host can't run %s machines", arch)
+}
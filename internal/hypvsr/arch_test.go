@@ -0,0 +1,161 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachine_GetArch(t *testing.T) {
+	machine := &Machine{}
+	arch, err := machine.getArch()
+	assert.NoError(t, err)
+	assert.Equal(t, ArchX86_64, arch)
+
+	machine.Arch = ArchAArch64
+	spec, err := machine.getArchSpec()
+	assert.NoError(t, err)
+	assert.Equal(t, "qemu-system-aarch64", spec.Binary)
+	assert.Equal(t, "virt", spec.MachineType)
+
+	// Test case: RISC-V machines have no TPM
+	machine.Arch = ArchRISCV64
+	machine.Resources.TPM = true
+	_, err = machine.getArchSpec()
+	assert.Error(t, err)
+
+	// Test case: Unsupported architecture
+	machine.Arch = "mips"
+	_, err = machine.getArch()
+	assert.Error(t, err)
+}
+
+func TestQemuAccel(t *testing.T) {
+	defaultCanAccelerate := canAccelerate
+	defer func() { canAccelerate = defaultCanAccelerate }()
+
+	canAccelerate = func(arch string) bool { return arch == ArchX86_64 }
+	assert.Equal(t, getHypervisorDriver(), qemuAccel(ArchX86_64))
+	assert.Equal(t, "tcg", qemuAccel(ArchAArch64))
+
+	// Test case: Other architectures than the host one are always emulated
+	canAccelerate = defaultCanAccelerate
+	for arch := range archSpecs {
+		if arch != hostArch() {
+			assert.Equal(t, "tcg", qemuAccel(arch), arch)
+		}
+	}
+}
+
+func TestParseDomainType(t *testing.T) {
+	capabilities := `<capabilities>
+  <host><cpu><arch>x86_64</arch></cpu></host>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name="x86_64">
+      <domain type="qemu"/>
+      <domain type="kvm"/>
+    </arch>
+  </guest>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name="aarch64">
+      <domain type="qemu"/>
+    </arch>
+  </guest>
+</capabilities>`
+
+	domainType, err := parseDomainType(capabilities, ArchX86_64)
+	assert.NoError(t, err)
+	assert.Equal(t, "kvm", domainType)
+
+	domainType, err = parseDomainType(capabilities, ArchAArch64)
+	assert.NoError(t, err)
+	assert.Equal(t, "qemu", domainType)
+
+	// Test case: The host has no emulator for the architecture
+	_, err = parseDomainType(capabilities, ArchRISCV64)
+	assert.Error(t, err)
+}
+
+func TestMachine_ResolveImage(t *testing.T) {
+	image := Image{
+		URL:      "https://example.com/amd64.img",
+		Checksum: "sha256:amd64",
+		Architectures: map[string]Image{
+			ArchAArch64: {URL: "https://example.com/arm64.img", Checksum: "sha256:arm64"},
+		},
+	}
+
+	// Test case: The default image is used for x86_64
+	machine := &Machine{Image: image}
+	assert.NoError(t, machine.resolveImage())
+	assert.Equal(t, Image{URL: "https://example.com/amd64.img", Checksum: "sha256:amd64"}, machine.Image)
+
+	// Test case: The image of the architecture is used
+	machine = &Machine{Arch: ArchAArch64, Image: image}
+	assert.NoError(t, machine.resolveImage())
+	assert.Equal(t, Image{URL: "https://example.com/arm64.img", Checksum: "sha256:arm64"}, machine.Image)
+
+	// Test case: The template lists no image for the architecture
+	machine = &Machine{Arch: ArchRISCV64, Image: image}
+	assert.Error(t, machine.resolveImage())
+
+	// Test case: The default image is not used for other architectures
+	machine = &Machine{Arch: ArchRISCV64, Image: Image{URL: "https://example.com/amd64.img"}}
+	assert.Error(t, machine.resolveImage())
+
+	// Test case: Images without architectures are kept for x86_64
+	machine = &Machine{Arch: ArchX86_64, Image: Image{URL: "https://example.com/amd64.img"}}
+	assert.NoError(t, machine.resolveImage())
+	assert.Equal(t, "https://example.com/amd64.img", machine.Image.URL)
+}
+
+func TestMachine_GetDisks_Arch(t *testing.T) {
+	machine := &Machine{Arch: ArchAArch64, Disks: []Disk{{Name: "data", Size: "1G", Bus: "sata"}}}
+	_, err := machine.getDisks()
+	assert.Error(t, err)
+
+	machine.Disks[0].Bus = "scsi"
+	_, err = machine.getDisks()
+	assert.NoError(t, err)
+}
+
+func TestNewDomainXML_Arch(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	dir := t.TempDir()
+	defaultPaths := aavmfPaths
+	defer func() { aavmfPaths = defaultPaths }()
+	aavmfPaths = []ovmfFiles{{filepath.Join(dir, "AAVMF_CODE.fd"), filepath.Join(dir, "AAVMF_VARS.fd")}}
+	os.WriteFile(aavmfPaths[0].Code, nil, 0644)
+	os.WriteFile(aavmfPaths[0].Vars, nil, 0644)
+
+	machine := &Machine{
+		Name:       "test-machine",
+		baseDir:    "/instances",
+		Arch:       ArchAArch64,
+		Hypervisor: &Libvirt{},
+		Resources:  Resources{CPUs: "2", Memory: "2G"},
+	}
+
+	// Test case: The emulated aarch64 machine boots with UEFI
+	definition, err := newDomainXML(machine, "qemu")
+	assert.NoError(t, err)
+	domain := domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, "qemu", domain.Type)
+	assert.Equal(t, domainOSType{Arch: "aarch64", Machine: "virt", Value: "hvm"}, domain.OS.Type)
+	assert.Equal(t, "maximum", domain.CPU.Mode)
+	assert.Nil(t, domain.Features.APIC)
+	assert.Equal(t, filepath.Join(dir, "AAVMF_CODE.fd"), domain.OS.Loader.Path)
+	assert.Equal(t, "no", domain.OS.Loader.Secure)
+
+	// Test case: Secure Boot is only supported in x86_64 machines
+	machine.Resources.Firmware = FirmwareUEFISecure
+	_, err = newDomainXML(machine, "qemu")
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package hypvsr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/osutil"
+)
+
+// Clone creates the files of a new machine from the stopped machine, with a
+// new IP address, MAC addresses, host ports, SSH key, hostname and seed disk. The disk of
+// the new machine is a copy of the machine disk or, when linked, an overlay on
+// top of it, in which case the machine can't be started, reverted or deleted
+// while the clone exists.
+func (machine *Machine) Clone(name string, linked bool) (clone *Machine, err error) {
+	// The disks of remote machines are not in the local host
+	if machine.isRemote() {
+		return nil, errors.New("machines in remote hosts can't be cloned")
+	}
+
+	// Check if the machine is stopped
+	status, err := machine.Status()
+	if err != nil {
+		return nil, err
+	}
+	// A saved machine resumes from memory that may hold writes not yet on its disk
+	if status == "saved" {
+		return nil, errors.New("the machine is suspended, resume and stop it to be cloned")
+	}
+	if status != "shut off" {
+		return nil, errors.New("the machine must be stopped to be cloned")
+	}
+
+	// Create the directory for the new machine
+	clone = machine.newClone(name)
+	err = clone.CreateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the new machine if any of the steps fails
+	defer func() {
+		if err == nil {
+			return
+		}
+		os.RemoveAll(filepath.Join(clone.baseDir, clone.Name))
+		if ipam, ipamErr := getIPAM(clone.getNetworkSettings()); ipamErr == nil {
+			ipam.Release(clone.Name)
+		}
+	}()
+
+	// Copy the files of the machine
+	err = clone.copyFiles(machine, linked)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the network configuration, user data and SSH key
+	err = clone.Prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	// The install scripts already ran in the disk of the machine
+	err = os.RemoveAll(filepath.Join(clone.baseDir, clone.Name, "bin"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the seed disk with the new configuration
+	err = clone.createSeedDisk()
+	if err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+// newClone returns a copy of the machine with a new name and without the
+// addresses that must be unique for each machine
+func (machine *Machine) newClone(name string) *Machine {
+	clone := *machine
+	clone.Name = name
+	clone.ClusterName = ""
+
+	// Clear the addresses, keeping the network settings
+	clone.Network.NicName = ""
+	clone.Network.IPAddress = ""
+	clone.Network.MacAddress = ""
+	clone.Network.SSHPort = 0
+	clone.Network.Interfaces = make([]Interface, len(machine.Network.Interfaces))
+	for i, iface := range machine.Network.Interfaces {
+		// The interfaces with static addresses use DHCP, as the addresses belong to the machine
+		iface.MacAddress = ""
+		iface.IPAddress = ""
+		clone.Network.Interfaces[i] = iface
+	}
+
+	// Assign new host ports to the forwarded ports
+	clone.Ports = make([]Port, len(machine.Ports))
+	for i, port := range machine.Ports {
+		port.HostPort = 0
+		clone.Ports[i] = port
+	}
+
+	return &clone
+}
+
+// The files created while a machine runs, which are not copied to its clones
+var runtimeFiles = []string{
+	config.GetFilename(config.PIDFilename),
+	config.GetFilename(config.ForwarderPIDFilename),
+	config.GetFilename(config.ForwarderLogFilename),
+	config.GetFilename(config.ConsoleSocketFilename),
+	config.GetFilename(config.ConsoleLogFilename),
+	config.GetFilename(config.TPMSocketFilename),
+	config.GetFilename(config.TPMLogFilename),
+	config.GetFilename(config.SavedStateFilename),
+}
+
+// copyFiles copies the files from the directory of the source machine,
+// creating an overlay of the source disk instead of copying it when linked
+func (machine *Machine) copyFiles(source *Machine, linked bool) error {
+	srcDir := filepath.Join(source.baseDir, source.Name)
+	dstDir := filepath.Join(machine.baseDir, machine.Name)
+	disk := config.GetFilename(config.DiskFilename)
+
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Skip the runtime files and the disk of linked clones
+		if !entry.Type().IsRegular() || slices.Contains(runtimeFiles, entry.Name()) {
+			continue
+		}
+		if linked && entry.Name() == disk {
+			continue
+		}
+
+		err = osutil.CopyFile(filepath.Join(srcDir, entry.Name()), filepath.Join(dstDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !linked {
+		return nil
+	}
+
+	// Create the overlay on top of the source disk
+	args := []string{
+		"create",
+		"-F", "qcow2",
+		"-b", filepath.Join(srcDir, disk),
+		"-f", "qcow2", filepath.Join(dstDir, disk),
+	}
+	_, err = machine.Runner.RunCommand("qemu-img", args)
+	return err
+}
+
+// getLinkedClones returns the names of the machines whose disks are overlays
+// on top of the disk of the machine, like its linked clones
+func (machine *Machine) getLinkedClones() ([]string, error) {
+	if machine.isRemote() {
+		return nil, nil
+	}
+	disk := filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.DiskFilename))
+
+	clones := []string{}
+	for _, other := range readInstanceFiles(machine.baseDir) {
+		if other.Name == machine.Name || other.isRemote() {
+			continue
+		}
+		otherDisk := filepath.Join(machine.baseDir, other.Name, config.GetFilename(config.DiskFilename))
+		if !fileExists(otherDisk) {
+			continue
+		}
+
+		chain, err := getBackingChain(machine.Runner, otherDisk)
+		if err != nil {
+			return nil, fmt.Errorf("reading the disk of instance %q: %w", other.Name, err)
+		}
+		if slices.Contains(chain, disk) {
+			clones = append(clones, other.Name)
+		}
+	}
+
+	return clones, nil
+}
+
+// checkLinkedClones returns an error when the disk of the machine backs the
+// disks of linked clones, which are corrupted when the disk changes
+func (machine *Machine) checkLinkedClones() error {
+	clones, err := machine.getLinkedClones()
+	if err != nil {
+		return err
+	}
+	if len(clones) > 0 {
+		return fmt.Errorf("the disk of the machine backs the linked clones %s, delete them first", strings.Join(clones, ", "))
+	}
+	return nil
+}
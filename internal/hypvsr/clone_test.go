@@ -0,0 +1,148 @@
+package hypvsr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachine_Clone(t *testing.T) {
+	source := newTestMachine(t, "shut off")
+	source.Network = Network{
+		NicName:    "virtnet",
+		IPAddress:  "192.168.122.10",
+		MacAddress: "52:54:00:00:00:01",
+		Interfaces: []Interface{{NicName: "lan", Bridge: "br-lan", MacAddress: "52:54:00:00:00:02", IPAddress: "10.0.0.5/24", Gateway: "10.0.0.1"}},
+	}
+	assert.NoError(t, source.save())
+	tmpDir := source.baseDir
+	os.WriteFile(filepath.Join(tmpDir, source.Name, config.GetFilename(config.PIDFilename)), []byte("1234"), 0644)
+
+	clone, err := source.Clone("clone", false)
+	assert.NoError(t, err)
+	dir := filepath.Join(tmpDir, "clone")
+
+	// Verify the disk is copied and the runtime files are not
+	disk, err := os.ReadFile(filepath.Join(dir, config.GetFilename(config.DiskFilename)))
+	assert.NoError(t, err)
+	assert.Equal(t, "disk", string(disk))
+	_, err = os.Stat(filepath.Join(dir, config.GetFilename(config.PIDFilename)))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "bin"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Verify the unique settings are regenerated
+	assert.Equal(t, "clone", clone.Name)
+	assert.Equal(t, "192.168.122.11", clone.Network.IPAddress)
+	assert.NotEqual(t, source.Network.MacAddress, clone.Network.MacAddress)
+	assert.Equal(t, "lan", clone.Network.Interfaces[0].NicName)
+	assert.NotEqual(t, source.Network.Interfaces[0].MacAddress, clone.Network.Interfaces[0].MacAddress)
+	assert.Empty(t, clone.Network.Interfaces[0].IPAddress)
+	assert.Equal(t, "10.0.0.5/24", source.Network.Interfaces[0].IPAddress)
+	netcfg, err := os.ReadFile(filepath.Join(dir, config.GetFilename(config.NetworkFilename)))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(netcfg), "10.0.0.5")
+	userdata, err := os.ReadFile(filepath.Join(dir, config.GetFilename(config.UserdataFilename)))
+	assert.NoError(t, err)
+	assert.Contains(t, string(userdata), "hostname: clone")
+
+	// Verify the seed disk is created for the clone
+	mockRunner := clone.Runner.(*MockRunner)
+	assert.Equal(t, "cloud-localds", mockRunner.Command)
+	assert.Contains(t, mockRunner.Args, filepath.Join(dir, config.GetFilename(config.SeedImageFilename)))
+
+	// Test case: The clone already exists
+	_, err = source.Clone("clone", false)
+	assert.Error(t, err)
+}
+
+func TestMachine_NewClone(t *testing.T) {
+	source := &Machine{
+		Name:    "source",
+		Network: Network{Mode: config.NetworkModeUser, MacAddress: "52:54:00:00:00:01", SSHPort: 2222},
+		Ports:   []Port{{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}},
+	}
+
+	// Verify the host ports are cleared to be assigned again, keeping the source ones
+	clone := source.newClone("clone")
+	assert.Equal(t, config.NetworkModeUser, clone.Network.Mode)
+	assert.Zero(t, clone.Network.SSHPort)
+	assert.Equal(t, []Port{{GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}}, clone.Ports)
+	assert.Equal(t, 8080, source.Ports[0].HostPort)
+}
+
+func TestMachine_CloneRunning(t *testing.T) {
+	source := newTestMachine(t, "shut off")
+	tmpDir := source.baseDir
+
+	// Only machines whose disks are consistent can be cloned
+	for _, state := range []string{"running", "paused", "in shutdown", "pmsuspended", "saved"} {
+		source.Hypervisor = &MockHypervisor{State: state}
+		_, err := source.Clone("clone", false)
+		assert.Error(t, err, state)
+		_, err = os.Stat(filepath.Join(tmpDir, "clone"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestMachine_CopyFilesLinked(t *testing.T) {
+	source := newTestMachine(t, "shut off")
+	tmpDir := source.baseDir
+
+	clone := source.newClone("clone")
+	assert.NoError(t, clone.CreateDir())
+	err := clone.copyFiles(source, true)
+	assert.NoError(t, err)
+
+	// Verify the disk is created as an overlay of the source disk
+	_, err = os.Stat(filepath.Join(tmpDir, "clone", config.GetFilename(config.DiskFilename)))
+	assert.True(t, os.IsNotExist(err))
+	mockRunner := clone.Runner.(*MockRunner)
+	assert.Equal(t, "qemu-img", mockRunner.Command)
+	assert.Equal(t, []string{
+		"create",
+		"-F", "qcow2",
+		"-b", filepath.Join(tmpDir, source.Name, "disk.img"),
+		"-f", "qcow2", filepath.Join(tmpDir, "clone", "disk.img"),
+	}, mockRunner.Args)
+}
+
+func TestMachine_LinkedClones(t *testing.T) {
+	source := newTestMachine(t, "shut off")
+	tmpDir := source.baseDir
+	hypervisor := source.Hypervisor.(*MockHypervisor)
+	runner := source.Runner.(*MockRunner)
+
+	// Create a linked clone, an overlay of the disk of the source
+	clone := source.newClone("clone")
+	assert.NoError(t, clone.CreateDir())
+	assert.NoError(t, clone.save())
+	cloneDisk := filepath.Join(tmpDir, "clone", config.GetFilename(config.DiskFilename))
+	os.WriteFile(cloneDisk, []byte("overlay"), 0644)
+	runner.Output = `[
+		{"filename": "` + cloneDisk + `", "full-backing-filename": "` + filepath.Join(tmpDir, source.Name, "disk.img") + `"},
+		{"filename": "` + filepath.Join(tmpDir, source.Name, "disk.img") + `"}
+	]`
+
+	clones, err := source.getLinkedClones()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"clone"}, clones)
+
+	// Test case: The source can't change while the clone uses its disk
+	assert.Error(t, source.Start())
+	assert.Error(t, source.Delete())
+	assert.Error(t, source.RevertSnapshot("snapshot"))
+	hypervisor.State = "saved"
+	assert.Error(t, source.Resume())
+	assert.NotContains(t, hypervisor.Calls, "Start")
+	assert.NotContains(t, hypervisor.Calls, "Delete")
+	assert.NotContains(t, hypervisor.Calls, "RevertSnapshot")
+
+	// Test case: The source is free once no disk is backed by it
+	runner.Output = `[{"filename": "` + cloneDisk + `"}]`
+	assert.NoError(t, source.Start())
+	assert.Contains(t, hypervisor.Calls, "Start")
+}
@@ -0,0 +1,137 @@
+package hypvsr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/enkodr/machina/internal/config"
+	"golang.org/x/term"
+)
+
+// The character that detaches the terminal from the console, Ctrl+]
+const consoleEscape = 0x1d
+
+// Console attaches the terminal to the serial console of the running machine
+// until Ctrl+] is pressed
+func (machine *Machine) Console() error {
+	status, err := machine.Status()
+	if err != nil {
+		return err
+	}
+	if status != "running" {
+		return errors.New("the machine is not running")
+	}
+
+	conn, err := machine.dialConsole()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Pass the keys to the console as they are typed when attached to a terminal
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+	}
+
+	return attachConsole(conn, os.Stdin, os.Stdout)
+}
+
+// ConsoleLog writes the output of the serial console of the machine, kept
+// since it was created, to the writer
+func (machine *Machine) ConsoleLog(w io.Writer) error {
+	path := filepath.Join(machine.getDiskDir(), config.GetFilename(config.ConsoleLogFilename))
+
+	// Read the log from the remote host the machine runs in, if any
+	jump, err := machine.connectJumpHost()
+	if err != nil {
+		return err
+	}
+	if jump != nil {
+		defer jump.Close()
+
+		var stderr bytes.Buffer
+		code, err := jump.Run("cat "+shellQuote(path), nil, w, &stderr)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("reading %s: %s", path, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil
+	}
+	if machine.isRemote() {
+		return errors.New("the console log of machines in remote hosts is only read with the ssh transport")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Opens a connection to the socket of the serial console of the machine
+func (machine *Machine) dialConsole() (net.Conn, error) {
+	path := filepath.Join(machine.getDiskDir(), config.GetFilename(config.ConsoleSocketFilename))
+
+	// Open the socket of the remote host the machine runs in, if any
+	jump, err := machine.connectJumpHost()
+	if err != nil {
+		return nil, err
+	}
+	if jump != nil {
+		conn, err := jump.DialUnix(path)
+		if err != nil {
+			jump.Close()
+			return nil, err
+		}
+		return &tunnelConn{Conn: conn, client: jump}, nil
+	}
+	if machine.isRemote() {
+		return nil, errors.New("the console of machines in remote hosts is only reached with the ssh transport")
+	}
+
+	return net.Dial("unix", path)
+}
+
+// attachConsole copies the input to the console and the output of the console
+// to the writer until the escape character is read or the console is closed
+func attachConsole(conn net.Conn, in io.Reader, out io.Writer) error {
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(out, conn)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, &escapeReader{r: in})
+		done <- err
+	}()
+
+	return <-done
+}
+
+// escapeReader ends the input at the console escape character
+type escapeReader struct {
+	r io.Reader
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if i := bytes.IndexByte(p[:n], consoleEscape); i >= 0 {
+		return i, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+package hypvsr
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeReader(t *testing.T) {
+	// Test case: The input ends at the escape character
+	data, err := io.ReadAll(&escapeReader{r: strings.NewReader("ls\r\x1dexit\r")})
+	assert.NoError(t, err)
+	assert.Equal(t, "ls\r", string(data))
+
+	// Test case: The input without the escape character is kept
+	data, err = io.ReadAll(&escapeReader{r: strings.NewReader("ls\r")})
+	assert.NoError(t, err)
+	assert.Equal(t, "ls\r", string(data))
+}
+
+func TestMachine_Console(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	dir := t.TempDir()
+	machine := &Machine{Name: "test-machine", baseDir: dir, Hypervisor: &MockHypervisor{}}
+	os.MkdirAll(filepath.Join(dir, machine.Name), 0755)
+
+	// Start a console that echoes the input
+	listener, err := net.Listen("unix", filepath.Join(dir, machine.Name, config.GetFilename(config.ConsoleSocketFilename)))
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// Test case: The input is sent until the escape character
+	conn, err := machine.dialConsole()
+	assert.NoError(t, err)
+	in, input := io.Pipe()
+	output, out := io.Pipe()
+	done := make(chan error)
+	go func() { done <- attachConsole(conn, in, out) }()
+	io.WriteString(input, "hello\r")
+	echo := make([]byte, 6)
+	_, err = io.ReadFull(output, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\r", string(echo))
+	io.WriteString(input, "\x1d")
+	assert.NoError(t, <-done)
+	conn.Close()
+
+	// Test case: The console log is printed
+	os.WriteFile(filepath.Join(dir, machine.Name, config.GetFilename(config.ConsoleLogFilename)), []byte("Booting\n"), 0644)
+	var log bytes.Buffer
+	assert.NoError(t, machine.ConsoleLog(&log))
+	assert.Equal(t, "Booting\n", log.String())
+}
@@ -0,0 +1,611 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enkodr/machina/internal/config"
+)
+
+// domainXML holds the libvirt domain definition of a machine
+type domainXML struct {
+	XMLName    xml.Name       `xml:"domain"`
+	Type       string         `xml:"type,attr"`
+	Name       string         `xml:"name"`
+	UUID       string         `xml:"uuid,omitempty"`
+	Memory     domainMemory   `xml:"memory"`
+	Backing    *domainBacking `xml:"memoryBacking"`
+	VCPU       string         `xml:"vcpu"`
+	OS         domainOS       `xml:"os"`
+	Features   domainFeatures `xml:"features"`
+	CPU        domainCPU      `xml:"cpu"`
+	Clock      domainClock    `xml:"clock"`
+	OnPoweroff string         `xml:"on_poweroff"`
+	OnReboot   string         `xml:"on_reboot"`
+	OnCrash    string         `xml:"on_crash"`
+	Devices    domainDevices  `xml:"devices"`
+}
+
+type domainMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value string `xml:",chardata"`
+}
+
+type domainBacking struct {
+	HugePages *struct{} `xml:"hugepages"`
+}
+
+type domainOS struct {
+	Firmware     string          `xml:"firmware,attr,omitempty"`
+	Type         domainOSType    `xml:"type"`
+	FirmwareInfo *domainFirmware `xml:"firmware"`
+	Loader       *domainLoader   `xml:"loader"`
+	NVRAM        *domainNVRAM    `xml:"nvram"`
+	Boot         domainBoot      `xml:"boot"`
+}
+
+type domainFirmware struct {
+	Features []domainFirmwareFeature `xml:"feature"`
+}
+
+type domainFirmwareFeature struct {
+	Enabled string `xml:"enabled,attr"`
+	Name    string `xml:"name,attr"`
+}
+
+type domainLoader struct {
+	ReadOnly string `xml:"readonly,attr"`
+	Secure   string `xml:"secure,attr,omitempty"`
+	Type     string `xml:"type,attr"`
+	Path     string `xml:",chardata"`
+}
+
+type domainNVRAM struct {
+	Template string `xml:"template,attr,omitempty"`
+	Path     string `xml:",chardata"`
+}
+
+type domainOSType struct {
+	Arch    string `xml:"arch,attr,omitempty"`
+	Machine string `xml:"machine,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+type domainBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type domainFeatures struct {
+	ACPI *struct{}    `xml:"acpi"`
+	APIC *struct{}    `xml:"apic"`
+	SMM  *domainState `xml:"smm"`
+}
+
+type domainState struct {
+	State string `xml:"state,attr"`
+}
+
+type domainCPU struct {
+	Mode     string             `xml:"mode,attr"`
+	Match    string             `xml:"match,attr,omitempty"`
+	Model    *domainCPUModel    `xml:"model"`
+	Topology *domainTopology    `xml:"topology"`
+	Features []domainCPUFeature `xml:"feature"`
+	NUMA     *domainNUMA        `xml:"numa"`
+}
+
+type domainCPUModel struct {
+	Fallback string `xml:"fallback,attr"`
+	Name     string `xml:",chardata"`
+}
+
+type domainTopology struct {
+	Sockets int `xml:"sockets,attr"`
+	Cores   int `xml:"cores,attr"`
+	Threads int `xml:"threads,attr"`
+}
+
+type domainCPUFeature struct {
+	Policy string `xml:"policy,attr"`
+	Name   string `xml:"name,attr"`
+}
+
+type domainNUMA struct {
+	Cells []domainNUMACell `xml:"cell"`
+}
+
+type domainNUMACell struct {
+	ID     int    `xml:"id,attr"`
+	CPUs   string `xml:"cpus,attr"`
+	Memory int    `xml:"memory,attr"`
+	Unit   string `xml:"unit,attr"`
+}
+
+type domainClock struct {
+	Offset string `xml:"offset,attr"`
+}
+
+type domainDevices struct {
+	Disks       []domainDisk       `xml:"disk"`
+	Controllers []domainController `xml:"controller"`
+	Filesystems []domainFilesystem `xml:"filesystem"`
+	Interfaces  []domainInterface  `xml:"interface"`
+	Serials     []domainChar       `xml:"serial"`
+	Consoles    []domainChar       `xml:"console"`
+	TPM         *domainTPM         `xml:"tpm"`
+	RNG         domainRNG          `xml:"rng"`
+	MemBalloon  *domainMemBalloon  `xml:"memballoon"`
+}
+
+type domainDisk struct {
+	Type   string       `xml:"type,attr"`
+	Device string       `xml:"device,attr"`
+	Driver domainDriver `xml:"driver"`
+	Source domainSource `xml:"source"`
+	Target domainTarget `xml:"target"`
+	Serial string       `xml:"serial,omitempty"`
+}
+
+type domainDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type domainSource struct {
+	Mode    string `xml:"mode,attr,omitempty"`
+	Path    string `xml:"path,attr,omitempty"`
+	File    string `xml:"file,attr,omitempty"`
+	Dir     string `xml:"dir,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+	Network string `xml:"network,attr,omitempty"`
+}
+
+type domainTarget struct {
+	Dev  string `xml:"dev,attr,omitempty"`
+	Bus  string `xml:"bus,attr,omitempty"`
+	Dir  string `xml:"dir,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Port *int   `xml:"port,attr"`
+}
+
+type domainController struct {
+	Type  string `xml:"type,attr"`
+	Model string `xml:"model,attr,omitempty"`
+}
+
+type domainFilesystem struct {
+	Type       string       `xml:"type,attr"`
+	AccessMode string       `xml:"accessmode,attr"`
+	Source     domainSource `xml:"source"`
+	Target     domainTarget `xml:"target"`
+	ReadOnly   *struct{}    `xml:"readonly"`
+}
+
+type domainInterface struct {
+	Type         string              `xml:"type,attr"`
+	MAC          domainMAC           `xml:"mac"`
+	Source       *domainSource       `xml:"source"`
+	Model        domainModel         `xml:"model"`
+	Backend      *domainModel        `xml:"backend"`
+	PortForwards []domainPortForward `xml:"portForward"`
+}
+
+type domainPortForward struct {
+	Proto   string          `xml:"proto,attr"`
+	Address string          `xml:"address,attr,omitempty"`
+	Ranges  []domainPortMap `xml:"range"`
+}
+
+type domainPortMap struct {
+	Start int `xml:"start,attr"`
+	To    int `xml:"to,attr"`
+}
+
+type domainMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type domainModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type domainChar struct {
+	Type   string        `xml:"type,attr"`
+	Source *domainSource `xml:"source"`
+	Log    *domainLog    `xml:"log"`
+	Target domainTarget  `xml:"target"`
+}
+
+type domainLog struct {
+	File   string `xml:"file,attr"`
+	Append string `xml:"append,attr,omitempty"`
+}
+
+type domainTPM struct {
+	Model   string           `xml:"model,attr"`
+	Backend domainTPMBackend `xml:"backend"`
+}
+
+type domainTPMBackend struct {
+	Type    string `xml:"type,attr"`
+	Version string `xml:"version,attr"`
+}
+
+type domainMemBalloon struct {
+	Model string `xml:"model,attr"`
+}
+
+type domainRNG struct {
+	Model   string        `xml:"model,attr"`
+	Backend domainBackend `xml:"backend"`
+}
+
+type domainBackend struct {
+	Model string `xml:"model,attr"`
+	Value string `xml:",chardata"`
+}
+
+// domainSnapshotXML holds the libvirt definition of a domain snapshot
+type domainSnapshotXML struct {
+	XMLName      xml.Name             `xml:"domainsnapshot"`
+	Name         string               `xml:"name"`
+	CreationTime int64                `xml:"creationTime,omitempty"`
+	Disks        []domainSnapshotDisk `xml:"disks>disk,omitempty"`
+}
+
+type domainSnapshotDisk struct {
+	Name     string `xml:"name,attr"`
+	Snapshot string `xml:"snapshot,attr"`
+}
+
+// newDomainXML generates the libvirt domain definition of the machine, run
+// by the domain type, kvm when accelerated or qemu when emulated
+func newDomainXML(machine *Machine, domainType string) ([]byte, error) {
+	domain, err := newDomain(machine, domainType)
+	if err != nil {
+		return nil, err
+	}
+
+	return xml.MarshalIndent(domain, "", "  ")
+}
+
+// newDomain builds the libvirt domain of the machine, run by the domain type
+func newDomain(machine *Machine, domainType string) (*domainXML, error) {
+	// Validate and convert the memory
+	ram, err := convertMemory(machine.Resources.Memory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory: %w", err)
+	}
+
+	arch, err := machine.getArch()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := machine.getArchSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	// The mount points are in the local host
+	if machine.isRemote() && len(machine.getMounts()) > 0 {
+		return nil, errors.New("mount points are not supported in remote hosts")
+	}
+
+	// Serve the serial console on a socket, keeping its output in the console log
+	port := 0
+	dir := machine.getDiskDir()
+	consoleSource := &domainSource{Mode: "bind", Path: filepath.Join(dir, config.GetFilename(config.ConsoleSocketFilename))}
+	consoleLog := &domainLog{File: filepath.Join(dir, config.GetFilename(config.ConsoleLogFilename)), Append: "on"}
+	domain := domainXML{
+		Type:       domainType,
+		Name:       machine.Name,
+		Memory:     domainMemory{Unit: "MiB", Value: ram},
+		VCPU:       machine.Resources.CPUs,
+		OS:         domainOS{Type: domainOSType{Arch: arch, Machine: spec.MachineType, Value: "hvm"}, Boot: domainBoot{Dev: "hd"}},
+		CPU:        domainCPU{Mode: "host-passthrough"},
+		Clock:      domainClock{Offset: "utc"},
+		OnPoweroff: "destroy",
+		OnReboot:   "restart",
+		OnCrash:    "destroy",
+		Devices: domainDevices{
+			Serials:  []domainChar{{Type: "unix", Source: consoleSource, Log: consoleLog, Target: domainTarget{Port: &port}}},
+			Consoles: []domainChar{{Type: "unix", Source: consoleSource, Log: consoleLog, Target: domainTarget{Type: "serial", Port: &port}}},
+			RNG:      domainRNG{Model: "virtio", Backend: domainBackend{Model: "random", Value: "/dev/urandom"}},
+		},
+	}
+
+	// Emulate the CPU with all the features supported when not accelerated
+	if domainType != "kvm" {
+		domain.CPU.Mode = "maximum"
+	}
+
+	// APIC is only found in x86 machines, while RISC-V ones boot without ACPI
+	switch arch {
+	case ArchX86_64:
+		domain.Features = domainFeatures{ACPI: &struct{}{}, APIC: &struct{}{}}
+	case ArchAArch64:
+		domain.Features = domainFeatures{ACPI: &struct{}{}}
+	}
+
+	// Lay out the CPUs and memory of the machine
+	err = setDomainResources(&domain, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the firmware the machine boots with
+	err = setDomainFirmware(&domain, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attach a software TPM, run by libvirt along with the machine
+	if machine.Resources.TPM {
+		domain.Devices.TPM = &domainTPM{Model: spec.TPMModel, Backend: domainTPMBackend{Type: "emulator", Version: "2.0"}}
+	}
+
+	// Attach the machine disk and the seed disk
+	devices := &domain.Devices
+	devices.Disks = append(devices.Disks,
+		domainDisk{
+			Type:   "file",
+			Device: "disk",
+			Driver: domainDriver{Name: "qemu", Type: "qcow2"},
+			Source: domainSource{File: filepath.Join(dir, config.GetFilename(config.DiskFilename))},
+			Target: domainTarget{Dev: diskTargetDev("vd", 0), Bus: "virtio"},
+		},
+		domainDisk{
+			Type:   "file",
+			Device: "disk",
+			Driver: domainDriver{Name: "qemu", Type: "raw"},
+			Source: domainSource{File: filepath.Join(dir, config.GetFilename(config.SeedImageFilename))},
+			Target: domainTarget{Dev: diskTargetDev("vd", 1), Bus: "virtio"},
+		},
+	)
+
+	// Attach the data disks, virtio disks are named vdX while scsi and sata ones are named sdX
+	disks, err := machine.getDisks()
+	if err != nil {
+		return nil, err
+	}
+	virtio, sd := 2, 0
+	for _, disk := range disks {
+		target := domainTarget{Bus: disk.Bus}
+		switch disk.Bus {
+		case "virtio":
+			target.Dev = diskTargetDev("vd", virtio)
+			virtio++
+		default:
+			target.Dev = diskTargetDev("sd", sd)
+			sd++
+		}
+		if disk.Bus == "scsi" && len(devices.Controllers) == 0 {
+			devices.Controllers = append(devices.Controllers, domainController{Type: "scsi", Model: "virtio-scsi"})
+		}
+
+		devices.Disks = append(devices.Disks, domainDisk{
+			Type:   "file",
+			Device: "disk",
+			Driver: domainDriver{Name: "qemu", Type: disk.Format},
+			Source: domainSource{File: machine.getDataDiskPath(disk)},
+			Target: target,
+			Serial: disk.getSerial(),
+		})
+	}
+
+	// Attach the primary interface to the bridge of the network or, in user
+	// mode, to a passt backend forwarding SSH and the udp ports from the host.
+	// The tcp ports are forwarded through SSH, which can be changed while the
+	// machine runs.
+	primary := domainInterface{
+		Type:   "bridge",
+		MAC:    domainMAC{Address: machine.Network.MacAddress},
+		Source: &domainSource{Bridge: machine.getNetworkSettings().Bridge},
+		Model:  domainModel{Type: "virtio"},
+	}
+	if machine.getNetworkSettings().Mode == config.NetworkModeUser {
+		primary.Type = "user"
+		primary.Source = nil
+		primary.Backend = &domainModel{Type: "passt"}
+		primary.PortForwards = []domainPortForward{{
+			Proto:   "tcp",
+			Address: localhost,
+			Ranges:  []domainPortMap{{Start: machine.Network.SSHPort, To: 22}},
+		}}
+		for _, port := range machine.Ports {
+			if isTunnelled(port) {
+				continue
+			}
+			primary.PortForwards = append(primary.PortForwards, domainPortForward{
+				Proto:   port.Protocol,
+				Address: port.HostAddress,
+				Ranges:  []domainPortMap{{Start: port.HostPort, To: port.GuestPort}},
+			})
+		}
+	}
+	devices.Interfaces = append(devices.Interfaces, primary)
+
+	// Attach the additional interfaces to their bridge or libvirt network
+	for _, iface := range machine.Network.Interfaces {
+		nic := domainInterface{
+			Type:   "bridge",
+			MAC:    domainMAC{Address: iface.MacAddress},
+			Source: &domainSource{Bridge: iface.Bridge},
+			Model:  domainModel{Type: "virtio"},
+		}
+		if iface.Network != "" {
+			nic.Type = "network"
+			nic.Source = &domainSource{Network: iface.Network}
+		}
+		devices.Interfaces = append(devices.Interfaces, nic)
+	}
+
+	// Share the mount points, tagged with the path inside the machine
+	for _, mount := range machine.getMounts() {
+		filesystem := domainFilesystem{
+			Type:       "mount",
+			AccessMode: "passthrough",
+			Source:     domainSource{Dir: mount.HostPath},
+			Target:     domainTarget{Dir: mount.GuestPath},
+		}
+		if mount.ReadOnly {
+			filesystem.ReadOnly = &struct{}{}
+		}
+		devices.Filesystems = append(devices.Filesystems, filesystem)
+	}
+
+	return &domain, nil
+}
+
+// setDomainResources sets the CPU model and topology, the NUMA nodes and the
+// memory backing and balloon of the domain
+func setDomainResources(domain *domainXML, machine *Machine) error {
+	topology, err := machine.getCPUTopology()
+	if err != nil {
+		return err
+	}
+	if topology.Sockets > 0 {
+		domain.VCPU = strconv.Itoa(topology.CPUs)
+		domain.CPU.Topology = &domainTopology{Sockets: topology.Sockets, Cores: topology.Cores, Threads: topology.Threads}
+	}
+
+	// Use the CPU model of the machine, toggling nested virtualization
+	if model := machine.Resources.CPU.Model; model != "" {
+		domain.CPU.Mode = "custom"
+		domain.CPU.Match = "exact"
+		domain.CPU.Model = &domainCPUModel{Fallback: "forbid", Name: model}
+	}
+	feature, err := machine.getNestedFeature()
+	if err != nil {
+		return err
+	}
+	if feature != "" {
+		policy := "disable"
+		if *machine.Resources.CPU.Nested {
+			policy = "require"
+		}
+		domain.CPU.Features = append(domain.CPU.Features, domainCPUFeature{Policy: policy, Name: feature})
+	}
+
+	cells, err := machine.getNUMACells(topology.CPUs)
+	if err != nil {
+		return err
+	}
+	if len(cells) > 0 {
+		domain.CPU.NUMA = &domainNUMA{}
+		for i, cell := range cells {
+			domain.CPU.NUMA.Cells = append(domain.CPU.NUMA.Cells, domainNUMACell{ID: i, CPUs: strings.Join(cell.CPUs, ","), Memory: cell.Memory, Unit: "MiB"})
+		}
+	}
+
+	if machine.Resources.HugePages {
+		domain.Backing = &domainBacking{HugePages: &struct{}{}}
+	}
+
+	// libvirt attaches a memory balloon by default, which is removed with the none model
+	if machine.Resources.Balloon != nil {
+		domain.Devices.MemBalloon = &domainMemBalloon{Model: "none"}
+		if *machine.Resources.Balloon {
+			domain.Devices.MemBalloon.Model = "virtio"
+		}
+	}
+
+	return nil
+}
+
+// setDomainFirmware sets the firmware of the domain. UEFI boots from the OVMF
+// build of the host with the NVRAM of the machine, while in remote hosts the
+// firmware is selected by libvirt.
+func setDomainFirmware(domain *domainXML, machine *Machine) error {
+	firmware, err := machine.getFirmware()
+	if err != nil || firmware == FirmwareBIOS {
+		return err
+	}
+
+	// Secure Boot needs the firmware to run in system management mode
+	secure := "no"
+	if firmware == FirmwareUEFISecure {
+		secure = "yes"
+		domain.Features.SMM = &domainState{State: "on"}
+	}
+
+	if machine.isRemote() {
+		domain.OS.Firmware = "efi"
+		domain.OS.FirmwareInfo = &domainFirmware{Features: []domainFirmwareFeature{
+			{Enabled: secure, Name: "secure-boot"},
+			{Enabled: secure, Name: "enrolled-keys"},
+		}}
+		return nil
+	}
+
+	arch, err := machine.getArch()
+	if err != nil {
+		return err
+	}
+	ovmf, err := findOVMF(arch, firmware)
+	if err != nil {
+		return err
+	}
+	domain.OS.Loader = &domainLoader{ReadOnly: "yes", Secure: secure, Type: "pflash", Path: ovmf.Code}
+	domain.OS.NVRAM = &domainNVRAM{Template: ovmf.Vars, Path: filepath.Join(machine.getDiskDir(), config.GetFilename(config.NVRAMFilename))}
+	return nil
+}
+
+// newDomainSnapshotXML generates the definition of a snapshot of the machine.
+// Internal snapshots are not supported by raw disks, so these are skipped, nor
+// by the pflash firmware of the machines that boot with UEFI.
+func newDomainSnapshotXML(machine *Machine, name string) ([]byte, error) {
+	firmware, err := machine.getFirmware()
+	if err != nil {
+		return nil, err
+	}
+	if firmware != FirmwareBIOS {
+		return nil, fmt.Errorf("libvirt can't take snapshots of machines with %s firmware, as their NVRAM is in pflash", firmware)
+	}
+
+	snapshot := domainSnapshotXML{
+		Name: name,
+		Disks: []domainSnapshotDisk{
+			{Name: filepath.Join(machine.getDiskDir(), config.GetFilename(config.SeedImageFilename)), Snapshot: "no"},
+		},
+	}
+
+	disks, err := machine.getDisks()
+	if err != nil {
+		return nil, err
+	}
+	for _, disk := range disks {
+		if disk.Format == "raw" {
+			snapshot.Disks = append(snapshot.Disks, domainSnapshotDisk{Name: machine.getDataDiskPath(disk), Snapshot: "no"})
+		}
+	}
+
+	return xml.MarshalIndent(snapshot, "", "  ")
+}
+
+// parseDomainSnapshotXML parses the definition of a domain snapshot
+func parseDomainSnapshotXML(data string) (Snapshot, error) {
+	snapshot := domainSnapshotXML{}
+	err := xml.Unmarshal([]byte(data), &snapshot)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return Snapshot{Name: snapshot.Name, CreatedAt: time.Unix(snapshot.CreationTime, 0)}, nil
+}
+
+// diskTargetDev returns the name of the disk device with the prefix at the index,
+// following the vda, vdb, ..., vdz, vdaa naming of libvirt
+func diskTargetDev(prefix string, index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('a'+index%26)) + name
+		index = index/26 - 1
+	}
+	return prefix + name
+}
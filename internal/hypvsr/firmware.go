@@ -0,0 +1,176 @@
+package hypvsr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/osutil"
+)
+
+// Firmwares the machines boot with
+const (
+	// Legacy BIOS, provided by SeaBIOS
+	FirmwareBIOS = "bios"
+	// UEFI, provided by OVMF
+	FirmwareUEFI = "uefi"
+	// UEFI with Secure Boot enabled and the Microsoft keys enrolled, when available
+	FirmwareUEFISecure = "uefi-secure"
+)
+
+// ovmfFiles holds the paths of the code and the NVRAM template of an OVMF build
+type ovmfFiles struct {
+	Code string
+	Vars string
+}
+
+// The OVMF builds shipped by the distributions, in order of preference
+var (
+	ovmfPaths = []ovmfFiles{
+		// Debian and Ubuntu
+		{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		// Fedora and RHEL
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+		// Arch Linux
+		{"/usr/share/edk2/x64/OVMF_CODE.4m.fd", "/usr/share/edk2/x64/OVMF_VARS.4m.fd"},
+		// openSUSE
+		{"/usr/share/qemu/ovmf-x86_64-code.bin", "/usr/share/qemu/ovmf-x86_64-vars.bin"},
+	}
+	ovmfSecurePaths = []ovmfFiles{
+		{"/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+		{"/usr/share/edk2/x64/OVMF_CODE.secboot.4m.fd", "/usr/share/edk2/x64/OVMF_VARS.4m.fd"},
+		{"/usr/share/qemu/ovmf-x86_64-smm-ms-code.bin", "/usr/share/qemu/ovmf-x86_64-smm-ms-vars.bin"},
+	}
+	aavmfPaths = []ovmfFiles{
+		// Debian and Ubuntu
+		{"/usr/share/AAVMF/AAVMF_CODE.fd", "/usr/share/AAVMF/AAVMF_VARS.fd"},
+		// Fedora and RHEL
+		{"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+		// Arch Linux
+		{"/usr/share/edk2/aarch64/QEMU_CODE.fd", "/usr/share/edk2/aarch64/QEMU_VARS.fd"},
+	}
+	riscvPaths = []ovmfFiles{
+		// Debian and Ubuntu
+		{"/usr/share/qemu-efi-riscv64/RISCV_VIRT_CODE.fd", "/usr/share/qemu-efi-riscv64/RISCV_VIRT_VARS.fd"},
+		// Fedora and Arch Linux
+		{"/usr/share/edk2/riscv/RISCV_VIRT_CODE.fd", "/usr/share/edk2/riscv/RISCV_VIRT_VARS.fd"},
+	}
+)
+
+// getFirmware returns the firmware of the machine, BIOS by default on x86_64
+// and UEFI on the architectures that only boot with it
+func (machine *Machine) getFirmware() (string, error) {
+	arch, err := machine.getArch()
+	if err != nil {
+		return "", err
+	}
+
+	firmware := machine.Resources.Firmware
+	switch firmware {
+	case "":
+		if archSpecs[arch].UEFIOnly {
+			return FirmwareUEFI, nil
+		}
+		return FirmwareBIOS, nil
+	case FirmwareBIOS, FirmwareUEFISecure:
+		if arch != ArchX86_64 {
+			return "", fmt.Errorf("firmware %q is only supported in %s machines", firmware, ArchX86_64)
+		}
+		return firmware, nil
+	case FirmwareUEFI:
+		return firmware, nil
+	default:
+		return "", fmt.Errorf("unsupported firmware %q, must be one of: %s, %s, %s", firmware, FirmwareBIOS, FirmwareUEFI, FirmwareUEFISecure)
+	}
+}
+
+// findOVMF returns the first OVMF build installed in the host for the
+// architecture and the firmware
+func findOVMF(arch string, firmware string) (ovmfFiles, error) {
+	paths := ovmfPaths
+	switch {
+	case arch == ArchAArch64:
+		paths = aavmfPaths
+	case arch == ArchRISCV64:
+		paths = riscvPaths
+	case firmware == FirmwareUEFISecure:
+		paths = ovmfSecurePaths
+	}
+
+	for _, files := range paths {
+		if fileExists(files.Code) && fileExists(files.Vars) {
+			return files, nil
+		}
+	}
+
+	return ovmfFiles{}, fmt.Errorf("no UEFI firmware found for %q in %s machines, install the ovmf, qemu-efi or edk2 package of the architecture", firmware, arch)
+}
+
+// Creates the NVRAM of a machine that boots with UEFI from the template of
+// the OVMF build, where the firmware keeps its variables
+func (machine *Machine) createNVRAM() error {
+	firmware, err := machine.getFirmware()
+	if err != nil || firmware == FirmwareBIOS {
+		return err
+	}
+
+	arch, err := machine.getArch()
+	if err != nil {
+		return err
+	}
+	ovmf, err := findOVMF(arch, firmware)
+	if err != nil {
+		return err
+	}
+
+	return osutil.CopyFile(ovmf.Vars, filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.NVRAMFilename)))
+}
+
+// startTPM starts the software TPM of the machine in the background, which
+// keeps its state in the machine directory and exits with the machine
+func startTPM(vm *Machine) error {
+	dir := filepath.Join(vm.baseDir, vm.Name)
+	stateDir := filepath.Join(dir, config.GetFilename(config.TPMStateFilename))
+	socket := filepath.Join(dir, config.GetFilename(config.TPMSocketFilename))
+	err := os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return err
+	}
+	os.Remove(socket)
+
+	args := []string{
+		"socket",
+		"--tpm2",
+		"--tpmstate", fmt.Sprintf("dir=%s", stateDir),
+		"--ctrl", fmt.Sprintf("type=unixio,path=%s", socket),
+		"--log", fmt.Sprintf("file=%s", filepath.Join(dir, config.GetFilename(config.TPMLogFilename))),
+		"--terminate",
+		"--daemon",
+	}
+	out, err := exec.Command("swtpm", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("starting swtpm: %w: %s", err, out)
+	}
+
+	// Wait for the socket QEMU connects to
+	for i := 0; i < 50; i++ {
+		if fileExists(socket) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("timeout waiting for swtpm to start")
+}
+
+// fileExists checks if the file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,123 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupOVMF points the OVMF builds to files in a temporary directory
+func setupOVMF(t *testing.T) string {
+	dir := t.TempDir()
+	for _, name := range []string{"OVMF_CODE.fd", "OVMF_VARS.fd", "OVMF_CODE.secboot.fd", "OVMF_VARS.ms.fd"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	defaultPaths, defaultSecurePaths := ovmfPaths, ovmfSecurePaths
+	ovmfPaths = []ovmfFiles{
+		{filepath.Join(dir, "missing.fd"), filepath.Join(dir, "OVMF_VARS.fd")},
+		{filepath.Join(dir, "OVMF_CODE.fd"), filepath.Join(dir, "OVMF_VARS.fd")},
+	}
+	ovmfSecurePaths = []ovmfFiles{{filepath.Join(dir, "OVMF_CODE.secboot.fd"), filepath.Join(dir, "OVMF_VARS.ms.fd")}}
+	t.Cleanup(func() { ovmfPaths, ovmfSecurePaths = defaultPaths, defaultSecurePaths })
+
+	return dir
+}
+
+func TestFindOVMF(t *testing.T) {
+	dir := setupOVMF(t)
+
+	// Test case: The first installed build is used
+	ovmf, err := findOVMF(ArchX86_64, FirmwareUEFI)
+	assert.NoError(t, err)
+	assert.Equal(t, ovmfFiles{filepath.Join(dir, "OVMF_CODE.fd"), filepath.Join(dir, "OVMF_VARS.fd")}, ovmf)
+
+	// Test case: Secure Boot uses its own build
+	ovmf, err = findOVMF(ArchX86_64, FirmwareUEFISecure)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "OVMF_CODE.secboot.fd"), ovmf.Code)
+
+	// Test case: No build is installed
+	ovmfPaths = nil
+	_, err = findOVMF(ArchX86_64, FirmwareUEFI)
+	assert.Error(t, err)
+}
+
+func TestMachine_GetFirmware(t *testing.T) {
+	machine := &Machine{}
+	firmware, err := machine.getFirmware()
+	assert.NoError(t, err)
+	assert.Equal(t, FirmwareBIOS, firmware)
+
+	machine.Resources.Firmware = "uefi-secure"
+	firmware, err = machine.getFirmware()
+	assert.NoError(t, err)
+	assert.Equal(t, FirmwareUEFISecure, firmware)
+
+	machine.Resources.Firmware = "efi"
+	_, err = machine.getFirmware()
+	assert.Error(t, err)
+}
+
+func TestMachine_CreateNVRAM(t *testing.T) {
+	setupOVMF(t)
+	dir := t.TempDir()
+	machine := &Machine{Name: "test-machine", baseDir: dir}
+	os.MkdirAll(filepath.Join(dir, machine.Name), 0755)
+	nvram := filepath.Join(dir, machine.Name, config.GetFilename(config.NVRAMFilename))
+
+	// Test case: Machines booting with BIOS have no NVRAM
+	assert.NoError(t, machine.createNVRAM())
+	assert.NoFileExists(t, nvram)
+
+	// Test case: The NVRAM is copied from the template of the firmware
+	machine.Resources.Firmware = FirmwareUEFISecure
+	assert.NoError(t, machine.createNVRAM())
+	content, err := os.ReadFile(nvram)
+	assert.NoError(t, err)
+	assert.Equal(t, "OVMF_VARS.ms.fd", string(content))
+}
+
+func TestNewDomainXML_Firmware(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	dir := setupOVMF(t)
+	machine := &Machine{
+		Name:       "test-machine",
+		baseDir:    "/instances",
+		Hypervisor: &Libvirt{},
+		Resources:  Resources{CPUs: "1", Memory: "1G", Firmware: FirmwareUEFISecure, TPM: true},
+	}
+
+	// Test case: The local firmware boots with the NVRAM of the machine
+	definition, err := newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	domain := domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, &domainLoader{ReadOnly: "yes", Secure: "yes", Type: "pflash", Path: filepath.Join(dir, "OVMF_CODE.secboot.fd")}, domain.OS.Loader)
+	assert.Equal(t, &domainNVRAM{Template: filepath.Join(dir, "OVMF_VARS.ms.fd"), Path: "/instances/test-machine/nvram.fd"}, domain.OS.NVRAM)
+	assert.Equal(t, &domainState{State: "on"}, domain.Features.SMM)
+	assert.Equal(t, &domainTPM{Model: "tpm-crb", Backend: domainTPMBackend{Type: "emulator", Version: "2.0"}}, domain.Devices.TPM)
+
+	// Test case: The firmware of remote hosts is selected by libvirt
+	machine.Connection = "qemu+ssh://lab1/system"
+	machine.Resources.Firmware = FirmwareUEFI
+	domain = domainXML{}
+	definition, err = newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, "efi", domain.OS.Firmware)
+	assert.Nil(t, domain.OS.Loader)
+	assert.Nil(t, domain.Features.SMM)
+	assert.Contains(t, domain.OS.FirmwareInfo.Features, domainFirmwareFeature{Enabled: "no", Name: "secure-boot"})
+
+	// Test case: Machines booting with BIOS have no loader
+	machine.Resources = Resources{CPUs: "1", Memory: "1G"}
+	definition, err = newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(definition), "<loader")
+	assert.NotContains(t, string(definition), "<tpm")
+}
@@ -0,0 +1,236 @@
+package hypvsr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/sshutil"
+)
+
+// ErrPortNotTunnelled is returned when a port that is not TCP is forwarded through SSH
+var ErrPortNotTunnelled = errors.New("only tcp ports can be forwarded through SSH, udp ports need the user-mode network")
+
+// ErrPortNotLive is returned when a port that passt forwards is changed while the machine runs
+var ErrPortNotLive = errors.New("udp ports are forwarded by passt, which can't change them while the machine runs, stop it first")
+
+var (
+	// The arguments of the machina command that runs the forwarder of a machine
+	forwarderCommand = []string{"port", "forward"}
+	// The interval between the checks of the forwarder for the machine status
+	forwarderInterval = 5 * time.Second
+)
+
+// startForwarder starts the machina process that forwards the TCP ports of
+// the machine through SSH in the background, replacing the running one
+func startForwarder(machine *Machine) error {
+	err := stopForwarder(machine)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(machine.Ports, isTunnelled) {
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Log the errors of the forwarder in the machine directory
+	dir := filepath.Join(machine.baseDir, machine.Name)
+	logFile, err := os.OpenFile(filepath.Join(dir, config.GetFilename(config.ForwarderLogFilename)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	// Start the forwarder in a new session so that it keeps running after machina exits
+	cmd := exec.Command(executable, append(forwarderCommand, machine.Name)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, config.GetFilename(config.ForwarderPIDFilename)), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+// stopForwarder stops the process forwarding the ports of the machine,
+// waiting for it to release the ports
+func stopForwarder(machine *Machine) error {
+	pidFile := filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.ForwarderPIDFilename))
+	data, err := os.ReadFile(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && processExists(pid) {
+		err = syscall.Kill(pid, syscall.SIGTERM)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 50 && processExists(pid); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	return os.Remove(pidFile)
+}
+
+// isTunnelled checks if the port is forwarded through SSH
+func isTunnelled(port Port) bool {
+	return port.Protocol == "tcp"
+}
+
+// ForwardPorts forwards the TCP ports of the machine from the host through
+// SSH until the machine is shut off or the context is done
+func (machine *Machine) ForwardPorts(ctx context.Context) error {
+	t := &tunnel{machine: machine}
+	defer t.close()
+
+	// Listen on the host ports
+	for _, port := range machine.Ports {
+		// The other ports are forwarded by the user-mode network
+		if !isTunnelled(port) {
+			continue
+		}
+
+		// A host port taken by another process keeps the other tunnels up
+		listener, err := net.Listen("tcp", net.JoinHostPort(port.HostAddress, strconv.Itoa(port.HostPort)))
+		if err != nil {
+			log.Printf("Skipping port %s: %s", port, err)
+			continue
+		}
+		defer listener.Close()
+		go t.serve(listener, net.JoinHostPort(localhost, strconv.Itoa(port.GuestPort)))
+	}
+
+	// Wait until the machine is shut off, suspended or deleted
+	ticker := time.NewTicker(forwarderInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			status, err := machine.Status()
+			if errors.Is(err, ErrMachineNotFound) || (err == nil && (status == "shut off" || status == "saved")) {
+				return nil
+			}
+		}
+	}
+}
+
+// tunnel forwards connections to the machine through a shared SSH connection
+type tunnel struct {
+	machine *Machine
+	mu      sync.Mutex
+	client  *sshutil.SSHClient
+}
+
+// Accepts the connections to the listener and forwards them to the address in the machine
+func (t *tunnel) serve(listener net.Listener, address string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(conn, address)
+	}
+}
+
+// Copies the data between the connection and the address in the machine until one of them is closed
+func (t *tunnel) forward(conn net.Conn, address string) {
+	defer conn.Close()
+
+	remote, err := t.dial(address)
+	if err != nil {
+		log.Printf("Error forwarding a connection to %s: %s", address, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Opens a connection to the address in the machine, reconnecting over SSH
+// when the machine was not ready yet or was restarted
+func (t *tunnel) dial(address string) (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		conn, err := t.client.Dial(address)
+		if err == nil {
+			return conn, nil
+		}
+		t.client.Close()
+		t.client = nil
+	}
+
+	client, err := t.machine.connect()
+	if err != nil {
+		return nil, err
+	}
+	t.client = client
+
+	return client.Dial(address)
+}
+
+// Closes the SSH connection
+func (t *tunnel) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		t.client.Close()
+	}
+}
+
+// ForwarderLog writes the errors logged by the forwarder of the machine to the writer
+func (machine *Machine) ForwarderLog(w io.Writer) error {
+	f, err := os.Open(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.ForwarderLogFilename)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
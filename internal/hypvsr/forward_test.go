@@ -0,0 +1,129 @@
+package hypvsr
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/netutil"
+	"github.com/enkodr/machina/internal/sshutil"
+	sshsrv "github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+)
+
+// startEchoServer starts a server that echoes the data back and returns its port
+func startEchoServer(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startSSHServer starts an SSH server that forwards TCP connections and lets
+// the machine reach it
+func startSSHServer(t *testing.T, machine *Machine) {
+	privateKey, publicKey, err := sshutil.GenerateNewSSHKeys()
+	assert.NoError(t, err)
+	authorized, _, _, _, err := sshsrv.ParseAuthorizedKey(publicKey)
+	assert.NoError(t, err)
+
+	server := &sshsrv.Server{
+		PublicKeyHandler: func(ctx sshsrv.Context, key sshsrv.PublicKey) bool {
+			return sshsrv.KeysEqual(key, authorized)
+		},
+		LocalPortForwardingCallback: func(ctx sshsrv.Context, host string, port uint32) bool {
+			return true
+		},
+		ChannelHandlers: map[string]sshsrv.ChannelHandler{
+			"direct-tcpip": sshsrv.DirectTCPIPHandler,
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	machine.Network.SSHPort = listener.Addr().(*net.TCPAddr).Port
+	os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)), privateKey, 0600)
+}
+
+func TestMachine_ForwardPorts(t *testing.T) {
+	machine := newTestMachine(t, "running")
+	startSSHServer(t, machine)
+	hostPort, err := netutil.FreePort("tcp", "127.0.0.1", nil)
+	assert.NoError(t, err)
+	// A host port held by another process is skipped
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer busy.Close()
+	machine.Ports = []Port{
+		{HostPort: busy.Addr().(*net.TCPAddr).Port, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"},
+		{HostPort: hostPort, GuestPort: startEchoServer(t), Protocol: "tcp", HostAddress: "127.0.0.1"},
+		{HostPort: 5353, GuestPort: 53, Protocol: "udp", HostAddress: "127.0.0.1"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- machine.ForwardPorts(ctx) }()
+
+	// Test case: The connections to the other host ports reach the port in the machine
+	var conn net.Conn
+	assert.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort)))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "ping")
+	assert.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+
+	// Test case: The forwarder stops when the context is done
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestMachine_ForwardPortsShutOff(t *testing.T) {
+	defaultInterval := forwarderInterval
+	forwarderInterval = 10 * time.Millisecond
+	t.Cleanup(func() { forwarderInterval = defaultInterval })
+
+	// Test case: The forwarder stops when the machine is shut off
+	machine := newTestMachine(t, "shut off")
+	startSSHServer(t, machine)
+	assert.NoError(t, machine.ForwardPorts(context.Background()))
+
+}
+
+func TestStopForwarder(t *testing.T) {
+	machine := newTestMachine(t, "")
+	pidFile := filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.ForwarderPIDFilename))
+
+	// Test case: No forwarder is running
+	assert.NoError(t, stopForwarder(machine))
+
+	// Test case: The PID file of a forwarder that is gone is removed
+	os.WriteFile(pidFile, []byte("999999999"), 0644)
+	assert.NoError(t, stopForwarder(machine))
+	assert.NoFileExists(t, pidFile)
+}
@@ -1,13 +1,27 @@
 package hypvsr
 
 import (
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/netutil"
+	"gopkg.in/yaml.v3"
 )
 
 var cfg *config.Config
 
+// The host address the forwarded ports are bound to by default
+const localhost = "127.0.0.1"
+
+// Snapshot holds the details of a machine snapshot
+type Snapshot struct {
+	Name      string    `json:"name" yaml:"name"`           // Name of the snapshot
+	CreatedAt time.Time `json:"createdAt" yaml:"createdAt"` // Creation time of the snapshot
+}
+
 // convertMemory is a function that converts the template memory to a value used by the hypervisor
 func convertMemory(memory string) (string, error) {
 	ram := memory
@@ -44,3 +58,80 @@ func getHypervisor() Hypervisor {
 		return &Libvirt{}
 	}
 }
+
+// getIPAM returns the IP address manager for the network with the gateway
+// and the addresses of the existing instances reserved
+func getIPAM(settings config.Network) (*netutil.IPAM, error) {
+	reserved := append(getInstanceAddresses(), settings.Gateway)
+	return netutil.NewIPAM(getLeasesDir(), settings.CIDR, reserved)
+}
+
+// getLeasesDir returns the directory where the IP address leases are stored
+func getLeasesDir() string {
+	if cfg.Directories.Leases != "" {
+		return cfg.Directories.Leases
+	}
+
+	// Configurations created before the leases existed keep them next to the instances
+	return filepath.Join(filepath.Dir(cfg.Directories.Instances), "leases")
+}
+
+// getRemoteDir returns the directory of the remote libvirt hosts where the
+// images and disks of the machines are stored
+func getRemoteDir() string {
+	if cfg != nil && cfg.Directories.Remote != "" {
+		return cfg.Directories.Remote
+	}
+	return "/var/lib/libvirt/images/machina"
+}
+
+// readInstanceFiles returns the machines stored in the instance files of the
+// instances directory, skipping the ones that can't be read
+func readInstanceFiles(dir string) []*Machine {
+	machines := []*Machine{}
+
+	dirs, _ := os.ReadDir(dir)
+	for _, entry := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name(), config.GetFilename(config.InstanceFilename)))
+		if err != nil {
+			continue
+		}
+
+		machine := &Machine{}
+		err = yaml.Unmarshal(data, machine)
+		if err != nil {
+			continue
+		}
+		machine.baseDir = dir
+		machines = append(machines, machine)
+	}
+
+	return machines
+}
+
+// getInstanceAddresses returns the IP addresses stored in the instance files
+func getInstanceAddresses() []string {
+	var addresses []string
+	for _, machine := range readInstanceFiles(cfg.Directories.Instances) {
+		if machine.Network.IPAddress != "" {
+			addresses = append(addresses, machine.Network.IPAddress)
+		}
+	}
+
+	return addresses
+}
+
+// getInstancePorts returns the host ports stored in the instance files
+func getInstancePorts() []int {
+	var ports []int
+	for _, machine := range readInstanceFiles(cfg.Directories.Instances) {
+		if machine.Network.SSHPort != 0 {
+			ports = append(ports, machine.Network.SSHPort)
+		}
+		for _, port := range machine.Ports {
+			ports = append(ports, port.HostPort)
+		}
+	}
+
+	return ports
+}
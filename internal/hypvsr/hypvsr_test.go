@@ -1,8 +1,12 @@
 package hypvsr
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/enkodr/machina/internal/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,3 +52,103 @@ func TestConvertMemory(t *testing.T) {
 		assert.Equal(t, tc.expected, result)
 	}
 }
+
+func TestParseQemuImgSnapshots(t *testing.T) {
+	output := `{
+    "snapshots": [
+        {"icount": 0, "vm-clock-nsec": 0, "name": "snap1", "date-sec": 1682935200, "date-nsec": 0, "vm-clock-sec": 0, "id": "1", "vm-state-size": 0}
+    ],
+    "virtual-size": 10737418240,
+    "filename": "disk.img",
+    "format": "qcow2"
+}`
+	snapshots, err := parseQemuImgSnapshots(output)
+	assert.NoError(t, err)
+	assert.Equal(t, []Snapshot{{Name: "snap1", CreatedAt: time.Unix(1682935200, 0)}}, snapshots)
+
+	// Test case: Disk without snapshots
+	snapshots, err = parseQemuImgSnapshots(`{"filename": "disk.img"}`)
+	assert.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	// Test case: Invalid output
+	_, err = parseQemuImgSnapshots("invalid")
+	assert.Error(t, err)
+}
+
+// MockHypervisor is a mock implementation of the Hypervisor interface
+type MockHypervisor struct {
+	State  string
+	Calls  []string
+	Errors map[string]error // Errors returned by the calls, by name
+}
+
+func (m *MockHypervisor) call(name string) error {
+	m.Calls = append(m.Calls, name)
+	return m.Errors[name]
+}
+
+func (m *MockHypervisor) Create(*Machine) error    { return m.call("Create") }
+func (m *MockHypervisor) Start(*Machine) error     { return m.call("Start") }
+func (m *MockHypervisor) Stop(*Machine) error      { return m.call("Stop") }
+func (m *MockHypervisor) ForceStop(*Machine) error { return m.call("ForceStop") }
+func (m *MockHypervisor) Restart(*Machine) error   { return m.call("Restart") }
+func (m *MockHypervisor) Pause(*Machine) error     { return m.call("Pause") }
+func (m *MockHypervisor) Resume(*Machine) error    { return m.call("Resume") }
+func (m *MockHypervisor) Save(*Machine) error      { return m.call("Save") }
+func (m *MockHypervisor) Status(*Machine) (string, error) {
+	return m.State, m.call("Status")
+}
+func (m *MockHypervisor) Delete(*Machine) error { return m.call("Delete") }
+func (m *MockHypervisor) CreateSnapshot(*Machine, string) error {
+	return m.call("CreateSnapshot")
+}
+func (m *MockHypervisor) ListSnapshots(*Machine) ([]Snapshot, error) {
+	return nil, m.call("ListSnapshots")
+}
+func (m *MockHypervisor) RevertSnapshot(*Machine, string) error {
+	return m.call("RevertSnapshot")
+}
+func (m *MockHypervisor) DeleteSnapshot(*Machine, string) error {
+	return m.call("DeleteSnapshot")
+}
+func (m *MockHypervisor) AddPort(*Machine, Port) error {
+	return m.call("AddPort")
+}
+func (m *MockHypervisor) RemovePort(*Machine, Port) error {
+	return m.call("RemovePort")
+}
+func (m *MockHypervisor) Resize(*Machine) error { return m.call("Resize") }
+
+// setTestConfig sets the configuration used by the test, restoring the
+// previous one when the test ends
+func setTestConfig(t *testing.T, c *config.Config) {
+	defaultConfig := cfg
+	t.Cleanup(func() { cfg = defaultConfig })
+	cfg = c
+}
+
+// newTestMachine creates a machine with its instance file and disk in a
+// temporary instances directory, run by a mock hypervisor in the state and a
+// mock runner. The configuration is restored when the test ends.
+func newTestMachine(t *testing.T, state string) *Machine {
+	setTestConfig(t, &config.Config{
+		Directories: config.Directories{
+			Instances: t.TempDir(),
+			Leases:    filepath.Join(t.TempDir(), "leases"),
+		},
+	})
+
+	machine := &Machine{
+		Name:        "test-machine",
+		baseDir:     cfg.Directories.Instances,
+		Runner:      &MockRunner{},
+		Hypervisor:  &MockHypervisor{State: state},
+		Credentials: Credentials{Username: "test-user"},
+	}
+	dir := filepath.Join(machine.baseDir, machine.Name)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, machine.save())
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, config.GetFilename(config.DiskFilename)), []byte("disk"), 0644))
+	return machine
+}
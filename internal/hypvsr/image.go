@@ -0,0 +1,315 @@
+package hypvsr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/imgutil"
+	"github.com/enkodr/machina/internal/netutil"
+	"github.com/enkodr/machina/internal/osutil"
+)
+
+// CachedImage holds a base image downloaded to the image cache
+type CachedImage struct {
+	Name      string   `yaml:"name"`                // Name of the image file
+	Size      int64    `yaml:"size"`                // Size of the image file in bytes
+	Checksum  string   `yaml:"checksum,omitempty"`  // Checksum of the image in the format 'algorithm:hash'
+	URL       string   `yaml:"url,omitempty"`       // URL the image was downloaded from
+	Instances []string `yaml:"instances,omitempty"` // Instances whose disks are backed by the image
+}
+
+// ListImages lists the images of the image cache with the instances that
+// depend on them. The checksum of the images downloaded without one is
+// computed and kept.
+func ListImages() ([]CachedImage, error) {
+	var err error
+	cfg, err = config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(cfg.Directories.Images)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	users, err := getImageUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []CachedImage{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || imgutil.IsMetadataFile(entry.Name()) || netutil.IsPartialDownload(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(cfg.Directories.Images, entry.Name())
+
+		metadata, err := imgutil.ReadMetadata(path)
+		if err != nil {
+			return nil, err
+		}
+		if metadata.Checksum == "" {
+			metadata.Checksum, err = imgutil.Digest(path, "sha256")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		images = append(images, CachedImage{
+			Name:      entry.Name(),
+			Size:      info.Size(),
+			Checksum:  metadata.Checksum,
+			URL:       metadata.URL,
+			Instances: users[path],
+		})
+	}
+
+	return images, nil
+}
+
+// RemoveImage removes the image from the image cache, unless it backs the
+// disks of any instance
+func RemoveImage(name string) error {
+	var err error
+	cfg, err = config.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Only the files of the image cache are removed
+	if name != filepath.Base(name) || imgutil.IsMetadataFile(name) || netutil.IsPartialDownload(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	path := filepath.Join(cfg.Directories.Images, name)
+	if !fileExists(path) {
+		return fmt.Errorf("image %q is not in the image cache", name)
+	}
+
+	users, err := getImageUsers()
+	if err != nil {
+		return err
+	}
+	if len(users[path]) > 0 {
+		return fmt.Errorf("image %q backs the disks of instances %s", name, strings.Join(users[path], ", "))
+	}
+
+	return imgutil.RemoveImage(path)
+}
+
+// PruneImages removes the images of the image cache that back the disks of
+// no instance and returns their names
+func PruneImages() ([]string, error) {
+	images, err := ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, image := range images {
+		if len(image.Instances) > 0 {
+			continue
+		}
+		err = imgutil.RemoveImage(filepath.Join(cfg.Directories.Images, image.Name))
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, image.Name)
+	}
+
+	return removed, nil
+}
+
+// getImageChecksum returns the checksum of the image of the machine, which is
+// looked up in its checksum file when the template sets none. The checksum
+// file is verified when it has a detached signature or is clearsigned.
+func (machine *Machine) getImageChecksum() (string, error) {
+	image := machine.Image
+	if image.Checksum != "" || image.ChecksumURL == "" {
+		return image.Checksum, nil
+	}
+
+	data, err := netutil.Download(image.ChecksumURL)
+	if err != nil {
+		return "", fmt.Errorf("downloading the checksum file %s: %w", image.ChecksumURL, err)
+	}
+
+	content, clearsigned := imgutil.SignedContent(data)
+	switch {
+	case image.SignatureURL != "":
+		signature, err := netutil.Download(image.SignatureURL)
+		if err != nil {
+			return "", fmt.Errorf("downloading the signature %s: %w", image.SignatureURL, err)
+		}
+		err = verifySignature(machine.Runner, image.Keyring, data, signature)
+		if err != nil {
+			return "", fmt.Errorf("verifying the checksum file %s: %w", image.ChecksumURL, err)
+		}
+	case clearsigned:
+		err = verifySignature(machine.Runner, image.Keyring, data, nil)
+		if err != nil {
+			return "", fmt.Errorf("verifying the checksum file %s: %w", image.ChecksumURL, err)
+		}
+		// Only the signed lines are trusted
+		data = content
+	case image.Keyring != "":
+		return "", fmt.Errorf("the checksum file %s is not signed", image.ChecksumURL)
+	}
+
+	fileName, err := imgutil.GetFilenameFromURL(image.URL)
+	if err != nil {
+		return "", err
+	}
+	return imgutil.ParseChecksumFile(data, fileName)
+}
+
+// verifySignature verifies the GPG signature of the data, which is clearsigned
+// when the signature is empty, with gpg. The public keys are imported from
+// the keyring, a path or URL, into a temporary home, or taken from the
+// keyring of the user when none is set.
+func verifySignature(runner osutil.Runner, keyring string, data []byte, signature []byte) error {
+	dir, err := os.MkdirTemp("", "machina-gpg-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"--batch"}
+	if keyring != "" {
+		var keys []byte
+		if strings.Contains(keyring, "://") {
+			keys, err = netutil.Download(keyring)
+		} else {
+			keys, err = os.ReadFile(keyring)
+		}
+		if err != nil {
+			return fmt.Errorf("reading the keyring %s: %w", keyring, err)
+		}
+
+		home := filepath.Join(dir, "gnupg")
+		keysFile := filepath.Join(dir, "keys")
+		err = os.Mkdir(home, 0700)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(keysFile, keys, 0600)
+		if err != nil {
+			return err
+		}
+
+		args = append(args, "--homedir", home)
+		_, err = runner.RunCommand("gpg", append(slices.Clone(args), "--import", keysFile))
+		if err != nil {
+			return fmt.Errorf("importing the keyring %s: %w", keyring, err)
+		}
+	}
+
+	args = append(args, "--verify")
+	if len(signature) > 0 {
+		signatureFile := filepath.Join(dir, "signature")
+		err = os.WriteFile(signatureFile, signature, 0600)
+		if err != nil {
+			return err
+		}
+		args = append(args, signatureFile)
+	}
+	dataFile := filepath.Join(dir, "checksums")
+	err = os.WriteFile(dataFile, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = runner.RunCommand("gpg", append(args, dataFile))
+	if err != nil {
+		return fmt.Errorf("bad or unknown signature: %w", err)
+	}
+	return nil
+}
+
+// getImageUsers returns the names of the instances whose disks are backed by
+// each file, directly or through other overlays like the disks of linked
+// clones. The disks of the instances in remote hosts are backed there.
+func getImageUsers() (map[string][]string, error) {
+	machines, err := GetMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string][]string{}
+	for _, machine := range machines {
+		if machine.isRemote() {
+			continue
+		}
+
+		disk := filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.DiskFilename))
+		if !fileExists(disk) {
+			continue
+		}
+		chain, err := getBackingChain(machine.Runner, disk)
+		if err != nil {
+			return nil, fmt.Errorf("reading the disk of instance %q: %w", machine.Name, err)
+		}
+		for _, file := range chain {
+			if !slices.Contains(users[file], machine.Name) {
+				users[file] = append(users[file], machine.Name)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+// getBackingChain returns the files backing the disk image, read with
+// qemu-img without taking the lock held by a running machine
+func getBackingChain(runner osutil.Runner, disk string) ([]string, error) {
+	output, err := runner.RunCommand("qemu-img", []string{"info", "--force-share", "--backing-chain", "--output=json", disk})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBackingChain(output)
+}
+
+// parseBackingChain parses the files backing a disk image from the JSON
+// output of the qemu-img info --backing-chain command
+func parseBackingChain(output string) ([]string, error) {
+	layers := []struct {
+		Filename            string `json:"filename"`
+		BackingFilename     string `json:"backing-filename"`
+		FullBackingFilename string `json:"full-backing-filename"`
+	}{}
+	err := json.Unmarshal([]byte(output), &layers)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return nil, errors.New("no image information")
+	}
+
+	chain := []string{}
+	for _, layer := range layers {
+		backing := layer.FullBackingFilename
+		if backing == "" {
+			backing = layer.BackingFilename
+		}
+		if backing == "" {
+			continue
+		}
+		if !filepath.IsAbs(backing) {
+			backing = filepath.Join(filepath.Dir(layer.Filename), backing)
+		}
+		chain = append(chain, filepath.Clean(backing))
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,31 @@
+package hypvsr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBackingChain(t *testing.T) {
+	runner := &MockRunner{Output: `[
+		{"filename": "/instances/clone/disk.img", "backing-filename": "/instances/vm/disk.img", "full-backing-filename": "/instances/vm/disk.img"},
+		{"filename": "/instances/vm/disk.img", "backing-filename": "../../images/debian.qcow2"},
+		{"filename": "/images/debian.qcow2"}
+	]`}
+	chain, err := getBackingChain(runner, "/instances/clone/disk.img")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/instances/vm/disk.img", "/images/debian.qcow2"}, chain)
+	assert.Equal(t, "qemu-img", runner.Command)
+	assert.Equal(t, []string{"info", "--force-share", "--backing-chain", "--output=json", "/instances/clone/disk.img"}, runner.Args)
+
+	// Test case: A disk without backing files
+	runner.Output = `[{"filename": "/instances/vm/disk.img"}]`
+	chain, err = getBackingChain(runner, "/instances/vm/disk.img")
+	assert.NoError(t, err)
+	assert.Empty(t, chain)
+
+	// Test case: Invalid output
+	runner.Output = "qemu-img: Could not open"
+	_, err = getBackingChain(runner, "/instances/vm/disk.img")
+	assert.Error(t, err)
+}
@@ -1,24 +1,44 @@
 package hypvsr
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
 	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/sshutil"
 )
 
+// ErrMachineNotFound is returned when the hypervisor has no machine with the given name
+var ErrMachineNotFound = errors.New("machine not found")
+
 // Hypervisor is an interface for interacting with the hypervisor
 type Hypervisor interface {
 	Create(machine *Machine) error
 	Start(machine *Machine) error
 	Stop(machine *Machine) error
 	ForceStop(machine *Machine) error
+	Restart(machine *Machine) error
+	Pause(machine *Machine) error
+	Resume(machine *Machine) error
+	Save(machine *Machine) error
 	Status(machine *Machine) (string, error)
 	Delete(machine *Machine) error
+	CreateSnapshot(machine *Machine, name string) error
+	ListSnapshots(machine *Machine) ([]Snapshot, error)
+	RevertSnapshot(machine *Machine, name string) error
+	DeleteSnapshot(machine *Machine, name string) error
+	AddPort(machine *Machine, port Port) error
+	RemovePort(machine *Machine, port Port) error
+	Resize(machine *Machine) error
 }
 
 // Libvirt is a struct that represents the libvirt hypervisor
@@ -26,252 +46,587 @@ type Libvirt struct{}
 
 // Create is a method for the libvirt hypervisor that creates an machine
 func (h *Libvirt) Create(machine *Machine) error {
-	// Loads the software configuration
-	cfg, err := config.LoadConfig()
+	conn, err := h.connect(machine)
 	if err != nil {
 		return err
 	}
-	// Define the command to be executed
-	command := "virt-install"
+	defer conn.Disconnect()
 
-	// Validate and convert the memory
-	ram, err := convertMemory(machine.Resources.Memory)
+	// Generate the definition of the machine, emulated when the host
+	// can't accelerate its architecture
+	domainType, err := getDomainType(conn, machine)
+	if err != nil {
+		return err
+	}
+	definition, err := newDomainXML(machine, domainType)
 	if err != nil {
-		return errors.New("invalid memory")
-	}
-
-	// Define the arguments for the execution of the command
-	args := []string{
-		"--connect", cfg.Connection,
-		"--virt-type", "kvm",
-		"--name", machine.Name,
-		"--ram", ram,
-		fmt.Sprintf("--vcpus=%s", machine.Resources.CPUs),
-		"--os-variant", machine.Variant,
-		"--disk", fmt.Sprintf("path=%s,device=disk", filepath.Join(cfg.Directories.Instances, machine.Name, config.GetFilename(config.DiskFilename))),
-		"--disk", fmt.Sprintf("path=%s,device=disk", filepath.Join(cfg.Directories.Instances, machine.Name, config.GetFilename(config.SeedImageFilename))),
-		"--import",
-		"--network", fmt.Sprintf("bridge=virbr0,model=virtio,mac=%s", machine.Network.MacAddress),
-		"--noautoconsole",
-	}
-
-	// Parse volume mount
-	var mountCommand []string
-	if machine.Mount.Name != "" {
-		mountCommand = []string{
-			"--filesystem",
-			fmt.Sprintf("type=mount,mode=passthrough,source=%s,target=%s", machine.Mount.HostPath, machine.Mount.GuestPath),
+		return err
+	}
+
+	// Create the disks in the remote host
+	if machine.isRemote() {
+		err = h.uploadDisks(conn, machine)
+		if err != nil {
+			return err
 		}
 	}
-	args = append(args, mountCommand...)
 
-	// Run the command to create the machine
-	_, err = machine.Runner.RunCommand(command, args)
+	// Define the machine and start it
+	domain, err := conn.DomainDefineXML(string(definition))
 	if err != nil {
-		return err
+		return fmt.Errorf("defining machine %q: %w", machine.Name, err)
+	}
+
+	err = conn.DomainCreate(domain)
+	if err != nil {
+		return fmt.Errorf("starting machine %q: %w", machine.Name, err)
 	}
 
-	return err
+	return startForwarder(machine)
 }
 
 // Start is a method for the libvirt hypervisor that starts a stopped machine
 func (h *Libvirt) Start(machine *Machine) error {
-	// Loads the software configuration
-	cfg, err := config.LoadConfig()
+	err := h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		// Apply the udp ports changed while the machine was stopped, which
+		// passt forwards in user mode. Saved machines keep their definition.
+		if machine.getNetworkSettings().Mode == config.NetworkModeUser {
+			saved, err := conn.DomainHasManagedSaveImage(domain, 0)
+			if err != nil {
+				return err
+			}
+			if saved == 0 {
+				err = redefineDomain(conn, domain, machine)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return conn.DomainCreate(domain)
+	})
 	if err != nil {
 		return err
 	}
 
-	// Define the command to be executed
-	command := "virsh"
-
-	// Define the arguments for the execution of the command
-	args := []string{
-		"--connect", cfg.Connection,
-		"start",
-		machine.Name,
-	}
+	return startForwarder(machine)
+}
 
-	// Run the command to create the machine
-	_, err = machine.Runner.RunCommand(command, args)
+// Start is a method for the libvirt hypervisor that stops a running machine
+func (h *Libvirt) Stop(machine *Machine) error {
+	err := stopForwarder(machine)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainShutdown(domain)
+	})
 }
 
-// Start is a method for the libvirt hypervisor that stops a running machine
-func (h *Libvirt) Stop(machine *Machine) error {
-	// Loads the software configuration
-	cfg, err := config.LoadConfig()
+// ForceStop is a method for the libvirt hypervisor that force stops a running/stuck machine
+func (h *Libvirt) ForceStop(machine *Machine) error {
+	err := stopForwarder(machine)
 	if err != nil {
 		return err
 	}
 
-	// Define the command to be executed
-	command := "virsh"
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainDestroy(domain)
+	})
+}
 
-	// Define the arguments for the execution of the command
-	args := []string{
-		"--connect", cfg.Connection,
-		"shutdown",
-		machine.Name,
-	}
+// Restart is a method for the libvirt hypervisor that requests the guest of a running machine to reboot
+func (h *Libvirt) Restart(machine *Machine) error {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainReboot(domain, 0)
+	})
+}
 
-	// Run the command to create the machine
-	_, err = machine.Runner.RunCommand(command, args)
+// Save is a method for the libvirt hypervisor that saves the state of a
+// running machine and stops it, which libvirt restores on the next start
+func (h *Libvirt) Save(machine *Machine) error {
+	err := stopForwarder(machine)
 	if err != nil {
 		return err
 	}
 
-	return err
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainManagedSave(domain, 0)
+	})
 }
 
-// ForceStop is a method for the libvirt hypervisor that force stops a running/stuck machine
-func (h *Libvirt) ForceStop(machine *Machine) error {
-	// Loads the software configuration
+// Pause is a method for the libvirt hypervisor that pauses the CPUs of a running machine
+func (h *Libvirt) Pause(machine *Machine) error {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainSuspend(domain)
+	})
+}
+
+// Resume is a method for the libvirt hypervisor that resumes the CPUs of a paused machine
+func (h *Libvirt) Resume(machine *Machine) error {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		return conn.DomainResume(domain)
+	})
+}
+
+// Status is a method for the libvirt hypervisor that gets the status of an machine
+func (h *Libvirt) Status(machine *Machine) (string, error) {
+	status := ""
+	err := h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		state, _, err := conn.DomainGetState(domain, 0)
+		if err != nil {
+			return err
+		}
+		status = domainStateName(libvirt.DomainState(state))
+
+		// Stopped machines with a saved state are restored on the next start
+		if status == "shut off" {
+			saved, err := conn.DomainHasManagedSaveImage(domain, 0)
+			if err != nil {
+				return err
+			}
+			if saved == 1 {
+				status = "saved"
+			}
+		}
+		return nil
+	})
+
+	return status, err
+}
+
+// Delete is a method for the libvirt hypervisor that deletes a created machine
+func (h *Libvirt) Delete(machine *Machine) error {
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		return err
 	}
 
-	// Define the command to be executed
-	command := "virsh"
-
-	// Define the arguments for the execution of the command
-	args := []string{
-		"--connect", cfg.Connection,
-		"destroy",
-		machine.Name,
+	err = stopForwarder(machine)
+	if err != nil {
+		return err
 	}
 
-	// Run the command to create the machine
-	_, err = machine.Runner.RunCommand(command, args)
+	conn, err := h.connect(machine)
 	if err != nil {
 		return err
 	}
+	defer conn.Disconnect()
 
-	return err
-}
-
-// Status is a method for the libvirt hypervisor that gets the status of an machine
-func (h *Libvirt) Status(machine *Machine) (string, error) {
-	// Loads the software configuration
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		return "", err
+	// Stop and undefine the machine along with the metadata of its snapshots
+	domain, err := lookupDomain(conn, machine.Name)
+	if err != nil && !errors.Is(err, ErrMachineNotFound) {
+		return err
 	}
+	if err == nil {
+		active, err := conn.DomainIsActive(domain)
+		if err != nil {
+			return err
+		}
+		if active == 1 {
+			err = conn.DomainDestroy(domain)
+			if err != nil {
+				return fmt.Errorf("stopping machine %q: %w", machine.Name, err)
+			}
+		}
 
-	// Define the command to be executed
-	command := "virsh"
+		err = conn.DomainUndefineFlags(domain, libvirt.DomainUndefineSnapshotsMetadata|libvirt.DomainUndefineNvram|libvirt.DomainUndefineManagedSave)
+		if err != nil {
+			return fmt.Errorf("undefining machine %q: %w", machine.Name, err)
+		}
+	}
 
-	// Define the arguments for the execution of the command
-	args := []string{
-		"--connect", cfg.Connection,
-		"domstate",
-		machine.Name,
+	// Remove the storage pool of the machine directory, created when the
+	// machine was installed with virt-install or its disks were uploaded
+	pool, err := conn.StoragePoolLookupByName(machine.Name)
+	if err != nil && !isLibvirtError(err, libvirt.ErrNoStoragePool) {
+		return err
 	}
+	if err == nil {
+		active, err := conn.StoragePoolIsActive(pool)
+		if err != nil {
+			return err
+		}
 
-	// Execute the command
-	cmd := exec.Command(command, args...)
+		// The disks of the machine are only removed with the pool in remote hosts
+		if machine.isRemote() {
+			if active == 0 {
+				err = conn.StoragePoolCreate(pool, 0)
+				if err != nil {
+					return fmt.Errorf("starting storage pool %q: %w", machine.Name, err)
+				}
+				active = 1
+			}
+			err = deleteVolumes(conn, pool)
+			if err != nil {
+				return err
+			}
+		}
 
-	// Runs the command and gets the combined outpu
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", err
+		if active == 1 {
+			err = conn.StoragePoolDestroy(pool)
+			if err != nil {
+				return fmt.Errorf("stopping storage pool %q: %w", machine.Name, err)
+			}
+		}
+
+		err = conn.StoragePoolUndefine(pool)
+		if err != nil {
+			return fmt.Errorf("undefining storage pool %q: %w", machine.Name, err)
+		}
 	}
-	strOutput := strings.TrimSpace(string(output))
-	return strOutput, nil
+
+	// Delete the machine directory
+	return os.RemoveAll(filepath.Join(cfg.Directories.Instances, machine.Name))
 }
 
-// Delete is a method for the libvirt hypervisor that deletes a created machine
-func (h *Libvirt) Delete(machine *Machine) error {
-	cfg, err := config.LoadConfig()
+// CreateSnapshot is a method for the libvirt hypervisor that creates a snapshot of a machine
+func (h *Libvirt) CreateSnapshot(machine *Machine, name string) error {
+	definition, err := newDomainSnapshotXML(machine, name)
 	if err != nil {
 		return err
 	}
 
-	// Delete the machine directory
-	err = os.RemoveAll(filepath.Join(cfg.Directories.Instances, machine.Name))
-	if err != nil {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		_, err := conn.DomainSnapshotCreateXML(domain, string(definition), uint32(libvirt.DomainSnapshotCreateAtomic))
 		return err
+	})
+}
+
+// ListSnapshots is a method for the libvirt hypervisor that lists the snapshots of a machine
+func (h *Libvirt) ListSnapshots(machine *Machine) ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+	err := h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		list, _, err := conn.DomainListAllSnapshots(domain, 1, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range list {
+			definition, err := conn.DomainSnapshotGetXMLDesc(item, 0)
+			if err != nil {
+				return err
+			}
+
+			snapshot, err := parseDomainSnapshotXML(definition)
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Define the command to be executed
-	command := "virsh"
+	return snapshots, nil
+}
+
+// RevertSnapshot is a method for the libvirt hypervisor that reverts a machine to a snapshot
+func (h *Libvirt) RevertSnapshot(machine *Machine, name string) error {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		snapshot, err := conn.DomainSnapshotLookupByName(domain, name, 0)
+		if err != nil {
+			return err
+		}
+		return conn.DomainRevertToSnapshot(snapshot, 0)
+	})
+}
+
+// DeleteSnapshot is a method for the libvirt hypervisor that deletes a snapshot of a machine
+func (h *Libvirt) DeleteSnapshot(machine *Machine, name string) error {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		snapshot, err := conn.DomainSnapshotLookupByName(domain, name, 0)
+		if err != nil {
+			return err
+		}
+		return conn.DomainSnapshotDelete(snapshot, 0)
+	})
+}
+
+// AddPort is a method for the libvirt hypervisor that forwards a port to a running machine through SSH
+func (h *Libvirt) AddPort(machine *Machine, port Port) error {
+	if !isTunnelled(port) {
+		return ErrPortNotLive
+	}
+	return startForwarder(machine)
+}
 
-	// Define the arguments for the execution of the command to destroy the machine
-	args := []string{
-		"--connect", cfg.Connection,
-		"destroy",
-		machine.Name,
+// RemovePort is a method for the libvirt hypervisor that stops forwarding a port to a running machine
+func (h *Libvirt) RemovePort(machine *Machine, port Port) error {
+	if !isTunnelled(port) {
+		return ErrPortNotLive
 	}
+	return startForwarder(machine)
+}
+
+// Resize is a method for the libvirt hypervisor that redefines a stopped
+// machine with its resources, growing its disk when it runs in a remote host
+func (h *Libvirt) Resize(machine *Machine) error {
+	return h.withDomain(machine, func(conn *libvirt.Libvirt, domain libvirt.Domain) error {
+		if machine.isRemote() {
+			err := resizeVolume(conn, machine)
+			if err != nil {
+				return err
+			}
+		}
 
-	// Run the command to create the machine
-	_, err = machine.Runner.RunCommand(command, args)
+		return redefineDomain(conn, domain, machine)
+	})
+}
+
+// redefineDomain updates the definition of the stopped domain with the
+// settings of the machine
+func redefineDomain(conn *libvirt.Libvirt, domain libvirt.Domain, machine *Machine) error {
+	// Keep the UUID of the machine, which libvirt requires to redefine it
+	domainType, err := getDomainType(conn, machine)
+	if err != nil {
+		return err
+	}
+	definition, err := newDomain(machine, domainType)
+	if err != nil {
+		return err
+	}
+	definition.UUID = formatUUID(domain.UUID)
+	data, err := xml.MarshalIndent(definition, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	// Define the arguments for the execution of the command to undefine the machine
-	args = []string{
-		"--connect", cfg.Connection,
-		"undefine",
-		machine.Name,
+	_, err = conn.DomainDefineXML(string(data))
+	if err != nil {
+		return fmt.Errorf("redefining machine %q: %w", machine.Name, err)
 	}
+	return nil
+}
 
-	// Execute the command
-	cmd := exec.Command(command, args...)
-	err = cmd.Start()
+// getDomainType returns the domain type that runs the machine in the libvirt
+// host, kvm when accelerated or qemu when emulated
+func getDomainType(conn *libvirt.Libvirt, machine *Machine) (string, error) {
+	arch, err := machine.getArch()
 	if err != nil {
-		return err
+		return "", err
 	}
+	capabilities, err := conn.ConnectGetCapabilities()
+	if err != nil {
+		return "", err
+	}
+	return parseDomainType(capabilities, arch)
+}
 
-	// Define the arguments for the execution of the command to destroy the pool of the machine
-	args = []string{
-		"--connect", cfg.Connection,
-		"pool-destroy",
-		machine.Name,
+// formatUUID formats the UUID in its canonical text form
+func formatUUID(uuid libvirt.UUID) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// connect opens a connection to the libvirt daemon of the connection URI of
+// the machine, which defaults to the configured one
+func (h *Libvirt) connect(machine *Machine) (*libvirt.Libvirt, error) {
+	connection := machine.getConnection()
+	c, err := parseConnection(connection)
+	if err != nil {
+		return nil, err
 	}
 
-	// Execute the command
-	cmd = exec.Command(command, args...)
-	err = cmd.Start()
+	var dialer socket.Dialer
+	switch c.Transport {
+	case "unix":
+		dialer = dialers.NewLocal(dialers.WithSocket(c.Address))
+	case "tcp":
+		host, port, _ := net.SplitHostPort(c.Address)
+		dialer = dialers.NewRemote(host, dialers.UsePort(port))
+	case "ssh":
+		// Open the daemon socket of the remote host through SSH
+		client, err := sshutil.NewHostClient(c.User)
+		if err != nil {
+			return nil, err
+		}
+		err = client.Connect(c.Address)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("connecting to %q: %w", c.Address, err)
+		}
+		sock, err := client.DialUnix(c.Socket)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("opening the libvirt socket of %q: %w", c.Address, err)
+		}
+		dialer = dialers.NewAlreadyConnected(&tunnelConn{Conn: sock, client: client})
+	}
+
+	conn := libvirt.NewWithDialer(dialer)
+	err = conn.ConnectToURI(c.URI)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("connecting to libvirt at %q: %w", connection, err)
 	}
 
-	// Define the arguments for the execution of the command to undefine the pool of the machine
-	args = []string{
-		"--connect", cfg.Connection,
-		"pool-undefine",
-		machine.Name,
+	return conn, nil
+}
+
+// tunnelConn is a connection tunnelled through SSH that closes the SSH
+// connection when it is closed
+type tunnelConn struct {
+	net.Conn
+	client *sshutil.SSHClient
+}
+
+func (c *tunnelConn) Close() error {
+	defer c.client.Close()
+	return c.Conn.Close()
+}
+
+// withDomain connects to libvirt and runs the function with the domain of the machine
+func (h *Libvirt) withDomain(machine *Machine, fn func(conn *libvirt.Libvirt, domain libvirt.Domain) error) error {
+	conn, err := h.connect(machine)
+	if err != nil {
+		return err
 	}
+	defer conn.Disconnect()
 
-	// Execute the command
-	cmd = exec.Command(command, args...)
-	err = cmd.Start()
+	domain, err := lookupDomain(conn, machine.Name)
 	if err != nil {
 		return err
 	}
 
-	// Define the command to be executed
-	command = "ssh-keygen"
+	return fn(conn, domain)
+}
+
+// lookupDomain gets the domain with the name, returning ErrMachineNotFound when it does not exist
+func lookupDomain(conn *libvirt.Libvirt, name string) (libvirt.Domain, error) {
+	domain, err := conn.DomainLookupByName(name)
+	if libvirt.IsNotFound(err) {
+		return domain, fmt.Errorf("%w: %s", ErrMachineNotFound, name)
+	}
+
+	return domain, err
+}
+
+// isLibvirtError checks if the error was returned by libvirt with the given code
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	var libvirtErr libvirt.Error
+	return errors.As(err, &libvirtErr) && libvirtErr.Code == uint32(code)
+}
+
+// libvirtConnection holds the details of a libvirt connection URI
+type libvirtConnection struct {
+	Transport string             // Transport to the daemon, unix, tcp or ssh
+	Address   string             // Path of the daemon socket for unix, or host:port of the daemon or SSH server
+	Socket    string             // Path of the daemon socket in the remote host for ssh
+	User      string             // User logged in the remote host for ssh, the current one when empty
+	URI       libvirt.ConnectURI // URI of the driver to open in the daemon
+}
+
+// isRemote checks if the daemon of the connection runs in another host,
+// whose filesystem is not shared with the local one
+func (c libvirtConnection) isRemote() bool {
+	switch c.Transport {
+	case "ssh":
+		return true
+	case "tcp":
+		host, _, _ := net.SplitHostPort(c.Address)
+		ip := net.ParseIP(host)
+		return host != "localhost" && (ip == nil || !ip.IsLoopback())
+	default:
+		return false
+	}
+}
 
-	// Define the arguments for the execution of the command to undefine the pool of the machine
-	args = []string{
-		"-R",
-		machine.Network.IPAddress,
+// parseConnection parses a libvirt connection URI into the transport and
+// address of the daemon socket and the URI of the driver to open in the daemon
+//
+//	Example:
+//		qemu:///system                    unix /var/run/libvirt/libvirt-sock    qemu:///system
+//		qemu+unix:///system?socket=/sock  unix /sock                            qemu:///system
+//		qemu+tcp://host/system            tcp  host:16509                       qemu:///system
+//		qemu+ssh://user@host/system       ssh  host:22                          qemu:///system
+func parseConnection(connection string) (libvirtConnection, error) {
+	if connection == "" {
+		connection = string(libvirt.QEMUSystem)
 	}
 
-	// Define the arguments for the execution of the command to remove the key from the SSH allowed machines
-	cmd = exec.Command(command, args...)
-	err = cmd.Start()
+	u, err := url.Parse(connection)
 	if err != nil {
-		return err
+		return libvirtConnection{}, err
 	}
 
-	return nil
+	driver, transport, _ := strings.Cut(u.Scheme, "+")
+	c := libvirtConnection{
+		Transport: transport,
+		URI:       libvirt.ConnectURI(fmt.Sprintf("%s://%s", driver, u.Path)),
+	}
+
+	switch transport {
+	case "", "unix":
+		if u.Host != "" && transport == "" {
+			return c, fmt.Errorf("unsupported connection %q, use the ssh or tcp transport for remote hosts", connection)
+		}
+		c.Transport = "unix"
 
+		// The socket of the daemon can be set explicitly
+		if sock := u.Query().Get("socket"); sock != "" {
+			c.Address = sock
+			return c, nil
+		}
+		if u.Path == "/session" {
+			runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+			if runtimeDir == "" {
+				home, _ := os.UserHomeDir()
+				runtimeDir = filepath.Join(home, ".cache")
+			}
+			c.Address = filepath.Join(runtimeDir, "libvirt", "libvirt-sock")
+			return c, nil
+		}
+		c.Address = "/var/run/libvirt/libvirt-sock"
+		return c, nil
+	case "tcp":
+		port := u.Port()
+		if port == "" {
+			port = "16509"
+		}
+		c.Address = net.JoinHostPort(u.Hostname(), port)
+		return c, nil
+	case "ssh":
+		port := u.Port()
+		if port == "" {
+			port = "22"
+		}
+		c.Address = net.JoinHostPort(u.Hostname(), port)
+		c.User = u.User.Username()
+
+		// The socket of the session daemon depends on the remote user
+		c.Socket = u.Query().Get("socket")
+		if c.Socket == "" && u.Path == "/session" {
+			return c, fmt.Errorf("the socket of the session daemon must be set in connection %q", connection)
+		}
+		if c.Socket == "" {
+			c.Socket = "/var/run/libvirt/libvirt-sock"
+		}
+		return c, nil
+	default:
+		return c, fmt.Errorf("unsupported connection transport %q", transport)
+	}
+}
+
+// domainStateName returns the name of the domain state, as shown by virsh
+func domainStateName(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DomainRunning:
+		return "running"
+	case libvirt.DomainBlocked:
+		return "idle"
+	case libvirt.DomainPaused:
+		return "paused"
+	case libvirt.DomainShutdown:
+		return "in shutdown"
+	case libvirt.DomainShutoff:
+		return "shut off"
+	case libvirt.DomainCrashed:
+		return "crashed"
+	case libvirt.DomainPmsuspended:
+		return "pmsuspended"
+	default:
+		return "no state"
+	}
 }
@@ -1 +1,287 @@
 package hypvsr
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConnection(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+
+	testCases := []struct {
+		connection string
+		expected   libvirtConnection
+		remote     bool
+	}{
+		{"", libvirtConnection{Transport: "unix", Address: "/var/run/libvirt/libvirt-sock", URI: "qemu:///system"}, false},
+		{"qemu:///system", libvirtConnection{Transport: "unix", Address: "/var/run/libvirt/libvirt-sock", URI: "qemu:///system"}, false},
+		{"qemu:///session", libvirtConnection{Transport: "unix", Address: "/run/user/1000/libvirt/libvirt-sock", URI: "qemu:///session"}, false},
+		{"qemu+unix:///system?socket=/tmp/libvirt.sock", libvirtConnection{Transport: "unix", Address: "/tmp/libvirt.sock", URI: "qemu:///system"}, false},
+		{"qemu+tcp://host.example.com/system", libvirtConnection{Transport: "tcp", Address: "host.example.com:16509", URI: "qemu:///system"}, true},
+		{"qemu+tcp://10.0.0.1:16000/session", libvirtConnection{Transport: "tcp", Address: "10.0.0.1:16000", URI: "qemu:///session"}, true},
+		{"qemu+tcp://localhost/system", libvirtConnection{Transport: "tcp", Address: "localhost:16509", URI: "qemu:///system"}, false},
+		{"qemu+tcp://127.0.0.1/system", libvirtConnection{Transport: "tcp", Address: "127.0.0.1:16509", URI: "qemu:///system"}, false},
+		{"qemu+ssh://lab1/system", libvirtConnection{Transport: "ssh", Address: "lab1:22", Socket: "/var/run/libvirt/libvirt-sock", URI: "qemu:///system"}, true},
+		{"qemu+ssh://admin@lab2:2222/session?socket=/run/user/1000/libvirt/libvirt-sock", libvirtConnection{Transport: "ssh", Address: "lab2:2222", Socket: "/run/user/1000/libvirt/libvirt-sock", User: "admin", URI: "qemu:///session"}, true},
+	}
+	for _, tc := range testCases {
+		c, err := parseConnection(tc.connection)
+		assert.NoError(t, err, tc.connection)
+		assert.Equal(t, tc.expected, c, tc.connection)
+		assert.Equal(t, tc.remote, c.isRemote(), tc.connection)
+	}
+
+	// Test case: Unsupported connections
+	for _, connection := range []string{"qemu://host/system", "qemu+tls://host/system", "qemu+ssh://host/session"} {
+		_, err := parseConnection(connection)
+		assert.Error(t, err, connection)
+	}
+}
+
+func TestMachine_IsRemote(t *testing.T) {
+	setTestConfig(t, &config.Config{Connection: "qemu+ssh://lab1/system"})
+
+	// Test case: The machine uses the configured connection
+	machine := &Machine{Name: "test-machine", baseDir: "/instances", Hypervisor: &Libvirt{}}
+	assert.True(t, machine.isRemote())
+	assert.Equal(t, "/var/lib/libvirt/images/machina/test-machine", machine.getDiskDir())
+
+	// Test case: The connection of the machine overrides the configured one
+	machine.Connection = "qemu:///system"
+	assert.False(t, machine.isRemote())
+	assert.Equal(t, "/instances/test-machine", machine.getDiskDir())
+
+	// Test case: The remote directory is configured
+	machine.Connection = "qemu+tcp://10.0.0.1/system"
+	cfg.Directories.Remote = "/srv/machina"
+	assert.Equal(t, "/srv/machina/test-machine", machine.getDiskDir())
+
+	// Test case: Only libvirt runs machines in remote hosts
+	machine.Hypervisor = &Qemu{}
+	assert.False(t, machine.isRemote())
+	assert.Error(t, machine.Hypervisor.Create(machine))
+}
+
+func TestDomainStateName(t *testing.T) {
+	assert.Equal(t, "running", domainStateName(libvirt.DomainRunning))
+	assert.Equal(t, "shut off", domainStateName(libvirt.DomainShutoff))
+	assert.Equal(t, "paused", domainStateName(libvirt.DomainPaused))
+	assert.Equal(t, "no state", domainStateName(libvirt.DomainNostate))
+}
+
+func TestDiskTargetDev(t *testing.T) {
+	assert.Equal(t, "vda", diskTargetDev("vd", 0))
+	assert.Equal(t, "vdz", diskTargetDev("vd", 25))
+	assert.Equal(t, "vdaa", diskTargetDev("vd", 26))
+	assert.Equal(t, "sdb", diskTargetDev("sd", 1))
+}
+
+func TestNewDomainXML(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	machine := &Machine{
+		Name:      "test-machine",
+		baseDir:   "/instances",
+		Resources: Resources{CPUs: "2", Memory: "2G"},
+		Disks: []Disk{
+			{Name: "data", Size: "10G"},
+			{Name: "db", Size: "10G", Format: "raw", Bus: "scsi"},
+			{Name: "logs", Size: "10G", Bus: "sata"},
+		},
+		Mounts: []Mount{
+			{Name: "src", HostPath: "/home/user/src", GuestPath: "/src", ReadOnly: true},
+		},
+		Network: Network{
+			MacAddress: "52:54:00:00:00:01",
+			Bridge:     "br0",
+			Interfaces: []Interface{
+				{NicName: "lan", Bridge: "br-lan", MacAddress: "52:54:00:00:00:02"},
+				{NicName: "nat", Network: "default", MacAddress: "52:54:00:00:00:03"},
+			},
+		},
+	}
+
+	definition, err := newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+
+	domain := domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, "kvm", domain.Type)
+	assert.Equal(t, "test-machine", domain.Name)
+	assert.Equal(t, domainMemory{Unit: "MiB", Value: "2048"}, domain.Memory)
+	assert.Equal(t, "2", domain.VCPU)
+
+	// Verify the disks
+	disks := domain.Devices.Disks
+	assert.Len(t, disks, 5)
+	assert.Equal(t, "/instances/test-machine/disk.img", disks[0].Source.File)
+	assert.Equal(t, domainTarget{Dev: "vda", Bus: "virtio"}, disks[0].Target)
+	assert.Equal(t, "/instances/test-machine/seed.img", disks[1].Source.File)
+	assert.Equal(t, "raw", disks[1].Driver.Type)
+	assert.Equal(t, domainTarget{Dev: "vdc", Bus: "virtio"}, disks[2].Target)
+	assert.Equal(t, "data", disks[2].Serial)
+	assert.Equal(t, domainTarget{Dev: "sda", Bus: "scsi"}, disks[3].Target)
+	assert.Equal(t, "raw", disks[3].Driver.Type)
+	assert.Equal(t, domainTarget{Dev: "sdb", Bus: "sata"}, disks[4].Target)
+	assert.Equal(t, []domainController{{Type: "scsi", Model: "virtio-scsi"}}, domain.Devices.Controllers)
+
+	// Verify the serial console is served on a socket and logged
+	assert.Len(t, domain.Devices.Serials, 1)
+	assert.Equal(t, &domainSource{Mode: "bind", Path: "/instances/test-machine/console.sock"}, domain.Devices.Serials[0].Source)
+	assert.Equal(t, &domainLog{File: "/instances/test-machine/console.log", Append: "on"}, domain.Devices.Serials[0].Log)
+	assert.Equal(t, "serial", domain.Devices.Consoles[0].Target.Type)
+
+	// Verify the interfaces
+	assert.Equal(t, []domainInterface{
+		{Type: "bridge", MAC: domainMAC{Address: "52:54:00:00:00:01"}, Source: &domainSource{Bridge: "br0"}, Model: domainModel{Type: "virtio"}},
+		{Type: "bridge", MAC: domainMAC{Address: "52:54:00:00:00:02"}, Source: &domainSource{Bridge: "br-lan"}, Model: domainModel{Type: "virtio"}},
+		{Type: "network", MAC: domainMAC{Address: "52:54:00:00:00:03"}, Source: &domainSource{Network: "default"}, Model: domainModel{Type: "virtio"}},
+	}, domain.Devices.Interfaces)
+
+	// Verify the mount points
+	assert.Len(t, domain.Devices.Filesystems, 1)
+	assert.Equal(t, "/home/user/src", domain.Devices.Filesystems[0].Source.Dir)
+	assert.Equal(t, "/src", domain.Devices.Filesystems[0].Target.Dir)
+	assert.NotNil(t, domain.Devices.Filesystems[0].ReadOnly)
+
+	// Test case: Invalid memory
+	machine.Resources.Memory = "twoG"
+	_, err = newDomainXML(machine, "kvm")
+	assert.Error(t, err)
+}
+
+func TestNewDomainXML_UserMode(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	machine := &Machine{
+		Name:      "test-machine",
+		baseDir:   "/instances",
+		Resources: Resources{CPUs: "1", Memory: "1G"},
+		Network: Network{
+			Mode:       config.NetworkModeUser,
+			MacAddress: "52:54:00:00:00:01",
+			SSHPort:    2222,
+		},
+		Ports: []Port{
+			{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"},
+			{HostPort: 5353, GuestPort: 53, Protocol: "udp", HostAddress: "0.0.0.0"},
+		},
+	}
+
+	definition, err := newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	assert.Contains(t, string(definition), `<interface type="user">`)
+
+	// Verify that SSH and the udp ports are forwarded by the passt backend
+	domain := domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, []domainInterface{
+		{
+			Type:    "user",
+			MAC:     domainMAC{Address: "52:54:00:00:00:01"},
+			Model:   domainModel{Type: "virtio"},
+			Backend: &domainModel{Type: "passt"},
+			PortForwards: []domainPortForward{
+				{Proto: "tcp", Address: "127.0.0.1", Ranges: []domainPortMap{{Start: 2222, To: 22}}},
+				{Proto: "udp", Address: "0.0.0.0", Ranges: []domainPortMap{{Start: 5353, To: 53}}},
+			},
+		},
+	}, domain.Devices.Interfaces)
+}
+
+func TestNewDomainXML_Remote(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	machine := &Machine{
+		Name:       "test-machine",
+		baseDir:    "/instances",
+		Connection: "qemu+ssh://lab1/system",
+		Hypervisor: &Libvirt{},
+		Resources:  Resources{CPUs: "1", Memory: "1G"},
+		Disks:      []Disk{{Name: "data", Size: "10G"}},
+	}
+
+	// Test case: The disks are in the remote directory
+	definition, err := newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	domain := domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, "/var/lib/libvirt/images/machina/test-machine/disk.img", domain.Devices.Disks[0].Source.File)
+	assert.Equal(t, "/var/lib/libvirt/images/machina/test-machine/seed.img", domain.Devices.Disks[1].Source.File)
+	assert.Equal(t, "/var/lib/libvirt/images/machina/test-machine/disk-data.img", domain.Devices.Disks[2].Source.File)
+
+	// Test case: The mount points are not in the remote host
+	machine.Mounts = []Mount{{HostPath: "/home/user/src", GuestPath: "/src"}}
+	_, err = newDomainXML(machine, "kvm")
+	assert.Error(t, err)
+}
+
+func TestNewDomainSnapshotXML(t *testing.T) {
+	machine := &Machine{
+		Name:    "test-machine",
+		baseDir: "/instances",
+		Disks: []Disk{
+			{Name: "data", Size: "10G"},
+			{Name: "db", Size: "10G", Format: "raw"},
+		},
+	}
+
+	definition, err := newDomainSnapshotXML(machine, "snap1")
+	assert.NoError(t, err)
+
+	snapshot := domainSnapshotXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &snapshot))
+	assert.Equal(t, "snap1", snapshot.Name)
+	assert.Equal(t, []domainSnapshotDisk{
+		{Name: "/instances/test-machine/seed.img", Snapshot: "no"},
+		{Name: "/instances/test-machine/disk-db.img", Snapshot: "no"},
+	}, snapshot.Disks)
+
+	// Test case: The machines that boot with UEFI have pflash firmware
+	machine.Resources.Firmware = FirmwareUEFI
+	_, err = newDomainSnapshotXML(machine, "snap1")
+	assert.Error(t, err)
+	machine = &Machine{Name: "test-machine", baseDir: "/instances", Arch: ArchAArch64}
+	_, err = newDomainSnapshotXML(machine, "snap1")
+	assert.Error(t, err)
+}
+
+func TestParseDomainSnapshotXML(t *testing.T) {
+	definition := `<domainsnapshot>
+  <name>snap1</name>
+  <state>shutoff</state>
+  <creationTime>1682935200</creationTime>
+  <memory snapshot='no'/>
+</domainsnapshot>`
+
+	snapshot, err := parseDomainSnapshotXML(definition)
+	assert.NoError(t, err)
+	assert.Equal(t, "snap1", snapshot.Name)
+	assert.Equal(t, time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC).Unix(), snapshot.CreatedAt.Unix())
+
+	// Test case: Invalid definition
+	_, err = parseDomainSnapshotXML("<domainsnapshot>")
+	assert.Error(t, err)
+}
+
+func TestLibvirt_ConnectError(t *testing.T) {
+	// Point the configuration to a connection without a daemon
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	os.MkdirAll(filepath.Join(home, ".config", "machina"), 0755)
+	os.WriteFile(filepath.Join(home, ".config", "machina", "config.yaml"), []byte("connection: qemu+unix:///system?socket="+filepath.Join(home, "missing.sock")+"\n"), 0644)
+
+	setTestConfig(t, nil)
+
+	h := &Libvirt{}
+	_, err := h.Status(&Machine{Name: "test-machine"})
+	assert.Error(t, err)
+
+	// Test case: The connection of the machine is used
+	_, err = h.Status(&Machine{Name: "test-machine", Connection: "qemu+unix:///system?socket=" + filepath.Join(home, "other.sock")})
+	assert.ErrorContains(t, err, "other.sock")
+}
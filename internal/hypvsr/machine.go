@@ -1,11 +1,15 @@
 package hypvsr
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,19 +33,55 @@ type Machine struct {
 	Credentials Credentials   `yaml:"credentials,omitempty"` // Credentials for the machine
 	Resources   Resources     `yaml:"resources,omitempty"`   // Hardware resources for the machine
 	Scripts     Scripts       `yaml:"scripts,omitempty"`     // Scripts to run in the machine
-	Mount       Mount         `yaml:"mount,omitempty"`       // Mount point details
+	Mount       Mount         `yaml:"mount,omitempty"`       // Mount point details (deprecated, use mounts)
+	Mounts      []Mount       `yaml:"mounts,omitempty"`      // List of mount points
+	Disks       []Disk        `yaml:"disks,omitempty"`       // Additional data disks
 	Network     Network       `yaml:"network,omitempty"`     // Network configuration
+	Ports       []Port        `yaml:"ports,omitempty"`       // Ports forwarded from the host
 	Connection  string        `yaml:"connection,omitempty"`  // Connection to hypervisor
 	Variant     string        `yaml:"variant,omitempty"`     // OS variant to use
+	Arch        string        `yaml:"arch,omitempty"`        // Architecture of the machine, x86_64, aarch64 or riscv64
+	ClusterName string        `yaml:"cluster,omitempty"`     // Name of the cluster the machine was created from
 	Hypervisor  Hypervisor    `yaml:"-"`
 	Runner      osutil.Runner `yaml:"-"`
-	clusterName string
 }
 
 // Image holds the URL and checksum of the machine image
 type Image struct {
-	URL      string `yaml:"url,omitempty"`      // URL of the machine image
-	Checksum string `yaml:"checksum,omitempty"` // Checksum for the image in the format 'algorithm:hash'
+	URL           string           `yaml:"url,omitempty"`           // URL of the machine image
+	Checksum      string           `yaml:"checksum,omitempty"`      // Checksum for the image in the format 'algorithm:hash'
+	ChecksumURL   string           `yaml:"checksumUrl,omitempty"`   // URL of a checksum file listing the image, e.g. SHA256SUMS, used when no checksum is set
+	SignatureURL  string           `yaml:"signatureUrl,omitempty"`  // URL of the detached GPG signature of the checksum file
+	Keyring       string           `yaml:"keyring,omitempty"`       // Path or URL of the public keys that sign the checksum file
+	Architectures map[string]Image `yaml:"architectures,omitempty"` // Images for other architectures, by architecture
+}
+
+// resolveImage sets the image of the machine to the one listed for its
+// architecture. The default image is only used for x86_64.
+func (machine *Machine) resolveImage() error {
+	arch, err := machine.getArch()
+	if err != nil {
+		return err
+	}
+
+	if image, ok := machine.Image.Architectures[arch]; ok {
+		machine.Image.URL = image.URL
+		machine.Image.Checksum = image.Checksum
+		// The checksum file is often shared by the images of all architectures
+		if image.ChecksumURL != "" {
+			machine.Image.ChecksumURL = image.ChecksumURL
+			machine.Image.SignatureURL = image.SignatureURL
+		}
+		if image.Keyring != "" {
+			machine.Image.Keyring = image.Keyring
+		}
+	} else if arch != ArchX86_64 {
+		// The default image is for x86_64 and can't boot other architectures
+		return fmt.Errorf("the template lists no image for %s under architectures", arch)
+	}
+	machine.Image.Architectures = nil
+
+	return nil
 }
 
 // Credentials holds the username, password, and user groups
@@ -53,9 +93,15 @@ type Credentials struct {
 
 // Resources holds the hardware specifications of the machine
 type Resources struct {
-	CPUs   string `yaml:"cpus,omitempty"`   // Number of CPUs for the machine
-	Memory string `yaml:"memory,omitempty"` // Amount of RAM for the machine
-	Disk   string `yaml:"disk,omitempty"`   // Disk space for the machine
+	CPUs      string     `yaml:"cpus,omitempty"`      // Number of CPUs for the machine
+	CPU       CPU        `yaml:"cpu,omitempty"`       // Model and topology of the CPUs
+	Memory    string     `yaml:"memory,omitempty"`    // Amount of RAM for the machine
+	HugePages bool       `yaml:"hugepages,omitempty"` // Back the RAM with huge pages
+	Balloon   *bool      `yaml:"balloon,omitempty"`   // Attach or remove the memory balloon device
+	NUMA      []NUMANode `yaml:"numa,omitempty"`      // NUMA nodes the CPUs and RAM are split in
+	Disk      string     `yaml:"disk,omitempty"`      // Disk space for the machine
+	Firmware  string     `yaml:"firmware,omitempty"`  // Firmware to boot with, bios, uefi or uefi-secure
+	TPM       bool       `yaml:"tpm,omitempty"`       // Attach a software TPM 2.0 to the machine
 }
 
 // Scripts holds the installation and initialisation scripts
@@ -69,14 +115,53 @@ type Mount struct {
 	Name      string `yaml:"name,omitempty"`      // Name of the mount point
 	HostPath  string `yaml:"hostPath,omitempty"`  // Path in the host
 	GuestPath string `yaml:"guestPath,omitempty"` // Path inside the VM
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`  // Mount the folder as read-only
+	Options   string `yaml:"options,omitempty"`   // Extra mount options used inside the VM
+}
+
+// Disk holds the details of an additional data disk
+type Disk struct {
+	Name       string `yaml:"name,omitempty"`       // Name of the disk
+	Size       string `yaml:"size,omitempty"`       // Size of the disk
+	Format     string `yaml:"format,omitempty"`     // Format of the disk image, qcow2 or raw
+	Bus        string `yaml:"bus,omitempty"`        // Bus the disk is attached to, virtio, scsi or sata
+	Filesystem string `yaml:"filesystem,omitempty"` // Filesystem to create on the disk
+	MountPoint string `yaml:"mountPoint,omitempty"` // Path where the filesystem is mounted inside the VM
 }
 
 // Network holds the network configuration
 type Network struct {
-	NicName    string `yaml:"nicName,omitempty"`    // Name of the interface
-	IPAddress  string `yaml:"ipAddress,omitempty"`  // IP Address of the machine
-	Gateway    string `yaml:"gateway,omitempty"`    // Gateway of the network
-	MacAddress string `yaml:"macAddress,omitempty"` // MacAddress of the NIC
+	Mode       string      `yaml:"mode,omitempty"`       // Networking mode, bridge or user
+	NicName    string      `yaml:"nicName,omitempty"`    // Name of the interface
+	IPAddress  string      `yaml:"ipAddress,omitempty"`  // IP Address of the machine
+	Gateway    string      `yaml:"gateway,omitempty"`    // Gateway of the network
+	MacAddress string      `yaml:"macAddress,omitempty"` // MacAddress of the NIC
+	CIDR       string      `yaml:"cidr,omitempty"`       // Subnet of the network
+	Bridge     string      `yaml:"bridge,omitempty"`     // Bridge the NIC is attached to
+	DNS        []string    `yaml:"dns,omitempty"`        // DNS servers
+	Search     []string    `yaml:"search,omitempty"`     // DNS search domains
+	SSHPort    int         `yaml:"sshPort,omitempty"`    // Host port forwarded to SSH in user mode
+	Interfaces []Interface `yaml:"interfaces,omitempty"` // Additional network interfaces
+}
+
+// Port holds a port of the machine forwarded from the host
+type Port struct {
+	HostPort    int    `yaml:"hostPort,omitempty"`    // Port on the host, a free one is assigned when empty
+	GuestPort   int    `yaml:"guestPort,omitempty"`   // Port inside the machine
+	Protocol    string `yaml:"protocol,omitempty"`    // Protocol of the port, tcp or udp
+	HostAddress string `yaml:"hostAddress,omitempty"` // Address the host port is bound to, 127.0.0.1 by default
+}
+
+// Interface holds the configuration of an additional network interface
+type Interface struct {
+	NicName    string   `yaml:"nicName,omitempty"`    // Name of the interface
+	Bridge     string   `yaml:"bridge,omitempty"`     // Bridge the NIC is attached to
+	Network    string   `yaml:"network,omitempty"`    // Libvirt network the NIC is attached to
+	IPAddress  string   `yaml:"ipAddress,omitempty"`  // Static IP address in CIDR notation, DHCP is used when empty
+	Gateway    string   `yaml:"gateway,omitempty"`    // Gateway of the interface
+	DNS        []string `yaml:"dns,omitempty"`        // DNS servers
+	Search     []string `yaml:"search,omitempty"`     // DNS search domains
+	MacAddress string   `yaml:"macAddress,omitempty"` // MacAddress of the NIC
 }
 
 // CreateDir creates the directory for the machine
@@ -94,33 +179,18 @@ func (machine *Machine) CreateDir() error {
 
 // Prepare prepares the machine for use
 func (machine *Machine) Prepare() error {
-	// Credentials network configuration
-	net := netutil.NewNetwork()
-	netYaml, err := yaml.Marshal(net)
+	// Create the network configuration
+	err := machine.createNetworkFile()
 	if err != nil {
 		return err
 	}
 
-	// Save network configuration
-	err = os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.NetworkFilename)), netYaml, 0644)
+	// Get the data disks
+	disks, err := machine.getDisks()
 	if err != nil {
 		return err
 	}
 
-	// Get the IP address from the network configuration
-	ipAddr, err := netutil.GetIPFromNetworkAddress(net.Ethernets.VirtNet.Addresses[0])
-	if err != nil {
-		return err
-	}
-
-	// Set Network configuration
-	machine.Network = Network{
-		NicName:    net.Ethernets.VirtNet.Name,
-		IPAddress:  ipAddr,
-		Gateway:    net.Ethernets.VirtNet.Gateway4,
-		MacAddress: net.Ethernets.VirtNet.Match.MacAddress,
-	}
-
 	// Create user data
 	clCfg := usrutil.CloudConfig{
 		Hostname: machine.Name,
@@ -129,6 +199,19 @@ func (machine *Machine) Prepare() error {
 		Groups:   machine.Credentials.Groups,
 	}
 
+	// Create the filesystems on the data disks
+	for _, disk := range disks {
+		if disk.Filesystem == "" {
+			continue
+		}
+		clCfg.Filesystems = append(clCfg.Filesystems, usrutil.Filesystem{
+			Label:      disk.Name,
+			Device:     disk.guestDevice(),
+			Type:       disk.Filesystem,
+			MountPoint: disk.MountPoint,
+		})
+	}
+
 	// Create user data
 	usr, err := usrutil.NewUserData(&clCfg)
 	if err != nil {
@@ -147,6 +230,20 @@ func (machine *Machine) Prepare() error {
 		return err
 	}
 
+	// Save meta data
+	meta, err := usrutil.NewMetaData(machine.Name)
+	if err != nil {
+		return err
+	}
+	metaYaml, err := yaml.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.MetadataFilename)), metaYaml, 0644)
+	if err != nil {
+		return err
+	}
+
 	// Save private key
 	err = os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)), clCfg.PrivateKey, 0600)
 	if err != nil {
@@ -160,22 +257,125 @@ func (machine *Machine) Prepare() error {
 	}
 
 	// Save machine file
+	return machine.save()
+}
+
+// Saves the machine file
+func (machine *Machine) save() error {
 	vmYaml, err := yaml.Marshal(machine)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.InstanceFilename)), vmYaml, 0644)
+	return os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.InstanceFilename)), vmYaml, 0644)
+}
+
+// Creates the cloud-init network configuration file with the IP address
+// allocated for the machine and its additional interfaces
+func (machine *Machine) createNetworkFile() error {
+	settings := machine.getNetworkSettings()
+	var net *netutil.Network
+	var err error
+	switch settings.Mode {
+	case config.NetworkModeBridge:
+		// Allocate the IP address and create the network configuration
+		ipam, err := getIPAM(settings)
+		if err != nil {
+			return err
+		}
+		net, err = netutil.NewNetwork(ipam, machine.Name, settings)
+		if err != nil {
+			return err
+		}
+	case config.NetworkModeUser:
+		// The address is assigned by the hypervisor and SSH is reached through a forwarded port
+		net = netutil.NewUserNetwork(settings)
+	default:
+		return fmt.Errorf("invalid network mode %q", settings.Mode)
+	}
+
+	// Assign the host ports forwarded to the machine
+	err = machine.assignPorts(settings)
 	if err != nil {
 		return err
 	}
 
+	// Add the additional interfaces
+	interfaces := make([]Interface, len(machine.Network.Interfaces))
+	for i, iface := range machine.Network.Interfaces {
+		// Name the interfaces without a name after their position
+		if iface.NicName == "" {
+			iface.NicName = fmt.Sprintf("%s%d", netutil.PrimaryInterface, i+1)
+		}
+		if iface.Bridge == "" && iface.Network == "" {
+			return fmt.Errorf("interface %q needs a bridge or a network", iface.NicName)
+		}
+
+		iface.MacAddress, err = net.AddInterface(netutil.Interface{
+			Name:       iface.NicName,
+			MacAddress: iface.MacAddress,
+			Address:    iface.IPAddress,
+			Gateway:    iface.Gateway,
+			DNS:        iface.DNS,
+			Search:     iface.Search,
+		})
+		if err != nil {
+			return err
+		}
+		interfaces[i] = iface
+	}
+
+	netYaml, err := yaml.Marshal(net)
+	if err != nil {
+		return err
+	}
+
+	// Save network configuration
+	err = os.WriteFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.NetworkFilename)), netYaml, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Get the IP address from the network configuration
+	primary := net.Primary()
+	ipAddr := ""
+	if len(primary.Addresses) > 0 {
+		ipAddr, err = netutil.GetIPFromNetworkAddress(primary.Addresses[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set Network configuration
+	machine.Network = Network{
+		Mode:       settings.Mode,
+		NicName:    primary.Name,
+		IPAddress:  ipAddr,
+		Gateway:    primary.Gateway4,
+		MacAddress: primary.Match.MacAddress,
+		CIDR:       settings.CIDR,
+		Bridge:     settings.Bridge,
+		DNS:        settings.DNS,
+		Search:     settings.Search,
+		SSHPort:    machine.Network.SSHPort,
+		Interfaces: interfaces,
+	}
+
 	return nil
+}
 
+// sshAddress returns the address where the SSH server of the machine is reached
+func (machine *Machine) sshAddress() string {
+	if machine.Network.SSHPort != 0 {
+		return net.JoinHostPort(localhost, strconv.Itoa(machine.Network.SSHPort))
+	}
+	return machine.Network.IPAddress
 }
 
-// DownloadImage downloads the image for the machine
-func (machine *Machine) DownloadImage() error {
+// DownloadImage downloads the image for the machine to the image cache,
+// reporting the progress of the download when set. The image is verified
+// against its checksum, which is read from its checksum file when not set.
+func (machine *Machine) DownloadImage(progress netutil.Progress) error {
 	// Get the image filename
 	imgDir := cfg.Directories.Images
 	fileName, err := imgutil.GetFilenameFromURL(machine.Image.URL)
@@ -186,27 +386,67 @@ func (machine *Machine) DownloadImage() error {
 	// Set the local image path
 	localImage := filepath.Join(imgDir, fileName)
 
+	checksum, err := machine.getImageChecksum()
+	if err != nil {
+		return err
+	}
+
 	// check if hashes equal
-	if osutil.Checksum(localImage, machine.Image.Checksum) {
-		return nil
+	if imgutil.VerifyChecksum(localImage, checksum) {
+		return machine.writeImageMetadata(localImage, checksum)
 	}
 
 	// download the image
-	err = netutil.DownloadAndSave(machine.Image.URL, imgDir)
+	err = netutil.DownloadFile(machine.Image.URL, localImage, progress)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	// Never keep an image that does not match its checksum
+	if checksum != "" && !imgutil.VerifyChecksum(localImage, checksum) {
+		imgutil.RemoveImage(localImage)
+		return fmt.Errorf("the downloaded image %s does not match the checksum %s", machine.Image.URL, checksum)
+	}
+
+	// Keep where the image was downloaded from for the image cache
+	return machine.writeImageMetadata(localImage, checksum)
+}
+
+// writeImageMetadata keeps where the cached image was downloaded from and its
+// checksum, along with the digests already computed
+func (machine *Machine) writeImageMetadata(localImage, checksum string) error {
+	metadata, err := imgutil.ReadMetadata(localImage)
+	if err != nil {
+		return err
+	}
+	metadata.URL = machine.Image.URL
+	metadata.Checksum = checksum
+	return imgutil.WriteMetadata(localImage, metadata)
 }
 
-// CreateDisks creates the disks for the machine
+// CreateDisks creates the disks for the machine. The disks of a machine that
+// runs in a remote host are created there by the hypervisor, except for the
+// seed disk, which is uploaded.
 func (machine *Machine) CreateDisks() error {
-	err := machine.createInstanceDisk()
+	err := machine.createSeedDisk()
+	if err != nil {
+		return err
+	}
+	if machine.isRemote() {
+		return nil
+	}
+
+	err = machine.createInstanceDisk()
+	if err != nil {
+		return err
+	}
+
+	err = machine.createNVRAM()
 	if err != nil {
 		return err
 	}
 
-	err = machine.createSeedDisk()
+	err = machine.createDataDisks()
 	if err != nil {
 		return err
 	}
@@ -214,6 +454,51 @@ func (machine *Machine) CreateDisks() error {
 	return nil
 }
 
+// Creates the additional data disks of the machine
+func (machine *Machine) createDataDisks() error {
+	disks, err := machine.getDisks()
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		// Set the arguments
+		args := []string{
+			"create",
+			"-f", disk.Format,
+			machine.getDataDiskPath(disk),
+			disk.Size,
+		}
+
+		// Run the command to create the disk
+		_, err := machine.Runner.RunCommand("qemu-img", args)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getDataDiskPath returns the path of the data disk image
+func (machine *Machine) getDataDiskPath(disk Disk) string {
+	return filepath.Join(machine.getDiskDir(), dataDiskFilename(disk))
+}
+
+// dataDiskFilename returns the name of the image file of the data disk
+func dataDiskFilename(disk Disk) string {
+	return fmt.Sprintf("disk-%s.img", disk.Name)
+}
+
+// getDiskDir returns the directory of the disk images of the machine, which
+// is in the remote host when the machine runs in one
+func (machine *Machine) getDiskDir() string {
+	if machine.isRemote() {
+		return filepath.Join(getRemoteDir(), machine.Name)
+	}
+	return filepath.Join(machine.baseDir, machine.Name)
+}
+
 func (machine *Machine) createInstanceDisk() error {
 	// Get the image filename
 	image, _ := imgutil.GetFilenameFromURL(machine.Image.URL)
@@ -248,6 +533,7 @@ func (machine *Machine) createSeedDisk() error {
 		fmt.Sprintf("--network-config=%s", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.NetworkFilename))),
 		filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.SeedImageFilename)),
 		filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.UserdataFilename)),
+		filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.MetadataFilename)),
 	}
 
 	// Run the command to create the disk
@@ -267,11 +553,22 @@ func (machine *Machine) Create() error {
 // Wait until the machine is running
 func (machine *Machine) Wait() error {
 	// Set the start time
+	// Check the machine from the remote host it runs in, if any
+	isResponding := sshutil.IsResponding
+	jump, err := machine.connectJumpHost()
+	if err != nil {
+		return err
+	}
+	if jump != nil {
+		defer jump.Close()
+		isResponding = jump.IsResponding
+	}
+
 	start := time.Now()
 	running := false
 	for !running {
 		// Check if the machine is running
-		running = sshutil.IsResponding(machine.Network.IPAddress)
+		running = isResponding(machine.sshAddress())
 		// Sleep for 1 second
 		time.Sleep(time.Second)
 		// Return a timeout error in case the machine takes more than
@@ -286,6 +583,10 @@ func (machine *Machine) Wait() error {
 
 // Starts a stopped vm
 func (machine *Machine) Start() error {
+	err := machine.checkLinkedClones()
+	if err != nil {
+		return err
+	}
 	return machine.Hypervisor.Start(machine)
 }
 
@@ -299,6 +600,33 @@ func (machine *Machine) ForceStop() error {
 	return machine.Hypervisor.ForceStop(machine)
 }
 
+// Restarts a running VM
+func (machine *Machine) Restart() error {
+	return machine.Hypervisor.Restart(machine)
+}
+
+// Pauses a running VM
+func (machine *Machine) Pause() error {
+	return machine.Hypervisor.Pause(machine)
+}
+
+// Resumes a paused VM or restores a suspended one
+func (machine *Machine) Resume() error {
+	status, err := machine.Status()
+	if err != nil {
+		return err
+	}
+	if status == "saved" {
+		return machine.Start()
+	}
+	return machine.Hypervisor.Resume(machine)
+}
+
+// Suspends a running VM to disk, saving its state to be restored on the next start
+func (machine *Machine) Suspend() error {
+	return machine.Hypervisor.Save(machine)
+}
+
 // Gets the status of a VM
 func (machine *Machine) Status() (string, error) {
 	return machine.Hypervisor.Status(machine)
@@ -306,77 +634,95 @@ func (machine *Machine) Status() (string, error) {
 
 // Deletes a VM
 func (machine *Machine) Delete() error {
-	return machine.Hypervisor.Delete(machine)
+	err := machine.checkLinkedClones()
+	if err != nil {
+		return err
+	}
+
+	err = machine.Hypervisor.Delete(machine)
+	if err != nil {
+		return err
+	}
+
+	// Release the IP address leased to the VM
+	settings := machine.getNetworkSettings()
+	if settings.Mode == config.NetworkModeUser {
+		return nil
+	}
+	ipam, err := getIPAM(settings)
+	if err != nil {
+		return err
+	}
+	return ipam.Release(machine.Name)
 }
 
-// Copies content from host to guest or vice-versa
-func (machine *Machine) CopyContent(origin string, dest string) error {
-	// Define the origin and destination for copying content
-	hostToVM := true
-	if hostToVM {
-		parts := strings.Split(dest, ":")
-		dest = fmt.Sprintf("%s@%s:%s", machine.Credentials.Username, machine.Network.IPAddress, parts[1])
-	} else {
-		parts := strings.Split(origin, ":")
-		origin = fmt.Sprintf("%s@%s:%s", machine.Credentials.Username, machine.Network.IPAddress, parts[1])
-	}
-	command := "scp"
-	args := []string{
-		"-r",
-		"-o StrictHostKeyChecking=no",
-		"-i", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)),
-		origin,
-		dest,
+// Creates a snapshot of a VM
+func (machine *Machine) CreateSnapshot(name string) error {
+	return machine.Hypervisor.CreateSnapshot(machine, name)
+}
+
+// Lists the snapshots of a VM
+func (machine *Machine) ListSnapshots() ([]Snapshot, error) {
+	return machine.Hypervisor.ListSnapshots(machine)
+}
+
+// Reverts a VM to a snapshot
+func (machine *Machine) RevertSnapshot(name string) error {
+	err := machine.checkLinkedClones()
+	if err != nil {
+		return err
 	}
+	return machine.Hypervisor.RevertSnapshot(machine, name)
+}
 
-	// Run the command to create the disk
-	_, err := machine.Runner.RunCommand(command, args)
+// Deletes a snapshot of a VM
+func (machine *Machine) DeleteSnapshot(name string) error {
+	return machine.Hypervisor.DeleteSnapshot(machine, name)
+}
+
+// Copies content from host to guest or vice-versa
+func (machine *Machine) CopyContent(origin string, dest string) error {
+	client, err := machine.connect()
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	return nil
+	// The path inside the machine is the one prefixed by the machine name
+	if strings.Contains(origin, ":") {
+		parts := strings.SplitN(origin, ":", 2)
+		return client.Download(parts[1], dest)
+	}
+	parts := strings.SplitN(dest, ":", 2)
+	return client.Upload(origin, parts[1])
 }
 
 // Runs the initial scripts after the machine is created
 func (machine *Machine) RunInitScripts() error {
-	// Copies the scripts
-	command := "scp"
-	args := []string{
-		"-o", "StrictHostKeyChecking=no",
-		"-i", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)),
-		"-r",
-		filepath.Join(machine.baseDir, machine.Name, "bin/"),
-		fmt.Sprintf("%s@%s:/tmp/machina", machine.Credentials.Username, machine.Network.IPAddress),
+	client, err := machine.connect()
+	if err != nil {
+		return err
 	}
+	defer client.Close()
 
 	// Copy the scripts
-	_, err := machine.Runner.RunCommand(command, args)
+	err = client.Upload(filepath.Join(machine.baseDir, machine.Name, "bin"), "/tmp/machina")
 	if err != nil {
 		return err
 	}
 
-	// Runs the prepare script inside the VM
-	command = "ssh"
-	args = []string{
-		"-o StrictHostKeyChecking=no",
-		"-i", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)),
-		fmt.Sprintf("%s@%s", machine.Credentials.Username, machine.Network.IPAddress),
-		"/tmp/machina/prepare.sh",
-	}
-
 	// Run the prepare script
-	_, err = machine.Runner.RunCommand(command, args)
+	err = runScript(client, "/tmp/machina/prepare.sh")
 	if err != nil {
 		return err
 	}
 
 	// Set permissions
-	command = "chmod"
-	args = []string{
+	command := "chmod"
+	args := []string{
 		"-R",
 		"+x",
-		filepath.Join(cfg.Directories.Results, machine.clusterName),
+		filepath.Join(cfg.Directories.Results, machine.ClusterName),
 	}
 
 	// Run the set permissions command
@@ -385,49 +731,20 @@ func (machine *Machine) RunInitScripts() error {
 		return err
 	}
 
-	// Sync the results from the host to the VM
-	command = "rsync"
-	args = []string{
-		"-ru",
-		"-e",
-		fmt.Sprintf("ssh -i %s", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename))),
-		filepath.Join(cfg.Directories.Results, machine.clusterName),
-		fmt.Sprintf("%s@%s:/etc/machina/results", machine.Credentials.Username, machine.Network.IPAddress),
-	}
-
 	// Copy the results to the machine
-	_, err = machine.Runner.RunCommand(command, args)
+	err = client.Upload(filepath.Join(cfg.Directories.Results, machine.ClusterName), "/etc/machina/results")
 	if err != nil {
 		return err
 	}
 
-	// Runs the install script inside the Machine
-	command = "ssh"
-	args = []string{
-		"-o StrictHostKeyChecking=no",
-		"-i", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)),
-		fmt.Sprintf("%s@%s", machine.Credentials.Username, machine.Network.IPAddress),
-		"/etc/machina/install.sh",
-	}
-
 	// Run the install script
-	_, err = machine.Runner.RunCommand(command, args)
+	err = runScript(client, "/etc/machina/install.sh")
 	if err != nil {
 		return err
 	}
 
-	// Sync the results from the Machine to the host
-	command = "rsync"
-	args = []string{
-		"-ru",
-		"-e",
-		fmt.Sprintf("ssh -i %s", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename))),
-		fmt.Sprintf("%s@%s:/etc/machina/results/%s", machine.Credentials.Username, machine.Network.IPAddress, machine.clusterName),
-		cfg.Directories.Results,
-	}
-
 	// Copy the results to the host
-	_, err = machine.Runner.RunCommand(command, args)
+	err = client.Download(path.Join("/etc/machina/results", machine.ClusterName), cfg.Directories.Results)
 	if err != nil {
 		return err
 	}
@@ -436,31 +753,269 @@ func (machine *Machine) RunInitScripts() error {
 	return os.RemoveAll(filepath.Join(machine.baseDir, machine.Name, "bin"))
 }
 
-func (machine *Machine) Shell() error {
-	// Copies the init script into the VM
-	command := "ssh"
-	args := []string{
-		"-i", filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)),
-		fmt.Sprintf("%s@%s", machine.Credentials.Username, machine.Network.IPAddress),
+// Runs a script inside the machine, returning its error output when it fails
+func runScript(client *sshutil.SSHClient, script string) error {
+	var stderr bytes.Buffer
+	code, err := client.Run(script, nil, nil, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("%s exited with code %d: %s", script, code, strings.TrimSpace(stderr.String()))
 	}
 
-	// TODO: Add stdin, stdout, stderr to os.Stdout, os.Stdin, os.Stderr
-	// Run the command to create the disk
-	// _, err := machine.Runner.RunCommand(command, args, osutil.WithStdin(os.Stdin), osutil.WithStdout(os.Stdout), osutil.WithStderr(os.Stderr))
-	// if err != nil {
-	// 	return err
-	// }
-	cmd := exec.Command(command, args...)
-	// Redirect stdin, stdout and stderr from the SSH connection to the host
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	return nil
+}
+
+// Runs a command inside the machine without a terminal, streaming its output,
+// and returns the exit code of the command.
+// A single argument is run by the shell of the machine as a command line,
+// while several arguments are quoted and run as a single command.
+func (machine *Machine) Exec(command []string, stdout, stderr io.Writer) (int, error) {
+	if len(command) == 0 {
+		return -1, errors.New("no command to run")
+	}
+
+	client, err := machine.connect()
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+
+	return client.Run(remoteCommand(command), nil, stdout, stderr)
+}
+
+// Returns the command line to run in the shell of the machine
+func remoteCommand(command []string) string {
+	if len(command) == 1 {
+		return command[0]
+	}
+
+	// Quote the arguments to keep them when passed to the shell of the machine
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Opens an interactive shell in the machine
+func (machine *Machine) Shell() error {
+	client, err := machine.connect()
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	return nil
+	return client.Shell()
+}
+
+// Connects to the machine over SSH with the private key of the machine
+func (machine *Machine) connect() (*sshutil.SSHClient, error) {
+	key, err := os.ReadFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.PrivateKeyFilename)))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sshutil.NewSSHClient(machine.Credentials.Username, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect through the remote host the machine runs in, if any
+	jump, err := machine.connectJumpHost()
+	if err != nil {
+		return nil, err
+	}
+	if jump != nil {
+		err = client.ConnectThrough(jump, machine.sshAddress())
+		if err != nil {
+			jump.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+
+	err = client.Connect(machine.sshAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// getConnection returns the connection to the hypervisor of the machine,
+// which defaults to the configured one
+func (machine *Machine) getConnection() string {
+	if machine.Connection != "" {
+		return machine.Connection
+	}
+	if cfg == nil {
+		cfg, _ = config.LoadConfig()
+	}
+	return cfg.Connection
+}
+
+// isRemote checks if the machine runs in a remote libvirt host
+func (machine *Machine) isRemote() bool {
+	if _, ok := machine.Hypervisor.(*Libvirt); !ok {
+		return false
+	}
+	c, err := parseConnection(machine.getConnection())
+	return err == nil && c.isRemote()
+}
+
+// connectJumpHost connects over SSH to the remote host the machine runs in,
+// through which the machine is reached. It returns nil when the machine is
+// reached directly.
+func (machine *Machine) connectJumpHost() (*sshutil.SSHClient, error) {
+	if !machine.isRemote() {
+		return nil, nil
+	}
+	c, err := parseConnection(machine.getConnection())
+	if err != nil || c.Transport != "ssh" {
+		return nil, err
+	}
+
+	client, err := sshutil.NewHostClient(c.User)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Connect(c.Address)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to %q: %w", c.Address, err)
+	}
+
+	return client, nil
+}
+
+// getDisks returns the data disks of the machine with the default values set
+func (machine *Machine) getDisks() ([]Disk, error) {
+	disks := make([]Disk, len(machine.Disks))
+	names := map[string]bool{}
+	for i, disk := range machine.Disks {
+		// Set the default values
+		if disk.Name == "" {
+			disk.Name = fmt.Sprintf("data%d", i)
+		}
+		if disk.Format == "" {
+			disk.Format = "qcow2"
+		}
+		if disk.Bus == "" {
+			disk.Bus = "virtio"
+		}
+		disk.Size = strings.ToUpper(disk.Size)
+
+		// Validate the disk
+		if names[disk.Name] {
+			return nil, fmt.Errorf("duplicated disk name %q", disk.Name)
+		}
+		names[disk.Name] = true
+		if disk.Size == "" {
+			return nil, fmt.Errorf("disk %q has no size", disk.Name)
+		}
+		if disk.Format != "qcow2" && disk.Format != "raw" {
+			return nil, fmt.Errorf("unsupported format %q for disk %q", disk.Format, disk.Name)
+		}
+		if disk.Bus != "virtio" && disk.Bus != "scsi" && disk.Bus != "sata" {
+			return nil, fmt.Errorf("unsupported bus %q for disk %q", disk.Bus, disk.Name)
+		}
+		if disk.Bus == "sata" && machine.Arch != "" && machine.Arch != ArchX86_64 {
+			return nil, fmt.Errorf("disk %q can't use the sata bus in %s machines", disk.Name, machine.Arch)
+		}
+		if disk.MountPoint != "" && disk.Filesystem == "" {
+			return nil, fmt.Errorf("disk %q needs a filesystem to be mounted", disk.Name)
+		}
+		disks[i] = disk
+	}
+
+	return disks, nil
+}
+
+// getSerial returns the serial number of the disk, used to identify it inside the VM
+func (disk Disk) getSerial() string {
+	// Virtio only keeps the first 20 characters of the serial number
+	serial := disk.Name
+	if len(serial) > 20 {
+		serial = serial[:20]
+	}
+	return serial
+}
+
+// guestDevice returns the stable path of the disk inside the VM
+func (disk Disk) guestDevice() string {
+	switch disk.Bus {
+	case "scsi":
+		return fmt.Sprintf("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_%s", disk.getSerial())
+	case "sata":
+		return fmt.Sprintf("/dev/disk/by-id/ata-QEMU_HARDDISK_%s", disk.getSerial())
+	default:
+		return fmt.Sprintf("/dev/disk/by-id/virtio-%s", disk.getSerial())
+	}
+}
+
+// getMounts returns the mount points of the machine, including the one
+// defined with the deprecated mount key
+func (machine *Machine) getMounts() []Mount {
+	var mounts []Mount
+	if machine.Mount.Name != "" {
+		mounts = append(mounts, machine.Mount)
+	}
+
+	for i, mount := range machine.Mounts {
+		// Name the mount points without a name after their position
+		if mount.Name == "" {
+			mount.Name = fmt.Sprintf("mount%d", i)
+		}
+		mounts = append(mounts, mount)
+	}
+
+	return mounts
+}
+
+// getNetworkSettings returns the network settings of the machine, where the
+// values set in the template override the ones from the configuration
+func (machine *Machine) getNetworkSettings() config.Network {
+	settings := config.DefaultNetwork()
+	if cfg != nil {
+		settings = mergeNetworkSettings(settings, cfg.Network)
+	}
+
+	return mergeNetworkSettings(settings, config.Network{
+		Mode:    machine.Network.Mode,
+		CIDR:    machine.Network.CIDR,
+		Gateway: machine.Network.Gateway,
+		Bridge:  machine.Network.Bridge,
+		DNS:     machine.Network.DNS,
+		Search:  machine.Network.Search,
+	})
+}
+
+// mergeNetworkSettings overrides the base network settings with the values set in override
+func mergeNetworkSettings(base, override config.Network) config.Network {
+	if override.Mode != "" {
+		base.Mode = override.Mode
+	}
+	if override.CIDR != "" {
+		base.CIDR = override.CIDR
+		// The gateway of the base settings belongs to another network
+		base.Gateway = ""
+	}
+	if override.Gateway != "" {
+		base.Gateway = override.Gateway
+	}
+	if override.Bridge != "" {
+		base.Bridge = override.Bridge
+	}
+	if len(override.DNS) > 0 {
+		base.DNS = override.DNS
+	}
+	if len(override.Search) > 0 {
+		base.Search = override.Search
+	}
+
+	return base
 }
 
 func (machine *Machine) GetVMs() []Machine {
@@ -565,23 +1120,34 @@ func (machine *Machine) createInstallScriptFile() error {
 // Create the machine startup script file
 func (machine *Machine) createStartupScriptFile() error {
 	// Boot script
-	var mountName string
+	var mountLines strings.Builder
+	for _, mount := range machine.getMounts() {
+		// The mount tag is the name with qemu and the guest path with libvirt
+		tag := mount.GuestPath
+		if cfg.Hypervisor == "qemu" {
+			tag = mount.Name
+		}
 
-	if cfg.Hypervisor == "qemu" {
-		mountName = machine.Mount.Name
-	} else {
-		mountName = machine.Mount.GuestPath
+		// Set the mount options
+		var options []string
+		if mount.ReadOnly {
+			options = append(options, "ro")
+		}
+		if mount.Options != "" {
+			options = append(options, mount.Options)
+		}
+		optionsArg := ""
+		if len(options) > 0 {
+			optionsArg = fmt.Sprintf(" -o %s", strings.Join(options, ","))
+		}
+
+		fmt.Fprintf(&mountLines, "sudo mkdir -p %s\n", shellQuote(mount.GuestPath))
+		fmt.Fprintf(&mountLines, "sudo mount -t 9p%s %s %s\n", optionsArg, shellQuote(tag), shellQuote(mount.GuestPath))
 	}
 	initScript := fmt.Sprintf(`#!/bin/bash
-HOST_PATH="%s"
-GUEST_PATH="%s"
-if [[ "$GUEST_PATH" != "" ]]; then
-	mkdir -p $GUEST_PATH
-	sudo mount -t 9p $HOST_PATH $GUEST_PATH
-fi
-
+%s
 exit 0
-`, mountName, machine.Mount.GuestPath)
+`, mountLines.String())
 
 	err := os.WriteFile(filepath.Join(machine.baseDir, machine.Name, "bin/machina"), []byte(initScript), 0744)
 	if err != nil {
@@ -594,3 +1160,8 @@ exit 0
 	}
 	return nil
 }
+
+// shellQuote quotes a value to be safely used as a shell argument
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -3,16 +3,20 @@ package hypvsr
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/imgutil"
 	"github.com/enkodr/machina/internal/osutil"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestMachine_CreateDir(t *testing.T) {
@@ -52,12 +56,12 @@ func TestMachine_Prepare(t *testing.T) {
 	}
 
 	// Mock configuration
-	cfg = &config.Config{
+	setTestConfig(t, &config.Config{
 		Directories: config.Directories{
 			Images:    filepath.Join(tempDir, "images"),
 			Instances: filepath.Join(tempDir, "instances"),
 		},
-	}
+	})
 
 	// Create the machine directory for testing
 	os.Mkdir(filepath.Join(tempDir, machine.Name), 0755)
@@ -75,6 +79,11 @@ func TestMachine_Prepare(t *testing.T) {
 	_, err = os.Stat(userdataPath)
 	assert.NoError(t, err, "User data file not found")
 
+	// Verify meta data file
+	metadataPath := filepath.Join(tempDir, machine.Name, config.GetFilename(config.MetadataFilename))
+	_, err = os.Stat(metadataPath)
+	assert.NoError(t, err, "Meta data file not found")
+
 	// Verify private key file
 	privateKeyPath := filepath.Join(tempDir, machine.Name, config.GetFilename(config.PrivateKeyFilename))
 	_, err = os.Stat(privateKeyPath)
@@ -106,11 +115,11 @@ func TestMachine_DownloadImage(t *testing.T) {
 	checksum := "sha256:" + hex.EncodeToString(hash[:])
 
 	// Mock configuration
-	cfg = &config.Config{
+	setTestConfig(t, &config.Config{
 		Directories: config.Directories{
 			Images: tempDir,
 		},
-	}
+	})
 
 	// Initialize a Machine machine for testing
 	machine := Machine{
@@ -121,17 +130,17 @@ func TestMachine_DownloadImage(t *testing.T) {
 	}
 
 	// Test case: Image is already downloaded
-	err := machine.DownloadImage()
+	err := machine.DownloadImage(nil)
 	assert.NoError(t, err, "Error downloading image")
 
 	// Test case: Image needs to be downloaded
 	machine.Image.URL = mockServer.URL + "/new-image.qcow2"
-	err = machine.DownloadImage()
+	err = machine.DownloadImage(nil)
 	assert.NoError(t, err, "Error downloading new image")
 
 	// Test case: Invalid image URL
 	machine.Image.URL = "invalid-url"
-	err = machine.DownloadImage()
+	err = machine.DownloadImage(nil)
 	assert.Error(t, err, "Invalid image URL")
 
 	// Close the mock server
@@ -157,6 +166,72 @@ func (m *MockRunner) RunCommand(command string, args []string, options ...osutil
 	return m.Output, m.Error
 }
 
+func TestMachine_DownloadImageChecksum(t *testing.T) {
+	content := []byte("mock image content")
+	hash := sha256.Sum256(content)
+	checksums := "0000000000000000000000000000000000000000000000000000000000000000  other.img\n" +
+		hex.EncodeToString(hash[:]) + "  image.qcow2\n"
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			fmt.Fprint(w, checksums)
+		case "/SHA256SUMS.gpg":
+			fmt.Fprint(w, "signature")
+		default:
+			w.Write(content)
+		}
+	}))
+	defer mockServer.Close()
+
+	setTestConfig(t, &config.Config{Directories: config.Directories{Images: t.TempDir()}})
+	localImage := filepath.Join(cfg.Directories.Images, "image.qcow2")
+	runner := &MockRunner{}
+	machine := Machine{
+		Runner: runner,
+		Image: Image{
+			URL:         mockServer.URL + "/image.qcow2",
+			ChecksumURL: mockServer.URL + "/SHA256SUMS",
+		},
+	}
+
+	// Test case: The checksum is read from the checksum file
+	err := machine.DownloadImage(nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, localImage)
+	metadata, err := imgutil.ReadMetadata(localImage)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(hash[:]), metadata.Checksum)
+	assert.False(t, runner.Called)
+
+	// Test case: The checksum file is verified with its detached signature
+	machine.Image.SignatureURL = mockServer.URL + "/SHA256SUMS.gpg"
+	err = machine.DownloadImage(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "gpg", runner.Command)
+	assert.Equal(t, []string{"--batch", "--verify"}, runner.Args[:2])
+	assert.Len(t, runner.Args, 4)
+
+	// Test case: A bad signature fails the download
+	runner.Error = errors.New("exit status 1")
+	err = machine.DownloadImage(nil)
+	assert.Error(t, err)
+	runner.Error = nil
+
+	// Test case: A keyring needs a signed checksum file
+	machine.Image.SignatureURL = ""
+	machine.Image.Keyring = mockServer.URL + "/keys.asc"
+	err = machine.DownloadImage(nil)
+	assert.Error(t, err)
+
+	// Test case: A downloaded image that does not match the checksum is removed
+	os.Remove(localImage)
+	machine.Image = Image{URL: mockServer.URL + "/image.qcow2", Checksum: "sha256:" + strings.Repeat("0", 64)}
+	err = machine.DownloadImage(nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, localImage)
+}
+
 func TestCreateMachineDisk(t *testing.T) {
 	// Create a temporary directory for testing
 	tmpDir := t.TempDir()
@@ -179,11 +254,11 @@ func TestCreateMachineDisk(t *testing.T) {
 		},
 	}
 
-	cfg = &config.Config{
+	setTestConfig(t, &config.Config{
 		Directories: config.Directories{
 			Images: tmpDir,
 		},
-	}
+	})
 
 	err := machine.createInstanceDisk()
 
@@ -223,9 +298,310 @@ func TestCreateSeedDisk(t *testing.T) {
 		"--network-config=network.cfg",
 		"seed.img",
 		"userdata.yaml",
+		"metadata.yaml",
 	}
 	assert.True(t, mockRunner.Called, "RunCommand should have been called")
 	assert.Equal(t, expectedCommand, mockRunner.Command, "Unexpected command")
 	assert.Equal(t, expectedArgs, mockRunner.Args, "Unexpected arguments")
 	assert.NoError(t, err, "Unexpected error")
 }
+
+func TestMachine_GetNetworkSettings(t *testing.T) {
+	// Test case 1: Defaults are used for older configurations without network
+	setTestConfig(t, &config.Config{})
+	machine := &Machine{}
+	assert.Equal(t, config.DefaultNetwork(), machine.getNetworkSettings())
+
+	// Test case 2: The configuration overrides the defaults
+	setTestConfig(t, &config.Config{
+		Network: config.Network{
+			Bridge: "br-lab",
+			DNS:    []string{"10.0.0.53"},
+		},
+	})
+	settings := machine.getNetworkSettings()
+	assert.Equal(t, "192.168.122.0/24", settings.CIDR)
+	assert.Equal(t, "192.168.122.1", settings.Gateway)
+	assert.Equal(t, "br-lab", settings.Bridge)
+	assert.Equal(t, []string{"10.0.0.53"}, settings.DNS)
+
+	// Test case 3: The template overrides the configuration and a new
+	// network does not inherit the gateway from another one
+	machine.Network = Network{
+		CIDR:   "10.10.0.0/16",
+		Search: []string{"lab.internal"},
+	}
+	settings = machine.getNetworkSettings()
+	assert.Equal(t, "10.10.0.0/16", settings.CIDR)
+	assert.Equal(t, "", settings.Gateway)
+	assert.Equal(t, "br-lab", settings.Bridge)
+	assert.Equal(t, []string{"10.0.0.53"}, settings.DNS)
+	assert.Equal(t, []string{"lab.internal"}, settings.Search)
+	assert.Equal(t, config.NetworkModeBridge, settings.Mode)
+
+	// Test case 4: The template overrides the networking mode
+	machine.Network.Mode = config.NetworkModeUser
+	assert.Equal(t, config.NetworkModeUser, machine.getNetworkSettings().Mode)
+}
+
+func TestMachine_CreateStartupScriptFile(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	machine := &Machine{
+		Name:    "test-machine",
+		baseDir: tmpDir,
+		Mount: Mount{
+			Name:      "legacy",
+			HostPath:  "/host/legacy",
+			GuestPath: "/guest/legacy",
+		},
+		Mounts: []Mount{
+			{
+				Name:      "src",
+				HostPath:  "/host/src",
+				GuestPath: "/guest/src",
+				ReadOnly:  true,
+				Options:   "trans=virtio",
+			},
+			{
+				HostPath:  "/host/data",
+				GuestPath: "/guest/data",
+			},
+		},
+	}
+	os.MkdirAll(filepath.Join(tmpDir, machine.Name, "bin"), 0755)
+
+	// Test case 1: The qemu hypervisor mounts using the name as tag
+	setTestConfig(t, &config.Config{Hypervisor: "qemu"})
+	err := machine.createStartupScriptFile()
+	assert.NoError(t, err)
+
+	script, err := os.ReadFile(filepath.Join(tmpDir, machine.Name, "bin/machina"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(script), "sudo mount -t 9p 'legacy' '/guest/legacy'\n")
+	assert.Contains(t, string(script), "sudo mkdir -p '/guest/src'\n")
+	assert.Contains(t, string(script), "sudo mount -t 9p -o ro,trans=virtio 'src' '/guest/src'\n")
+	assert.Contains(t, string(script), "sudo mount -t 9p 'mount1' '/guest/data'\n")
+
+	// Test case 2: The libvirt hypervisor mounts using the guest path as tag
+	setTestConfig(t, &config.Config{Hypervisor: "libvirt"})
+	err = machine.createStartupScriptFile()
+	assert.NoError(t, err)
+
+	script, err = os.ReadFile(filepath.Join(tmpDir, machine.Name, "bin/machina"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(script), "sudo mount -t 9p -o ro,trans=virtio '/guest/src' '/guest/src'\n")
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "'/path/to/dir'", shellQuote("/path/to/dir"))
+	assert.Equal(t, `'/it'\''s'`, shellQuote("/it's"))
+}
+
+func TestRemoteCommand(t *testing.T) {
+	// Test case: A single argument is run as a command line
+	assert.Equal(t, "ls -la | wc -l", remoteCommand([]string{"ls -la | wc -l"}))
+
+	// Test case: Several arguments are quoted
+	assert.Equal(t, "'touch' '/tmp/my file'", remoteCommand([]string{"touch", "/tmp/my file"}))
+}
+
+func TestMachine_Exec(t *testing.T) {
+	machine := &Machine{
+		Name:    "test-machine",
+		baseDir: t.TempDir(),
+	}
+
+	// Test case: No command is passed
+	code, err := machine.Exec(nil, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, -1, code)
+
+	// Test case: The machine has no private key
+	code, err = machine.Exec([]string{"true"}, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, -1, code)
+}
+
+func TestMachine_CreateNetworkFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	setTestConfig(t, &config.Config{
+		Directories: config.Directories{
+			Instances: filepath.Join(tempDir, "instances"),
+			Leases:    filepath.Join(tempDir, "leases"),
+		},
+	})
+
+	machine := Machine{
+		Name:    "test-machine",
+		baseDir: tempDir,
+		Network: Network{
+			Interfaces: []Interface{
+				{Bridge: "br-wan"},
+				{NicName: "lan", Network: "lab", IPAddress: "10.0.0.5/24"},
+			},
+		},
+	}
+	os.Mkdir(filepath.Join(tempDir, machine.Name), 0755)
+
+	// Test case 1: The interfaces are named and get a MAC address
+	err := machine.createNetworkFile()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, machine.Network.IPAddress)
+	assert.Equal(t, "virbr0", machine.Network.Bridge)
+	assert.Len(t, machine.Network.Interfaces, 2)
+	assert.Equal(t, "virtnet1", machine.Network.Interfaces[0].NicName)
+	assert.NotEmpty(t, machine.Network.Interfaces[0].MacAddress)
+	assert.Equal(t, "lan", machine.Network.Interfaces[1].NicName)
+	assert.NotEmpty(t, machine.Network.Interfaces[1].MacAddress)
+
+	// Test case 2: The interfaces are written to the network configuration
+	data, err := os.ReadFile(filepath.Join(tempDir, machine.Name, config.GetFilename(config.NetworkFilename)))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "set-name: virtnet1")
+	assert.Contains(t, string(data), "- 10.0.0.5/24")
+
+	// Test case 3: Interfaces need a bridge or a network
+	machine.Network = Network{Interfaces: []Interface{{NicName: "eth1"}}}
+	err = machine.createNetworkFile()
+	assert.Error(t, err)
+}
+
+func TestMachine_CreateNetworkFileUserMode(t *testing.T) {
+	tempDir := t.TempDir()
+
+	setTestConfig(t, &config.Config{
+		Directories: config.Directories{
+			Instances: filepath.Join(tempDir, "instances"),
+			Leases:    filepath.Join(tempDir, "leases"),
+		},
+	})
+
+	// Store an instance with forwarded ports
+	other := Machine{
+		Network: Network{SSHPort: 2222},
+		Ports:   []Port{{HostPort: 8080, GuestPort: 80}},
+	}
+	os.MkdirAll(filepath.Join(cfg.Directories.Instances, "other"), 0755)
+	data, _ := yaml.Marshal(other)
+	os.WriteFile(filepath.Join(cfg.Directories.Instances, "other", config.GetFilename(config.InstanceFilename)), data, 0644)
+	assert.ElementsMatch(t, []int{2222, 8080}, getInstancePorts())
+
+	machine := Machine{
+		Name:    "test-machine",
+		baseDir: tempDir,
+		Network: Network{Mode: config.NetworkModeUser},
+		Ports: []Port{
+			{GuestPort: 80},
+			{HostPort: 5353, GuestPort: 53, Protocol: "udp", HostAddress: "0.0.0.0"},
+		},
+	}
+	os.Mkdir(filepath.Join(tempDir, machine.Name), 0755)
+
+	// Test case 1: SSH and the ports without a host port get a free port
+	err := machine.createNetworkFile()
+	assert.NoError(t, err)
+	assert.Equal(t, config.NetworkModeUser, machine.Network.Mode)
+	assert.Empty(t, machine.Network.IPAddress)
+	assert.NotZero(t, machine.Network.SSHPort)
+	assert.NotEqual(t, 2222, machine.Network.SSHPort)
+	assert.Equal(t, Port{HostPort: machine.Ports[0].HostPort, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}, machine.Ports[0])
+	assert.NotZero(t, machine.Ports[0].HostPort)
+	assert.NotEqual(t, machine.Network.SSHPort, machine.Ports[0].HostPort)
+	assert.Equal(t, Port{HostPort: 5353, GuestPort: 53, Protocol: "udp", HostAddress: "0.0.0.0"}, machine.Ports[1])
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", machine.Network.SSHPort), machine.sshAddress())
+
+	// Test case 2: The primary interface uses DHCP and no address is leased
+	data, err = os.ReadFile(filepath.Join(tempDir, machine.Name, config.GetFilename(config.NetworkFilename)))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "dhcp4: true")
+	assert.NoDirExists(t, filepath.Join(tempDir, "leases"))
+
+	// Test case 3: Invalid ports and modes are rejected
+	machine.Ports = []Port{{GuestPort: 80, Protocol: "sctp"}}
+	assert.Error(t, machine.createNetworkFile())
+	machine.Ports = []Port{{}}
+	assert.Error(t, machine.createNetworkFile())
+	machine.Ports = nil
+	machine.Network.Mode = "host"
+	assert.Error(t, machine.createNetworkFile())
+}
+
+func TestMachine_SSHAddress(t *testing.T) {
+	machine := Machine{Network: Network{IPAddress: "192.168.122.10"}}
+	assert.Equal(t, "192.168.122.10", machine.sshAddress())
+}
+
+func TestMachine_GetDisks(t *testing.T) {
+	// Test case 1: The default values are set
+	machine := &Machine{
+		Disks: []Disk{
+			{Size: "10g"},
+			{Name: "db", Size: "20G", Format: "raw", Bus: "scsi", Filesystem: "xfs", MountPoint: "/var/lib/db"},
+		},
+	}
+	disks, err := machine.getDisks()
+	assert.NoError(t, err)
+	assert.Equal(t, []Disk{
+		{Name: "data0", Size: "10G", Format: "qcow2", Bus: "virtio"},
+		{Name: "db", Size: "20G", Format: "raw", Bus: "scsi", Filesystem: "xfs", MountPoint: "/var/lib/db"},
+	}, disks)
+	assert.Equal(t, "/dev/disk/by-id/virtio-data0", disks[0].guestDevice())
+	assert.Equal(t, "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_db", disks[1].guestDevice())
+
+	// Test case 2: Invalid disks
+	invalid := [][]Disk{
+		{{Name: "a", Size: "1G"}, {Name: "a", Size: "1G"}},
+		{{Name: "a"}},
+		{{Name: "a", Size: "1G", Format: "vmdk"}},
+		{{Name: "a", Size: "1G", Bus: "ide"}},
+		{{Name: "a", Size: "1G", MountPoint: "/data"}},
+	}
+	for _, d := range invalid {
+		machine.Disks = d
+		_, err := machine.getDisks()
+		assert.Error(t, err)
+	}
+}
+
+func TestCreateDataDisks(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	machine := &Machine{
+		Name:    "test-machine",
+		Runner:  &MockRunner{},
+		baseDir: tmpDir,
+		Disks: []Disk{
+			{Name: "db", Size: "20G", Format: "raw"},
+		},
+	}
+
+	err := machine.createDataDisks()
+
+	// Verify the RunCommand call to create the data disk
+	mockRunner := machine.Runner.(*MockRunner)
+	expectedArgs := []string{
+		"create",
+		"-f", "raw",
+		filepath.Join(tmpDir, "test-machine", "disk-db.img"),
+		"20G",
+	}
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "qemu-img", mockRunner.Command, "Unexpected command")
+	assert.Equal(t, expectedArgs, mockRunner.Args, "Unexpected arguments")
+}
+
+func TestMachine_Resume(t *testing.T) {
+	// Test case: A paused machine is resumed
+	hypervisor := &MockHypervisor{State: "paused"}
+	machine := &Machine{Hypervisor: hypervisor}
+	assert.NoError(t, machine.Resume())
+	assert.Equal(t, []string{"Status", "Resume"}, hypervisor.Calls)
+
+	// Test case: A suspended machine is restored from its saved state
+	hypervisor = &MockHypervisor{State: "saved"}
+	machine.Hypervisor = hypervisor
+	assert.NoError(t, machine.Resume())
+	assert.Equal(t, []string{"Status", "Start"}, hypervisor.Calls)
+}
@@ -0,0 +1,202 @@
+package hypvsr
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/netutil"
+)
+
+// ParsePort parses a port in the [hostAddress:][hostPort:]guestPort[/protocol]
+// format, e.g. 8080:80 or 127.0.0.1:5353:53/udp
+func ParsePort(spec string) (Port, error) {
+	port := Port{}
+
+	// Split the protocol
+	address, protocol, found := strings.Cut(spec, "/")
+	if found {
+		port.Protocol = protocol
+	}
+
+	// Split the host address and ports
+	parts := strings.Split(address, ":")
+	if len(parts) > 3 {
+		return Port{}, fmt.Errorf("invalid port %q", spec)
+	}
+	if len(parts) == 3 {
+		port.HostAddress = parts[0]
+		parts = parts[1:]
+	}
+
+	var err error
+	port.GuestPort, err = strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return Port{}, fmt.Errorf("invalid port %q", spec)
+	}
+	if len(parts) == 2 {
+		port.HostPort, err = strconv.Atoi(parts[0])
+		if err != nil {
+			return Port{}, fmt.Errorf("invalid port %q", spec)
+		}
+	}
+
+	return normalizePort(port)
+}
+
+// String returns the port in the format accepted by ParsePort
+func (port Port) String() string {
+	return fmt.Sprintf("%s:%d:%d/%s", port.HostAddress, port.HostPort, port.GuestPort, port.Protocol)
+}
+
+// normalizePort validates the port and sets the default protocol and host address
+func normalizePort(port Port) (Port, error) {
+	if port.GuestPort <= 0 || port.GuestPort > 65535 {
+		return Port{}, fmt.Errorf("invalid guest port %d", port.GuestPort)
+	}
+	if port.HostPort < 0 || port.HostPort > 65535 {
+		return Port{}, fmt.Errorf("invalid host port %d", port.HostPort)
+	}
+	if port.Protocol == "" {
+		port.Protocol = "tcp"
+	}
+	if port.Protocol != "tcp" && port.Protocol != "udp" {
+		return Port{}, fmt.Errorf("invalid protocol %q of port %d", port.Protocol, port.GuestPort)
+	}
+	if port.HostAddress == "" {
+		port.HostAddress = localhost
+	}
+
+	return port, nil
+}
+
+// checkPort validates the port and checks that the machine can forward its
+// protocol. Only the user-mode network forwards udp ports, as the ports are
+// otherwise forwarded through SSH.
+func (machine *Machine) checkPort(port Port) (Port, error) {
+	port, err := normalizePort(port)
+	if err != nil {
+		return Port{}, err
+	}
+	if !isTunnelled(port) && machine.getNetworkSettings().Mode != config.NetworkModeUser {
+		return Port{}, fmt.Errorf("port %s: %w", port, ErrPortNotTunnelled)
+	}
+	return port, nil
+}
+
+// assignPorts assigns a free host port to the forwarded ports without one and,
+// in user mode, to SSH, skipping the ports assigned to the other machines
+func (machine *Machine) assignPorts(settings config.Network) error {
+	used := append(getInstancePorts(), machine.hostPorts()...)
+
+	var err error
+	if settings.Mode == config.NetworkModeUser && machine.Network.SSHPort == 0 {
+		machine.Network.SSHPort, err = netutil.FreePort("tcp", localhost, used)
+		if err != nil {
+			return err
+		}
+		used = append(used, machine.Network.SSHPort)
+	}
+
+	for i, port := range machine.Ports {
+		port, err = machine.checkPort(port)
+		if err != nil {
+			return err
+		}
+		if port.HostPort == 0 {
+			port.HostPort, err = netutil.FreePort(port.Protocol, port.HostAddress, used)
+			if err != nil {
+				return err
+			}
+			used = append(used, port.HostPort)
+		}
+		machine.Ports[i] = port
+	}
+
+	return nil
+}
+
+// AddPort forwards a port of the machine from the host, assigning a free host
+// port when none is set, and applies it to the machine when it is running
+func (machine *Machine) AddPort(port Port) (Port, error) {
+	port, err := machine.checkPort(port)
+	if err != nil {
+		return Port{}, err
+	}
+
+	// Check that the host port is not used by any machine
+	used := getInstancePorts()
+	if port.HostPort == 0 {
+		port.HostPort, err = netutil.FreePort(port.Protocol, port.HostAddress, used)
+		if err != nil {
+			return Port{}, err
+		}
+	} else if slices.Contains(used, port.HostPort) || slices.Contains(machine.hostPorts(), port.HostPort) {
+		return Port{}, fmt.Errorf("host port %d is already forwarded", port.HostPort)
+	} else if err = netutil.CheckPort(port.Protocol, port.HostAddress, port.HostPort); err != nil {
+		return Port{}, fmt.Errorf("host port %d is not available: %w", port.HostPort, err)
+	}
+
+	machine.Ports = append(machine.Ports, port)
+	err = machine.save()
+	if err != nil {
+		return Port{}, err
+	}
+
+	// Apply the port to the running machine, removing it when it fails
+	status, err := machine.Status()
+	if err == nil && status != "shut off" && status != "saved" {
+		err = machine.Hypervisor.AddPort(machine, port)
+	}
+	if err != nil {
+		machine.Ports = machine.Ports[:len(machine.Ports)-1]
+		machine.save()
+		return Port{}, err
+	}
+
+	return port, nil
+}
+
+// RemovePort stops forwarding the host port of the protocol to the machine
+func (machine *Machine) RemovePort(hostPort int, protocol string) error {
+	i := slices.IndexFunc(machine.Ports, func(port Port) bool {
+		return port.HostPort == hostPort && port.Protocol == protocol
+	})
+	if i < 0 {
+		return fmt.Errorf("host port %d/%s is not forwarded", hostPort, protocol)
+	}
+
+	port := machine.Ports[i]
+	machine.Ports = slices.Delete(machine.Ports, i, i+1)
+	err := machine.save()
+	if err != nil {
+		return err
+	}
+
+	// Remove the port from the running machine, keeping it when it fails
+	status, err := machine.Status()
+	if err == nil && status != "shut off" && status != "saved" {
+		err = machine.Hypervisor.RemovePort(machine, port)
+	}
+	if err != nil {
+		machine.Ports = slices.Insert(machine.Ports, i, port)
+		machine.save()
+		return err
+	}
+
+	return nil
+}
+
+// hostPorts returns the host ports forwarded to the machine
+func (machine *Machine) hostPorts() []int {
+	ports := []int{}
+	if machine.Network.SSHPort != 0 {
+		ports = append(ports, machine.Network.SSHPort)
+	}
+	for _, port := range machine.Ports {
+		ports = append(ports, port.HostPort)
+	}
+	return ports
+}
@@ -0,0 +1,133 @@
+package hypvsr
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/netutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParsePort(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		expected Port
+	}{
+		{spec: "80", expected: Port{GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}},
+		{spec: "8080:80", expected: Port{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}},
+		{spec: "0.0.0.0:5353:53/udp", expected: Port{HostPort: 5353, GuestPort: 53, Protocol: "udp", HostAddress: "0.0.0.0"}},
+	}
+	for _, tc := range testCases {
+		port, err := ParsePort(tc.spec)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, port)
+	}
+
+	// Test case: Invalid ports
+	for _, spec := range []string{"", "http", "8080:http", "a:b:8080:80", "70000", "80/sctp"} {
+		_, err := ParsePort(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// loadPorts returns the ports stored in the instance file of the machine
+func loadPorts(t *testing.T, machine *Machine) []Port {
+	data, err := os.ReadFile(filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.InstanceFilename)))
+	assert.NoError(t, err)
+	stored := &Machine{}
+	assert.NoError(t, yaml.Unmarshal(data, stored))
+	return stored.Ports
+}
+
+func TestMachine_AddPort(t *testing.T) {
+	machine := newTestMachine(t, "running")
+	machine.Ports = []Port{{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}}
+	assert.NoError(t, machine.save())
+	hypervisor := machine.Hypervisor.(*MockHypervisor)
+
+	// Test case 1: A free host port is assigned and the port is applied to the running machine
+	port, err := machine.AddPort(Port{GuestPort: 443})
+	assert.NoError(t, err)
+	assert.NotZero(t, port.HostPort)
+	assert.Equal(t, "tcp", port.Protocol)
+	assert.Equal(t, []Port{machine.Ports[0], port}, loadPorts(t, machine))
+	assert.Contains(t, hypervisor.Calls, "AddPort")
+
+	// Test case 2: The host port is already forwarded
+	_, err = machine.AddPort(Port{HostPort: 8080, GuestPort: 8000})
+	assert.Error(t, err)
+	assert.Len(t, loadPorts(t, machine), 2)
+
+	// Test case 3: The port is only stored when the machine is shut off
+	machine = newTestMachine(t, "shut off")
+	machine.Ports = []Port{{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}}
+	assert.NoError(t, machine.save())
+	hypervisor = machine.Hypervisor.(*MockHypervisor)
+	hostPort, err := netutil.FreePort("tcp", "127.0.0.1", nil)
+	assert.NoError(t, err)
+	_, err = machine.AddPort(Port{HostPort: hostPort, GuestPort: 90})
+	assert.NoError(t, err)
+	assert.Len(t, loadPorts(t, machine), 2)
+	assert.NotContains(t, hypervisor.Calls, "AddPort")
+
+	// Test case 4: The udp ports are only forwarded by the user-mode network
+	hostPort, err = netutil.FreePort("udp", "127.0.0.1", nil)
+	assert.NoError(t, err)
+	_, err = machine.AddPort(Port{HostPort: hostPort, GuestPort: 53, Protocol: "udp"})
+	assert.ErrorIs(t, err, ErrPortNotTunnelled)
+	assert.Len(t, loadPorts(t, machine), 2)
+	machine.Network.Mode = config.NetworkModeUser
+	_, err = machine.AddPort(Port{HostPort: hostPort, GuestPort: 53, Protocol: "udp"})
+	assert.NoError(t, err)
+	assert.Len(t, loadPorts(t, machine), 3)
+
+	// Test case 5: The host port is held by another process
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	_, err = machine.AddPort(Port{HostPort: listener.Addr().(*net.TCPAddr).Port, GuestPort: 8000})
+	assert.Error(t, err)
+	assert.Len(t, loadPorts(t, machine), 3)
+}
+
+func TestMachine_AssignPorts(t *testing.T) {
+	machine := newTestMachine(t, "shut off")
+	machine.Ports = []Port{{GuestPort: 53, Protocol: "udp"}}
+
+	// Test case 1: The udp ports are rejected outside the user-mode network
+	assert.ErrorIs(t, machine.assignPorts(machine.getNetworkSettings()), ErrPortNotTunnelled)
+
+	// Test case 2: The udp ports are assigned in the user-mode network
+	machine.Network.Mode = config.NetworkModeUser
+	assert.NoError(t, machine.assignPorts(machine.getNetworkSettings()))
+	assert.NotZero(t, machine.Ports[0].HostPort)
+}
+
+func TestMachine_RemovePort(t *testing.T) {
+	machine := newTestMachine(t, "running")
+	machine.Ports = []Port{{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}}
+	assert.NoError(t, machine.save())
+	hypervisor := machine.Hypervisor.(*MockHypervisor)
+
+	// Test case 1: The port is not forwarded
+	assert.Error(t, machine.RemovePort(8080, "udp"))
+	assert.Error(t, machine.RemovePort(9090, "tcp"))
+
+	// Test case 2: The port is removed from the instance file and the running machine
+	assert.NoError(t, machine.RemovePort(8080, "tcp"))
+	assert.Empty(t, loadPorts(t, machine))
+	assert.Contains(t, hypervisor.Calls, "RemovePort")
+
+	// Test case: The port is kept when the running machine can't remove it
+	machine.Network.Mode = config.NetworkModeUser
+	port, err := machine.AddPort(Port{GuestPort: 53, Protocol: "udp"})
+	assert.NoError(t, err)
+	hypervisor.Errors = map[string]error{"RemovePort": ErrPortNotLive}
+	assert.ErrorIs(t, machine.RemovePort(port.HostPort, "udp"), ErrPortNotLive)
+	assert.Equal(t, []Port{port}, machine.Ports)
+	assert.Equal(t, []Port{port}, loadPorts(t, machine))
+}
@@ -1,105 +1,518 @@
 package hypvsr
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/qmputil"
+	"github.com/enkodr/machina/internal/sshutil"
 )
 
 type Qemu struct{}
 
+var (
+	// The time to wait for a machine to restore its saved state
+	qemuRestoreTimeout = 5 * time.Minute
+	// The interval between the checks of the state being saved or restored
+	qemuRestoreInterval = 500 * time.Millisecond
+)
+
 func (h *Qemu) Create(vm *Machine) error {
+	// The qemu hypervisor only runs machines in the local host
+	if c, err := parseConnection(vm.Connection); err == nil && c.isRemote() {
+		return fmt.Errorf("the qemu hypervisor can't run machines in remote hosts, use libvirt for connection %q", vm.Connection)
+	}
+
 	return h.Start(vm)
 }
 
 func (h *Qemu) Start(vm *Machine) error {
-	command := "qemu-system-x86_64"
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		return err
 	}
 	dir := filepath.Join(cfg.Directories.Instances, vm.Name)
-	args := []string{
-		"-machine", fmt.Sprintf("accel=%s,type=q35", getHypervisor()),
-		"-cpu", "host",
-		"-smp", vm.Resources.CPUs,
-		"-m", vm.Resources.Memory,
-		"-nographic",
-		"-netdev", fmt.Sprintf("bridge,id=%s,br=virbr0", vm.Network.NicName),
+
+	// Run the machine with the binary and board of its architecture,
+	// emulating the CPU when the host can't accelerate it
+	arch, err := vm.getArch()
+	if err != nil {
+		return err
+	}
+	spec, err := vm.getArchSpec()
+	if err != nil {
+		return err
+	}
+	accel := qemuAccel(arch)
+	cpu := "host"
+	if accel == "tcg" {
+		cpu = "max"
+	}
+	command := spec.Binary
+
+	// Secure Boot needs the firmware to run in system management mode
+	firmware, err := vm.getFirmware()
+	if err != nil {
+		return err
+	}
+	machineType := fmt.Sprintf("accel=%s,type=%s", accel, spec.MachineType)
+	if firmware == FirmwareUEFISecure {
+		machineType += ",smm=on"
+	}
+
+	// Lay out the CPUs and memory of the machine
+	resources, memoryBackend, err := qemuResources(vm, cpu)
+	if err != nil {
+		return err
+	}
+	if memoryBackend != "" {
+		machineType += ",memory-backend=" + memoryBackend
+	}
+
+	args := append(resources,
+		"-machine", machineType,
+		"-display", "none",
+		"-netdev", qemuNetdev(vm),
 		"-device", fmt.Sprintf("virtio-net-pci,netdev=%s,id=virtnet0,mac=%s", vm.Network.NicName, vm.Network.MacAddress),
 		"-pidfile", fmt.Sprintf("%s/vm.pid", dir),
+		"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", filepath.Join(dir, config.GetFilename(config.QMPSocketFilename))),
+		// Serve the serial console on a socket, keeping its output in the console log
+		"-chardev", fmt.Sprintf("socket,id=console0,path=%s,server=on,wait=off,logfile=%s,logappend=on", filepath.Join(dir, config.GetFilename(config.ConsoleSocketFilename)), filepath.Join(dir, config.GetFilename(config.ConsoleLogFilename))),
+		"-serial", "chardev:console0",
 		"-drive", fmt.Sprintf("if=virtio,format=qcow2,file=%s/disk.img", dir),
 		"-drive", fmt.Sprintf("if=virtio,format=raw,file=%s/seed.img", dir),
+	)
+
+	// Boot with UEFI from the OVMF build of the host and the NVRAM of the machine
+	if firmware != FirmwareBIOS {
+		ovmf, err := findOVMF(arch, firmware)
+		if err != nil {
+			return err
+		}
+		args = append(args,
+			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,readonly=on,file=%s", ovmf.Code),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", filepath.Join(dir, config.GetFilename(config.NVRAMFilename))),
+		)
+	}
+	if firmware == FirmwareUEFISecure {
+		args = append(args, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+
+	// Attach the software TPM, started along with the machine
+	if vm.Resources.TPM {
+		args = append(args,
+			"-chardev", fmt.Sprintf("socket,id=chrtpm,path=%s", filepath.Join(dir, config.GetFilename(config.TPMSocketFilename))),
+			"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+			"-device", fmt.Sprintf("%s,tpmdev=tpm0", spec.TPMDevice),
+		)
 	}
 
-	var mountCommand []string
-	if vm.Mount.Name != "" {
-		mountCommand = []string{
-			"-fsdev",
-			fmt.Sprintf("local,security_model=passthrough,id=fsdev%d,path=%s", 0, vm.Mount.HostPath),
-			"--device",
-			fmt.Sprintf("virtio-9p-pci,id=fs%d,fsdev=fsdev%d,mount_tag=%s", 0, 0, vm.Mount.Name),
+	// Attach the data disks
+	disks, err := vm.getDisks()
+	if err != nil {
+		return err
+	}
+	scsi := false
+	sata := 0
+	for i, disk := range disks {
+		drive := fmt.Sprintf("format=%s,file=%s,serial=%s", disk.Format, vm.getDataDiskPath(disk), disk.getSerial())
+		switch disk.Bus {
+		case "scsi":
+			// Add the SCSI controller once
+			if !scsi {
+				args = append(args, "-device", "virtio-scsi-pci,id=scsi0")
+				scsi = true
+			}
+			args = append(args,
+				"-drive", fmt.Sprintf("if=none,id=data%d,%s", i, drive),
+				"-device", fmt.Sprintf("scsi-hd,drive=data%d,bus=scsi0.0", i),
+			)
+		case "sata":
+			// Use the next free port of the q35 AHCI controller
+			args = append(args,
+				"-drive", fmt.Sprintf("if=none,id=data%d,%s", i, drive),
+				"-device", fmt.Sprintf("ide-hd,drive=data%d,bus=ide.%d", i, sata),
+			)
+			sata++
+		default:
+			args = append(args, "-drive", fmt.Sprintf("if=virtio,%s", drive))
+		}
+	}
+
+	// Add a network device for each additional interface
+	for i, iface := range vm.Network.Interfaces {
+		if iface.Bridge == "" {
+			return fmt.Errorf("interface %q must be attached to a bridge with the qemu hypervisor", iface.NicName)
 		}
+		args = append(args,
+			"-netdev", fmt.Sprintf("bridge,id=%s,br=%s", iface.NicName, iface.Bridge),
+			"-device", fmt.Sprintf("virtio-net-pci,netdev=%s,id=virtnet%d,mac=%s", iface.NicName, i+1, iface.MacAddress),
+		)
+	}
+
+	// Add a filesystem device for each mount point
+	for i, mount := range vm.getMounts() {
+		fsdev := fmt.Sprintf("local,security_model=passthrough,id=fsdev%d,path=%s", i, mount.HostPath)
+		if mount.ReadOnly {
+			fsdev += ",readonly=on"
+		}
+		args = append(args,
+			"-fsdev", fsdev,
+			"--device", fmt.Sprintf("virtio-9p-pci,id=fs%d,fsdev=fsdev%d,mount_tag=%s", i, i, mount.Name),
+		)
+	}
+
+	// Restore the state saved when the machine was suspended, which QEMU
+	// loads before resuming the machine
+	saved := filepath.Join(dir, config.GetFilename(config.SavedStateFilename))
+	if fileExists(saved) {
+		args = append(args, "-incoming", "exec:cat "+shellQuote(saved))
+	}
+
+	// Remove the files left by a previous run that did not exit cleanly
+	status, err := h.Status(vm)
+	if err != nil {
+		return err
 	}
-	args = append(args, mountCommand...)
+	if status != "shut off" && status != "saved" {
+		return errors.New("the machine is already running")
+	}
+	h.cleanup(vm)
+
+	if vm.Resources.TPM {
+		err = startTPM(vm)
+		if err != nil {
+			return err
+		}
+	}
+
 	cmd := exec.Command(command, args...)
 	err = cmd.Start()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Remove the saved state once the machine runs from it
+	if status == "saved" {
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		err = h.waitRestored(vm, exited)
+		if err != nil {
+			return err
+		}
+		os.Remove(saved)
+	}
+
+	// The ports are forwarded by QEMU in user mode
+	if vm.getNetworkSettings().Mode == config.NetworkModeUser {
+		return nil
+	}
+	return startForwarder(vm)
+}
+
+// qemuResources returns the arguments with the CPUs, memory and NUMA nodes of
+// the machine, along with the memory backend of the board when the memory is
+// not split in NUMA nodes
+func qemuResources(vm *Machine, cpu string) ([]string, string, error) {
+	topology, err := vm.getCPUTopology()
+	if err != nil {
+		return nil, "", err
+	}
+	smp := vm.Resources.CPUs
+	if topology.Sockets > 0 {
+		smp = fmt.Sprintf("%d,sockets=%d,cores=%d,threads=%d", topology.CPUs, topology.Sockets, topology.Cores, topology.Threads)
+	}
+
+	// Use the CPU model of the machine, toggling nested virtualization
+	if vm.Resources.CPU.Model != "" {
+		cpu = vm.Resources.CPU.Model
+	}
+	feature, err := vm.getNestedFeature()
+	if err != nil {
+		return nil, "", err
+	}
+	if feature != "" {
+		state := "off"
+		if *vm.Resources.CPU.Nested {
+			state = "on"
+		}
+		cpu += fmt.Sprintf(",%s=%s", feature, state)
+	}
+
+	args := []string{
+		"-cpu", cpu,
+		"-smp", smp,
+		"-m", vm.Resources.Memory,
+	}
+
+	// Back the memory with huge pages, in a single backend or one per NUMA node
+	cells, err := vm.getNUMACells(topology.CPUs)
+	if err != nil {
+		return nil, "", err
+	}
+	backend := "memory-backend-ram,id=%s,size=%s"
+	if vm.Resources.HugePages {
+		backend = "memory-backend-file,id=%s,size=%s,mem-path=/dev/hugepages,share=on,prealloc=on"
+	}
+	memoryBackend := ""
+	switch {
+	case len(cells) > 0:
+		for i, cell := range cells {
+			node := fmt.Sprintf("node,nodeid=%d", i)
+			for _, cpus := range cell.CPUs {
+				node += ",cpus=" + cpus
+			}
+			args = append(args,
+				"-object", fmt.Sprintf(backend, fmt.Sprintf("mem%d", i), fmt.Sprintf("%dM", cell.Memory)),
+				"-numa", fmt.Sprintf("%s,memdev=mem%d", node, i),
+			)
+		}
+	case vm.Resources.HugePages:
+		memoryBackend = "mem0"
+		args = append(args, "-object", fmt.Sprintf(backend, memoryBackend, vm.Resources.Memory))
+	}
+
+	// Attach the memory balloon, which QEMU does not add by default
+	if vm.Resources.Balloon != nil && *vm.Resources.Balloon {
+		args = append(args, "-device", "virtio-balloon-pci,id=balloon0")
+	}
+
+	return args, memoryBackend, nil
 }
 
+// Stop requests the guest to power down through QMP
 func (h *Qemu) Stop(vm *Machine) error {
-	cfg, err := config.LoadConfig()
+	err := stopForwarder(vm)
 	if err != nil {
 		return err
 	}
-	command := "ssh"
-	args := []string{
-		"-o StrictHostKeyChecking=no",
-		"-i", filepath.Join(cfg.Directories.Instances, vm.Name, config.GetFilename(config.PrivateKeyFilename)),
-		fmt.Sprintf("%s@%s", vm.Credentials.Username, vm.Network.IPAddress),
-		"sudo", "shutdown", "now",
+
+	qmp, err := h.dialQMP(vm)
+	if errors.Is(err, os.ErrNotExist) {
+		// Machines started without a QMP socket are shut down over SSH,
+		// which closes the connection without an exit status
+		_, err := vm.Exec([]string{"sudo shutdown now"}, nil, nil)
+		if err != nil && !errors.Is(err, sshutil.ErrNoExitStatus) {
+			return err
+		}
+		return nil
 	}
-	cmd := exec.Command(command, args...)
-	err = cmd.Run()
 	if err != nil {
 		return err
 	}
+	defer qmp.Close()
 
-	return nil
+	return qmp.SystemPowerdown()
 }
 
+// ForceStop exits QEMU immediately through QMP, killing the process when QMP is not available
 func (h *Qemu) ForceStop(vm *Machine) error {
-	command := "kill"
-	args := []string{
-		"-9",
-		h.getPID(vm),
+	err := stopForwarder(vm)
+	if err != nil {
+		return err
 	}
-	cmd := exec.Command(command, args...)
-	err := cmd.Run()
+
+	qmp, err := h.dialQMP(vm)
+	if err == nil {
+		defer qmp.Close()
+		return qmp.Quit()
+	}
+
+	pid, err := h.getPID(vm)
+	if err != nil {
+		return err
+	}
+	err = syscall.Kill(pid, syscall.SIGKILL)
 	if err != nil {
 		return err
 	}
+	h.cleanup(vm)
 
 	return nil
 }
 
+// Restart resets the machine through QMP
+func (h *Qemu) Restart(vm *Machine) error {
+	qmp, err := h.dialQMP(vm)
+	if errors.Is(err, os.ErrNotExist) {
+		// Machines started without a QMP socket are rebooted over SSH,
+		// which closes the connection without an exit status
+		_, err := vm.Exec([]string{"sudo reboot"}, nil, nil)
+		if err != nil && !errors.Is(err, sshutil.ErrNoExitStatus) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	return qmp.SystemReset()
+}
+
+// Save saves the state of the running machine to a file in its directory,
+// migrating it through QMP, and exits QEMU. The next start restores it.
+func (h *Qemu) Save(vm *Machine) error {
+	qmp, err := h.dialQMP(vm)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	// Pause the machine so its state does not change while it is saved
+	err = qmp.Stop()
+	if err != nil {
+		return err
+	}
+	err = stopForwarder(vm)
+	if err != nil {
+		qmp.Cont()
+		return err
+	}
+	saved := filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.SavedStateFilename))
+	err = qmp.Migrate("exec:cat > " + shellQuote(saved))
+	if err == nil {
+		err = waitMigration(qmp)
+	}
+	if err != nil {
+		// Leave the machine running as it was
+		os.Remove(saved)
+		qmp.Cont()
+		if vm.getNetworkSettings().Mode != config.NetworkModeUser {
+			startForwarder(vm)
+		}
+		return fmt.Errorf("saving the machine state: %w", err)
+	}
+
+	return qmp.Quit()
+}
+
+// waitMigration waits until the outgoing migration completes
+func waitMigration(qmp *qmputil.Client) error {
+	for {
+		status, err := qmp.QueryMigrate()
+		if err != nil {
+			return err
+		}
+		switch status.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("migration %s: %s", status.Status, status.ErrorDesc)
+		}
+		time.Sleep(qemuRestoreInterval)
+	}
+}
+
+// waitRestored waits until the machine started from a saved state runs, or
+// until QEMU exits. The state is saved paused, so the CPUs are started once
+// QEMU has loaded it.
+func (h *Qemu) waitRestored(vm *Machine, exited <-chan error) error {
+	timeout := time.After(qemuRestoreTimeout)
+	ticker := time.NewTicker(qemuRestoreInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return errors.New("the machine exited while restoring its saved state, see its console log")
+		case <-timeout:
+			return errors.New("timeout waiting for the machine to restore its saved state")
+		case <-ticker.C:
+			// The QMP socket is created once QEMU starts
+			qmp, err := h.dialQMP(vm)
+			if err != nil {
+				continue
+			}
+			status, err := qmp.QueryStatus()
+			if err == nil && !status.Running && (status.Status == "paused" || status.Status == "postmigrate") {
+				err = qmp.Cont()
+				if err != nil {
+					qmp.Close()
+					return fmt.Errorf("resuming the restored machine: %w", err)
+				}
+				status.Running = true
+			}
+			qmp.Close()
+			if err == nil && status.Running {
+				return nil
+			}
+		}
+	}
+}
+
+// Pause pauses the CPUs of the running machine through QMP
+func (h *Qemu) Pause(vm *Machine) error {
+	qmp, err := h.dialQMP(vm)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	return qmp.Stop()
+}
+
+// Resume resumes the CPUs of the paused machine through QMP
+func (h *Qemu) Resume(vm *Machine) error {
+	qmp, err := h.dialQMP(vm)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	return qmp.Cont()
+}
+
+// Status gets the run state of the machine through QMP.
+// A PID file left by a QEMU process that is no longer running is removed.
 func (h *Qemu) Status(vm *Machine) (string, error) {
-	cfg, err := config.LoadConfig()
+	pid, err := h.getPID(vm)
+	if err != nil {
+		return h.stoppedStatus(vm), nil
+	}
+
+	// The process is gone or the PID was reused by another process
+	// that is not listening on the QMP socket
+	qmp, err := h.dialQMP(vm)
+	if !processExists(pid) || errors.Is(err, syscall.ECONNREFUSED) {
+		h.cleanup(vm)
+		return h.stoppedStatus(vm), nil
+	}
+
+	// Machines started without a QMP socket are running while the process exists
+	if errors.Is(err, os.ErrNotExist) {
+		return "running", nil
+	}
 	if err != nil {
 		return "", err
 	}
-	if _, err := os.Stat(filepath.Join(cfg.Directories.Instances, vm.Name, config.GetFilename(config.PIDFilename))); os.IsNotExist(err) {
-		return "shut off", nil
+	defer qmp.Close()
+
+	status, err := qmp.QueryStatus()
+	if err != nil {
+		return "", err
+	}
+
+	return qmpStatusName(status.Status), nil
+}
+
+// stoppedStatus returns the status of the machine when QEMU is not running,
+// saved when the state of the machine was saved to be restored
+func (h *Qemu) stoppedStatus(vm *Machine) string {
+	if fileExists(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.SavedStateFilename))) {
+		return "saved"
 	}
-	return "running", nil
+	return "shut off"
 }
 
 func (h *Qemu) Delete(vm *Machine) error {
@@ -108,23 +521,157 @@ func (h *Qemu) Delete(vm *Machine) error {
 		return err
 	}
 
+	err = stopForwarder(vm)
+	if err != nil {
+		return err
+	}
+
+	// Stop the machine so that its disks are not in use when removed
 	status, _ := h.Status(vm)
-	if status == "running" {
-		h.Stop(vm)
+	if status != "shut off" && status != "saved" {
+		err = h.ForceStop(vm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(filepath.Join(cfg.Directories.Instances, vm.Name))
+}
+
+// AddPort forwards a port to the running machine, through QEMU in user mode or through SSH otherwise
+func (h *Qemu) AddPort(vm *Machine, port Port) error {
+	if vm.getNetworkSettings().Mode != config.NetworkModeUser {
+		if !isTunnelled(port) {
+			return ErrPortNotTunnelled
+		}
+		return startForwarder(vm)
+	}
+
+	return h.runHumanMonitorCommand(vm, fmt.Sprintf("hostfwd_add %s %s", vm.Network.NicName, hostfwdRule(port)))
+}
+
+// RemovePort stops forwarding a port to the running machine
+func (h *Qemu) RemovePort(vm *Machine, port Port) error {
+	if vm.getNetworkSettings().Mode != config.NetworkModeUser {
+		return startForwarder(vm)
+	}
+
+	// The rule is removed by the host side of the forward
+	rule, _, _ := strings.Cut(hostfwdRule(port), "-")
+	return h.runHumanMonitorCommand(vm, fmt.Sprintf("hostfwd_remove %s %s", vm.Network.NicName, rule))
+}
+
+// Resize checks the resources of the machine, which are applied on its next
+// start as the QEMU arguments are built from them
+func (h *Qemu) Resize(vm *Machine) error {
+	_, _, err := qemuResources(vm, "host")
+	return err
+}
+
+// runHumanMonitorCommand runs the command of the QEMU human monitor through
+// QMP, failing when it has any output, which the monitor uses for the errors
+func (h *Qemu) runHumanMonitorCommand(vm *Machine, command string) error {
+	qmp, err := h.dialQMP(vm)
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+
+	output, err := qmp.HumanMonitorCommand(command)
+	if err != nil {
+		return err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return errors.New(output)
 	}
 
-	command := "ssh-keygen"
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of the stopped machine disks
+func (h *Qemu) CreateSnapshot(vm *Machine, name string) error {
+	return h.runSnapshotCommand(vm, "-c", name)
+}
+
+// ListSnapshots lists the snapshots of the machine disk
+func (h *Qemu) ListSnapshots(vm *Machine) ([]Snapshot, error) {
 	args := []string{
-		"-R",
-		vm.Network.IPAddress,
+		"info",
+		"--output=json",
+		// Allow reading the disk while the machine is running
+		"-U",
+		filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.DiskFilename)),
 	}
-	cmd := exec.Command(command, args...)
-	err = cmd.Start()
+	output, err := vm.Runner.RunCommand("qemu-img", args)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseQemuImgSnapshots(output)
+}
+
+// RevertSnapshot reverts the stopped machine disks to a snapshot
+func (h *Qemu) RevertSnapshot(vm *Machine, name string) error {
+	return h.runSnapshotCommand(vm, "-a", name)
+}
+
+// DeleteSnapshot deletes a snapshot from the stopped machine disks
+func (h *Qemu) DeleteSnapshot(vm *Machine, name string) error {
+	return h.runSnapshotCommand(vm, "-d", name)
+}
+
+// runSnapshotCommand runs the qemu-img snapshot operation on the machine
+// disk and its qcow2 data disks, which requires the machine to be stopped
+func (h *Qemu) runSnapshotCommand(vm *Machine, operation string, name string) error {
+	status, err := h.Status(vm)
 	if err != nil {
 		return err
 	}
+	if status != "shut off" {
+		return errors.New("the machine must be stopped to manage its snapshots")
+	}
 
-	return os.RemoveAll(filepath.Join(cfg.Directories.Instances, vm.Name))
+	// Get the disks supporting snapshots
+	images := []string{filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.DiskFilename))}
+	disks, err := vm.getDisks()
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		if disk.Format == "qcow2" {
+			images = append(images, vm.getDataDiskPath(disk))
+		}
+	}
+
+	for _, image := range images {
+		_, err := vm.Runner.RunCommand("qemu-img", []string{"snapshot", operation, name, image})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseQemuImgSnapshots parses the snapshots from the JSON output of the qemu-img info command
+func parseQemuImgSnapshots(output string) ([]Snapshot, error) {
+	info := struct {
+		Snapshots []struct {
+			Name    string `json:"name"`
+			DateSec int64  `json:"date-sec"`
+		} `json:"snapshots"`
+	}{}
+	err := json.Unmarshal([]byte(output), &info)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, s := range info.Snapshots {
+		snapshots = append(snapshots, Snapshot{Name: s.Name, CreatedAt: time.Unix(s.DateSec, 0)})
+	}
+
+	return snapshots, nil
 }
 
 // Get Hypervisor driver
@@ -138,11 +685,65 @@ func getHypervisorDriver() string {
 	return driver
 }
 
-func (h *Qemu) getPID(vm *Machine) string {
-	cfg, err := config.LoadConfig()
+// getPID reads the PID of the QEMU process from the PID file
+func (h *Qemu) getPID(vm *Machine) (int, error) {
+	data, err := os.ReadFile(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.PIDFilename)))
 	if err != nil {
-		return "err"
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// dialQMP connects to the QMP socket of the machine
+func (h *Qemu) dialQMP(vm *Machine) (*qmputil.Client, error) {
+	return qmputil.Dial(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.QMPSocketFilename)))
+}
+
+// cleanup removes the PID file and the QMP socket of a QEMU process that is not running
+func (h *Qemu) cleanup(vm *Machine) {
+	os.Remove(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.PIDFilename)))
+	os.Remove(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.QMPSocketFilename)))
+	os.Remove(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.ConsoleSocketFilename)))
+	os.Remove(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.TPMSocketFilename)))
+}
+
+// qemuNetdev returns the backend of the primary network interface, which
+// forwards SSH and the ports of the machine from the host in user mode
+func qemuNetdev(vm *Machine) string {
+	settings := vm.getNetworkSettings()
+	if settings.Mode != config.NetworkModeUser {
+		return fmt.Sprintf("bridge,id=%s,br=%s", vm.Network.NicName, settings.Bridge)
+	}
+
+	netdev := fmt.Sprintf("user,id=%s,hostfwd=%s", vm.Network.NicName, hostfwdRule(Port{HostAddress: localhost, HostPort: vm.Network.SSHPort, GuestPort: 22, Protocol: "tcp"}))
+	for _, port := range vm.Ports {
+		netdev += ",hostfwd=" + hostfwdRule(port)
+	}
+	return netdev
+}
+
+// hostfwdRule returns the rule of the user-mode network forwarding the port from the host
+func hostfwdRule(port Port) string {
+	return fmt.Sprintf("%s:%s:%d-:%d", port.Protocol, port.HostAddress, port.HostPort, port.GuestPort)
+}
+
+// processExists checks if a process with the PID is running
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// qmpStatusName returns the name of the QMP run state, named like the libvirt states
+func qmpStatusName(status string) string {
+	switch status {
+	case "suspended":
+		return "pmsuspended"
+	case "shutdown":
+		return "in shutdown"
+	case "guest-panicked", "internal-error", "io-error":
+		return "crashed"
+	default:
+		return status
 	}
-	data, _ := os.ReadFile(filepath.Join(cfg.Directories.Instances, vm.Name, config.GetFilename(config.PIDFilename)))
-	return string(data)
 }
@@ -1 +1,219 @@
 package hypvsr
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePIDFile writes the PID of the process running the machine
+func writePIDFile(vm *Machine, pid int) {
+	os.WriteFile(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.PIDFilename)), []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+// startQMPServer starts a fake QMP server on the socket of the machine that
+// replies to query-status with the status and returns the received commands,
+// with the command line of the human monitor commands
+func startQMPServer(t *testing.T, vm *Machine, status string) chan string {
+	listener, err := net.Listen("unix", filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.QMPSocketFilename)))
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				cmd := struct {
+					Execute   string `json:"execute"`
+					Arguments struct {
+						CommandLine string `json:"command-line"`
+					} `json:"arguments"`
+				}{}
+				json.Unmarshal(scanner.Bytes(), &cmd)
+				if cmd.Execute == "query-status" {
+					fmt.Fprintf(conn, `{"return": {"status": %q, "running": false}}`+"\n", status)
+					continue
+				}
+				if cmd.Execute == "query-migrate" {
+					fmt.Fprintln(conn, `{"return": {"status": "completed"}}`)
+					continue
+				}
+				if cmd.Execute == "human-monitor-command" {
+					received <- cmd.Arguments.CommandLine
+					fmt.Fprintln(conn, `{"return": ""}`)
+					continue
+				}
+				if cmd.Execute != "qmp_capabilities" {
+					received <- cmd.Execute
+				}
+				fmt.Fprintln(conn, `{"return": {}}`)
+			}
+			conn.Close()
+		}
+	}()
+
+	return received
+}
+
+func TestQemu_Status(t *testing.T) {
+	h := &Qemu{}
+
+	// Test case: The machine was never started
+	status, err := h.Status(newTestMachine(t, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "shut off", status)
+
+	// Test case: The process of the PID file is gone
+	vm := newTestMachine(t, "")
+	writePIDFile(vm, 999999999)
+	status, err = h.Status(vm)
+	assert.NoError(t, err)
+	assert.Equal(t, "shut off", status)
+	assert.NoFileExists(t, filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.PIDFilename)))
+
+	// Test case: The machine was started without a QMP socket
+	vm = newTestMachine(t, "")
+	writePIDFile(vm, os.Getpid())
+	status, err = h.Status(vm)
+	assert.NoError(t, err)
+	assert.Equal(t, "running", status)
+
+	// Test case: The status is read through QMP
+	vm = newTestMachine(t, "")
+	writePIDFile(vm, os.Getpid())
+	startQMPServer(t, vm, "paused")
+	status, err = h.Status(vm)
+	assert.NoError(t, err)
+	assert.Equal(t, "paused", status)
+
+	// Test case: The PID was reused by a process that is not listening on the QMP socket
+	vm = newTestMachine(t, "")
+	writePIDFile(vm, os.Getpid())
+	listener, err := net.Listen("unix", filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.QMPSocketFilename)))
+	assert.NoError(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	status, err = h.Status(vm)
+	assert.NoError(t, err)
+	assert.Equal(t, "shut off", status)
+	assert.NoFileExists(t, filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.QMPSocketFilename)))
+}
+
+func TestQemu_Control(t *testing.T) {
+	h := &Qemu{}
+	vm := newTestMachine(t, "")
+	writePIDFile(vm, os.Getpid())
+	received := startQMPServer(t, vm, "running")
+
+	assert.NoError(t, h.Stop(vm))
+	assert.Equal(t, "system_powerdown", <-received)
+	assert.NoError(t, h.Pause(vm))
+	assert.Equal(t, "stop", <-received)
+	assert.NoError(t, h.Resume(vm))
+	assert.Equal(t, "cont", <-received)
+	assert.NoError(t, h.Restart(vm))
+	assert.Equal(t, "system_reset", <-received)
+	assert.NoError(t, h.ForceStop(vm))
+	assert.Equal(t, "quit", <-received)
+
+	// Test case: The machine is not running
+	assert.Error(t, h.Pause(newTestMachine(t, "")))
+}
+
+func TestQemu_Save(t *testing.T) {
+	h := &Qemu{}
+	vm := newTestMachine(t, "")
+	writePIDFile(vm, os.Getpid())
+	vm.Network.Mode = config.NetworkModeUser
+	received := startQMPServer(t, vm, "running")
+
+	// The machine is paused, migrated to the state file and exited
+	assert.NoError(t, h.Save(vm))
+	assert.Equal(t, "stop", <-received)
+	assert.Equal(t, "migrate", <-received)
+	assert.Equal(t, "quit", <-received)
+
+	// Test case: A stopped machine with a saved state
+	vm = newTestMachine(t, "")
+	os.WriteFile(filepath.Join(vm.baseDir, vm.Name, config.GetFilename(config.SavedStateFilename)), nil, 0644)
+	status, err := h.Status(vm)
+	assert.NoError(t, err)
+	assert.Equal(t, "saved", status)
+}
+
+func TestQemu_WaitRestored(t *testing.T) {
+	defaultInterval := qemuRestoreInterval
+	qemuRestoreInterval = 10 * time.Millisecond
+	t.Cleanup(func() { qemuRestoreInterval = defaultInterval })
+	h := &Qemu{}
+
+	// Test case: The state was saved paused, so the CPUs are started once it is loaded
+	vm := newTestMachine(t, "")
+	received := startQMPServer(t, vm, "paused")
+	assert.NoError(t, h.waitRestored(vm, make(chan error)))
+	assert.Equal(t, "cont", <-received)
+
+	// Test case: QEMU exits while restoring the state
+	vm = newTestMachine(t, "")
+	exited := make(chan error, 1)
+	exited <- nil
+	assert.Error(t, h.waitRestored(vm, exited))
+}
+
+func TestQmpStatusName(t *testing.T) {
+	assert.Equal(t, "running", qmpStatusName("running"))
+	assert.Equal(t, "paused", qmpStatusName("paused"))
+	assert.Equal(t, "pmsuspended", qmpStatusName("suspended"))
+	assert.Equal(t, "crashed", qmpStatusName("guest-panicked"))
+}
+
+func TestQemuNetdev(t *testing.T) {
+	// Test case: The machine is attached to the bridge
+	vm := &Machine{Network: Network{NicName: "virtnet", Bridge: "br0"}}
+	assert.Equal(t, "bridge,id=virtnet,br=br0", qemuNetdev(vm))
+
+	// Test case: SSH and the ports are forwarded in user mode
+	vm = &Machine{
+		Network: Network{Mode: config.NetworkModeUser, NicName: "virtnet", SSHPort: 2222},
+		Ports: []Port{
+			{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"},
+			{HostPort: 5353, GuestPort: 53, Protocol: "udp", HostAddress: "0.0.0.0"},
+		},
+	}
+	assert.Equal(t, "user,id=virtnet,hostfwd=tcp:127.0.0.1:2222-:22,hostfwd=tcp:127.0.0.1:8080-:80,hostfwd=udp:0.0.0.0:5353-:53", qemuNetdev(vm))
+}
+
+func TestQemu_Ports(t *testing.T) {
+	h := &Qemu{}
+	vm := newTestMachine(t, "")
+	writePIDFile(vm, os.Getpid())
+	vm.Network = Network{Mode: config.NetworkModeUser, NicName: "virtnet", SSHPort: 2222}
+	received := startQMPServer(t, vm, "running")
+	port := Port{HostPort: 8080, GuestPort: 80, Protocol: "tcp", HostAddress: "127.0.0.1"}
+
+	// Test case: The ports are forwarded by QEMU in user mode
+	assert.NoError(t, h.AddPort(vm, port))
+	assert.Equal(t, "hostfwd_add virtnet tcp:127.0.0.1:8080-:80", <-received)
+	assert.NoError(t, h.RemovePort(vm, port))
+	assert.Equal(t, "hostfwd_remove virtnet tcp:127.0.0.1:8080", <-received)
+
+	// Test case: Only TCP ports are forwarded through SSH
+	vm.Network.Mode = config.NetworkModeBridge
+	port.Protocol = "udp"
+	assert.ErrorIs(t, h.AddPort(vm, port), ErrPortNotTunnelled)
+}
@@ -0,0 +1,293 @@
+package hypvsr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/enkodr/machina/internal/config"
+)
+
+// CPU holds the model and topology of the virtual CPUs of the machine
+type CPU struct {
+	Model   string `yaml:"model,omitempty"`   // CPU model, e.g. Skylake-Server. The host one by default
+	Sockets int    `yaml:"sockets,omitempty"` // Number of sockets
+	Cores   int    `yaml:"cores,omitempty"`   // Number of cores per socket
+	Threads int    `yaml:"threads,omitempty"` // Number of threads per core
+	Nested  *bool  `yaml:"nested,omitempty"`  // Enables or disables nested virtualization. Left as the host sets it by default
+}
+
+// NUMANode holds the vCPUs and memory of a NUMA node of the machine
+type NUMANode struct {
+	CPUs   string `yaml:"cpus"`   // vCPUs of the node, e.g. 0-3 or 0-1,4-5
+	Memory string `yaml:"memory"` // Amount of RAM of the node
+}
+
+// cpuTopology holds the number of vCPUs of a machine and how they are laid out
+type cpuTopology struct {
+	CPUs    int
+	Sockets int
+	Cores   int
+	Threads int
+}
+
+// numaCell holds a validated NUMA node with its memory in MiB
+type numaCell struct {
+	CPUs   []string // Ranges of the vCPUs of the node, e.g. 0-1
+	Memory int
+}
+
+// Resize changes the CPUs, memory and disk size of the stopped machine. The
+// disk is grown to the size, or by it when prefixed with +, and the guest
+// grows its root filesystem on the next boot.
+func (machine *Machine) Resize(cpus string, memory string, disk string) error {
+	status, err := machine.Status()
+	if err != nil {
+		return err
+	}
+	if status != "shut off" {
+		return errors.New("the machine must be stopped to be resized")
+	}
+
+	previous := machine.Resources
+	if cpus != "" {
+		machine.Resources.CPUs = cpus
+	}
+	if memory != "" {
+		machine.Resources.Memory = strings.ToUpper(memory)
+	}
+	if disk != "" {
+		machine.Resources.Disk, err = resizedDisk(previous.Disk, disk)
+		if err != nil {
+			machine.Resources = previous
+			return err
+		}
+	}
+
+	err = machine.checkResources()
+	if err != nil {
+		machine.Resources = previous
+		return err
+	}
+
+	// Grow the disk, which can't be undone, so its size is kept when the rest fails
+	if machine.Resources.Disk != previous.Disk && !machine.isRemote() {
+		path := filepath.Join(machine.baseDir, machine.Name, config.GetFilename(config.DiskFilename))
+		_, err = machine.Runner.RunCommand("qemu-img", []string{"resize", path, machine.Resources.Disk})
+		if err != nil {
+			machine.Resources = previous
+			return err
+		}
+		previous.Disk = machine.Resources.Disk
+	}
+
+	err = machine.Hypervisor.Resize(machine)
+	if err != nil {
+		machine.Resources = previous
+		machine.save()
+		return err
+	}
+
+	return machine.save()
+}
+
+// checkResources validates the CPUs and memory of the machine
+func (machine *Machine) checkResources() error {
+	_, err := memoryMiB(machine.Resources.Memory)
+	if err != nil {
+		return fmt.Errorf("invalid memory %q", machine.Resources.Memory)
+	}
+
+	topology, err := machine.getCPUTopology()
+	if err != nil {
+		return err
+	}
+	_, err = machine.getNUMACells(topology.CPUs)
+	return err
+}
+
+// resizedDisk returns the disk size after resizing the current one to the
+// size, or by it when prefixed with +. Disks can only grow.
+func resizedDisk(current string, size string) (string, error) {
+	grow, relative := strings.CutPrefix(size, "+")
+	bytes, err := parseSize(grow)
+	if err != nil || bytes == 0 {
+		return "", fmt.Errorf("invalid disk size %q", size)
+	}
+
+	if current == "" {
+		if relative {
+			return "", errors.New("the disk size of the machine is unknown, set the new size instead")
+		}
+		return formatSize(bytes), nil
+	}
+	currentBytes, err := parseSize(current)
+	if err != nil {
+		return "", fmt.Errorf("invalid disk size %q of the machine", current)
+	}
+
+	if relative {
+		bytes += currentBytes
+	}
+	if bytes < currentBytes {
+		return "", fmt.Errorf("the disk can't shrink from %s to %s", current, formatSize(bytes))
+	}
+	return formatSize(bytes), nil
+}
+
+// formatSize formats the bytes with the largest of the K, M, G or T suffixes
+// that divides them
+func formatSize(bytes uint64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   uint64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if bytes%unit.size == 0 {
+			return fmt.Sprintf("%d%s", bytes/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatUint(bytes, 10)
+}
+
+// getCPUTopology returns the number of vCPUs of the machine and their
+// topology, which is not set when no sockets, cores or threads are given
+func (machine *Machine) getCPUTopology() (cpuTopology, error) {
+	topology := cpuTopology{}
+	if machine.Resources.CPUs != "" {
+		cpus, err := strconv.Atoi(machine.Resources.CPUs)
+		if err != nil || cpus < 1 {
+			return topology, fmt.Errorf("invalid number of cpus %q", machine.Resources.CPUs)
+		}
+		topology.CPUs = cpus
+	}
+
+	cpu := machine.Resources.CPU
+	if cpu.Sockets == 0 && cpu.Cores == 0 && cpu.Threads == 0 {
+		return topology, nil
+	}
+	if cpu.Sockets < 0 || cpu.Cores < 0 || cpu.Threads < 0 {
+		return topology, fmt.Errorf("invalid cpu topology %d sockets, %d cores and %d threads", cpu.Sockets, cpu.Cores, cpu.Threads)
+	}
+
+	// The fields not set default to one
+	topology.Sockets, topology.Cores, topology.Threads = max(cpu.Sockets, 1), max(cpu.Cores, 1), max(cpu.Threads, 1)
+	total := topology.Sockets * topology.Cores * topology.Threads
+	if topology.CPUs == 0 {
+		topology.CPUs = total
+	}
+	if topology.CPUs != total {
+		return topology, fmt.Errorf("the cpu topology has %d vCPUs, but cpus is %d", total, topology.CPUs)
+	}
+
+	return topology, nil
+}
+
+// getNUMACells returns the NUMA nodes of the machine, checking that every
+// vCPU and all the memory belong to exactly one node
+func (machine *Machine) getNUMACells(cpus int) ([]numaCell, error) {
+	if len(machine.Resources.NUMA) == 0 {
+		return nil, nil
+	}
+
+	total, err := memoryMiB(machine.Resources.Memory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory %q", machine.Resources.Memory)
+	}
+
+	cells := []numaCell{}
+	assigned := make([]bool, cpus)
+	memory := 0
+	for i, node := range machine.Resources.NUMA {
+		cell := numaCell{}
+
+		// Assign the vCPUs of the node
+		for _, r := range strings.Split(node.CPUs, ",") {
+			first, last, isRange := strings.Cut(strings.TrimSpace(r), "-")
+			start, err := strconv.Atoi(first)
+			end := start
+			if err == nil && isRange {
+				end, err = strconv.Atoi(last)
+			}
+			if err != nil || start < 0 || end < start || end >= cpus {
+				return nil, fmt.Errorf("invalid cpus %q for NUMA node %d of a machine with %d cpus", node.CPUs, i, cpus)
+			}
+			for cpu := start; cpu <= end; cpu++ {
+				if assigned[cpu] {
+					return nil, fmt.Errorf("cpu %d is in more than one NUMA node", cpu)
+				}
+				assigned[cpu] = true
+			}
+			cell.CPUs = append(cell.CPUs, strings.TrimSpace(r))
+		}
+
+		// Assign the memory of the node
+		cell.Memory, err = memoryMiB(node.Memory)
+		if err != nil || cell.Memory < 1 {
+			return nil, fmt.Errorf("invalid memory %q for NUMA node %d", node.Memory, i)
+		}
+		memory += cell.Memory
+
+		cells = append(cells, cell)
+	}
+
+	for cpu, ok := range assigned {
+		if !ok {
+			return nil, fmt.Errorf("cpu %d is in no NUMA node", cpu)
+		}
+	}
+	if memory != total {
+		return nil, fmt.Errorf("the NUMA nodes have %dM of memory, but the machine has %dM", memory, total)
+	}
+
+	return cells, nil
+}
+
+// getNestedFeature returns the CPU feature toggled to enable or disable nested
+// virtualization, empty when it is left as the host sets it
+func (machine *Machine) getNestedFeature() (string, error) {
+	if machine.Resources.CPU.Nested == nil {
+		return "", nil
+	}
+	arch, err := machine.getArch()
+	if err != nil {
+		return "", err
+	}
+	if arch != ArchX86_64 {
+		return "", fmt.Errorf("nested virtualization is only configurable in %s machines", ArchX86_64)
+	}
+	return nestedFeature(machine.Resources.CPU.Model), nil
+}
+
+// memoryMiB converts an amount of memory with a G or M suffix to MiB
+func memoryMiB(memory string) (int, error) {
+	if memory == "" {
+		return 0, errors.New("no memory set")
+	}
+	ram, err := convertMemory(strings.ToUpper(memory))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(ram)
+}
+
+// nestedFeature returns the CPU feature that enables nested virtualization,
+// svm for AMD CPUs and vmx for Intel ones
+func nestedFeature(model string) string {
+	if model == "" {
+		cpuinfo, _ := os.ReadFile("/proc/cpuinfo")
+		if strings.Contains(string(cpuinfo), "AuthenticAMD") {
+			return "svm"
+		}
+		return "vmx"
+	}
+
+	for _, prefix := range []string{"EPYC", "Opteron", "phenom", "athlon"} {
+		if strings.HasPrefix(model, prefix) {
+			return "svm"
+		}
+	}
+	return "vmx"
+}
@@ -0,0 +1,261 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/enkodr/machina/internal/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMachine_GetCPUTopology(t *testing.T) {
+	machine := &Machine{Resources: Resources{CPUs: "4"}}
+	topology, err := machine.getCPUTopology()
+	assert.NoError(t, err)
+	assert.Equal(t, cpuTopology{CPUs: 4}, topology)
+
+	// Test case: The fields not set default to one
+	machine.Resources.CPU = CPU{Sockets: 2, Cores: 2}
+	topology, err = machine.getCPUTopology()
+	assert.NoError(t, err)
+	assert.Equal(t, cpuTopology{CPUs: 4, Sockets: 2, Cores: 2, Threads: 1}, topology)
+
+	// Test case: The number of CPUs is taken from the topology
+	machine.Resources = Resources{CPU: CPU{Sockets: 1, Cores: 4, Threads: 2}}
+	topology, err = machine.getCPUTopology()
+	assert.NoError(t, err)
+	assert.Equal(t, 8, topology.CPUs)
+
+	// Test case: The topology does not match the number of CPUs
+	machine.Resources.CPUs = "4"
+	_, err = machine.getCPUTopology()
+	assert.Error(t, err)
+
+	// Test case: Invalid number of CPUs
+	machine.Resources = Resources{CPUs: "many"}
+	_, err = machine.getCPUTopology()
+	assert.Error(t, err)
+}
+
+func TestMachine_GetNUMACells(t *testing.T) {
+	machine := &Machine{Resources: Resources{CPUs: "4", Memory: "4G", NUMA: []NUMANode{
+		{CPUs: "0-1", Memory: "1G"},
+		{CPUs: "2,3", Memory: "3072M"},
+	}}}
+	cells, err := machine.getNUMACells(4)
+	assert.NoError(t, err)
+	assert.Equal(t, []numaCell{{CPUs: []string{"0-1"}, Memory: 1024}, {CPUs: []string{"2", "3"}, Memory: 3072}}, cells)
+
+	// Test case: A CPU in no node
+	machine.Resources.NUMA[1].CPUs = "2"
+	_, err = machine.getNUMACells(4)
+	assert.Error(t, err)
+
+	// Test case: A CPU in two nodes
+	machine.Resources.NUMA[1].CPUs = "1-3"
+	_, err = machine.getNUMACells(4)
+	assert.Error(t, err)
+
+	// Test case: A CPU the machine does not have
+	machine.Resources.NUMA[1].CPUs = "2-4"
+	_, err = machine.getNUMACells(4)
+	assert.Error(t, err)
+
+	// Test case: The nodes do not add up to the memory of the machine
+	machine.Resources.NUMA[1] = NUMANode{CPUs: "2-3", Memory: "1G"}
+	_, err = machine.getNUMACells(4)
+	assert.Error(t, err)
+
+	// Test case: No nodes
+	machine.Resources.NUMA = nil
+	cells, err = machine.getNUMACells(4)
+	assert.NoError(t, err)
+	assert.Empty(t, cells)
+}
+
+func TestMachine_GetNestedFeature(t *testing.T) {
+	nested := true
+	machine := &Machine{Resources: Resources{CPU: CPU{Model: "Skylake-Server", Nested: &nested}}}
+	feature, err := machine.getNestedFeature()
+	assert.NoError(t, err)
+	assert.Equal(t, "vmx", feature)
+
+	machine.Resources.CPU.Model = "EPYC-Milan"
+	feature, err = machine.getNestedFeature()
+	assert.NoError(t, err)
+	assert.Equal(t, "svm", feature)
+
+	// Test case: Nested virtualization is only configurable in x86_64 machines
+	machine.Arch = ArchAArch64
+	_, err = machine.getNestedFeature()
+	assert.Error(t, err)
+}
+
+func TestQemuResources(t *testing.T) {
+	machine := &Machine{Resources: Resources{CPUs: "2", Memory: "2G"}}
+	args, backend, err := qemuResources(machine, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-cpu", "host", "-smp", "2", "-m", "2G"}, args)
+	assert.Empty(t, backend)
+
+	// Test case: Model, topology, nested virtualization, huge pages and balloon
+	nested, balloon := false, true
+	machine.Resources = Resources{
+		Memory:    "2G",
+		CPU:       CPU{Model: "Skylake-Server", Sockets: 1, Cores: 2, Threads: 2, Nested: &nested},
+		HugePages: true,
+		Balloon:   &balloon,
+	}
+	args, backend, err = qemuResources(machine, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"-cpu", "Skylake-Server,vmx=off",
+		"-smp", "4,sockets=1,cores=2,threads=2",
+		"-m", "2G",
+		"-object", "memory-backend-file,id=mem0,size=2G,mem-path=/dev/hugepages,share=on,prealloc=on",
+		"-device", "virtio-balloon-pci,id=balloon0",
+	}, args)
+	assert.Equal(t, "mem0", backend)
+
+	// Test case: The memory is split in NUMA nodes
+	machine.Resources = Resources{CPUs: "4", Memory: "2G", NUMA: []NUMANode{
+		{CPUs: "0,2", Memory: "1G"},
+		{CPUs: "1,3", Memory: "1G"},
+	}}
+	args, backend, err = qemuResources(machine, "max")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"-cpu", "max",
+		"-smp", "4",
+		"-m", "2G",
+		"-object", "memory-backend-ram,id=mem0,size=1024M",
+		"-numa", "node,nodeid=0,cpus=0,cpus=2,memdev=mem0",
+		"-object", "memory-backend-ram,id=mem1,size=1024M",
+		"-numa", "node,nodeid=1,cpus=1,cpus=3,memdev=mem1",
+	}, args)
+	assert.Empty(t, backend)
+}
+
+func TestNewDomainXML_Resources(t *testing.T) {
+	setTestConfig(t, &config.Config{})
+	nested, balloon := true, false
+	machine := &Machine{
+		Name:       "test-machine",
+		baseDir:    "/instances",
+		Hypervisor: &Libvirt{},
+		Resources: Resources{
+			Memory:    "4G",
+			CPU:       CPU{Model: "EPYC", Sockets: 2, Cores: 2, Nested: &nested},
+			HugePages: true,
+			Balloon:   &balloon,
+			NUMA:      []NUMANode{{CPUs: "0-1", Memory: "2G"}, {CPUs: "2-3", Memory: "2G"}},
+		},
+	}
+
+	definition, err := newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	domain := domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, "4", domain.VCPU)
+	assert.Equal(t, "custom", domain.CPU.Mode)
+	assert.Equal(t, &domainCPUModel{Fallback: "forbid", Name: "EPYC"}, domain.CPU.Model)
+	assert.Equal(t, &domainTopology{Sockets: 2, Cores: 2, Threads: 1}, domain.CPU.Topology)
+	assert.Equal(t, []domainCPUFeature{{Policy: "require", Name: "svm"}}, domain.CPU.Features)
+	assert.Equal(t, []domainNUMACell{
+		{ID: 0, CPUs: "0-1", Memory: 2048, Unit: "MiB"},
+		{ID: 1, CPUs: "2-3", Memory: 2048, Unit: "MiB"},
+	}, domain.CPU.NUMA.Cells)
+	assert.NotNil(t, domain.Backing.HugePages)
+	assert.Equal(t, "none", domain.Devices.MemBalloon.Model)
+
+	// Test case: No tuning leaves the defaults of libvirt
+	machine.Resources = Resources{CPUs: "2", Memory: "2G"}
+	definition, err = newDomainXML(machine, "kvm")
+	assert.NoError(t, err)
+	domain = domainXML{}
+	assert.NoError(t, xml.Unmarshal(definition, &domain))
+	assert.Equal(t, "2", domain.VCPU)
+	assert.Equal(t, "host-passthrough", domain.CPU.Mode)
+	assert.Nil(t, domain.CPU.Topology)
+	assert.Nil(t, domain.Backing)
+	assert.Nil(t, domain.Devices.MemBalloon)
+}
+
+func TestResizedDisk(t *testing.T) {
+	size, err := resizedDisk("50G", "+20G")
+	assert.NoError(t, err)
+	assert.Equal(t, "70G", size)
+
+	size, err = resizedDisk("50G", "1T")
+	assert.NoError(t, err)
+	assert.Equal(t, "1T", size)
+
+	size, err = resizedDisk("", "60g")
+	assert.NoError(t, err)
+	assert.Equal(t, "60G", size)
+
+	size, err = resizedDisk("10G", "+512M")
+	assert.NoError(t, err)
+	assert.Equal(t, "10752M", size)
+
+	// Test case: Disks can't shrink
+	_, err = resizedDisk("50G", "20G")
+	assert.Error(t, err)
+
+	// Test case: Growing a disk of unknown size
+	_, err = resizedDisk("", "+20G")
+	assert.Error(t, err)
+
+	// Test case: Invalid size
+	_, err = resizedDisk("50G", "+big")
+	assert.Error(t, err)
+}
+
+func TestMachine_Resize(t *testing.T) {
+	dir := t.TempDir()
+	runner := &MockRunner{}
+	hypervisor := &MockHypervisor{State: "shut off"}
+	machine := &Machine{
+		Name:       "test-machine",
+		baseDir:    dir,
+		Runner:     runner,
+		Hypervisor: hypervisor,
+		Resources:  Resources{CPUs: "2", Memory: "2G", Disk: "50G"},
+	}
+	os.MkdirAll(filepath.Join(dir, machine.Name), 0755)
+
+	err := machine.Resize("4", "8g", "+20G")
+	assert.NoError(t, err)
+	assert.Equal(t, Resources{CPUs: "4", Memory: "8G", Disk: "70G"}, machine.Resources)
+	assert.Equal(t, "qemu-img", runner.Command)
+	assert.Equal(t, []string{"resize", filepath.Join(dir, machine.Name, config.GetFilename(config.DiskFilename)), "70G"}, runner.Args)
+	assert.Contains(t, hypervisor.Calls, "Resize")
+
+	// Check that the resources are saved
+	data, err := os.ReadFile(filepath.Join(dir, machine.Name, config.GetFilename(config.InstanceFilename)))
+	assert.NoError(t, err)
+	saved := &Machine{}
+	assert.NoError(t, yaml.Unmarshal(data, saved))
+	assert.Equal(t, machine.Resources, saved.Resources)
+
+	// Test case: The disk is not resized when its size is unchanged
+	runner.Called = false
+	err = machine.Resize("2", "", "")
+	assert.NoError(t, err)
+	assert.False(t, runner.Called)
+	assert.Equal(t, "2", machine.Resources.CPUs)
+
+	// Test case: Invalid resources are not applied
+	err = machine.Resize("", "lots", "")
+	assert.Error(t, err)
+	assert.Equal(t, "8G", machine.Resources.Memory)
+
+	// Test case: The machine must be stopped
+	hypervisor.State = "running"
+	err = machine.Resize("8", "", "")
+	assert.Error(t, err)
+	assert.Equal(t, "2", machine.Resources.CPUs)
+}
@@ -0,0 +1,295 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/imgutil"
+)
+
+// The storage pool of the remote hosts where the base images are uploaded
+const imagesPool = "machina-images"
+
+// storagePoolXML holds the libvirt definition of a directory storage pool
+type storagePoolXML struct {
+	XMLName xml.Name      `xml:"pool"`
+	Type    string        `xml:"type,attr"`
+	Name    string        `xml:"name"`
+	Target  storageTarget `xml:"target"`
+}
+
+// storageVolumeXML holds the libvirt definition of a storage volume
+type storageVolumeXML struct {
+	XMLName      xml.Name        `xml:"volume"`
+	Name         string          `xml:"name"`
+	Capacity     storageCapacity `xml:"capacity"`
+	Target       storageTarget   `xml:"target"`
+	BackingStore *storageTarget  `xml:"backingStore"`
+}
+
+type storageCapacity struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+type storageTarget struct {
+	Path   string         `xml:"path,omitempty"`
+	Format *storageFormat `xml:"format"`
+}
+
+type storageFormat struct {
+	Type string `xml:"type,attr"`
+}
+
+// uploadDisks creates the disks of the machine in the storage pools of the
+// remote host, uploading the base image when the host does not have it yet
+// and the seed disk
+func (h *Libvirt) uploadDisks(conn *libvirt.Libvirt, machine *Machine) error {
+	// Upload the base image, shared by the machines of the host
+	images, err := ensureStoragePool(conn, imagesPool, filepath.Join(getRemoteDir(), "images"))
+	if err != nil {
+		return err
+	}
+	name, err := imgutil.GetFilenameFromURL(machine.Image.URL)
+	if err != nil {
+		return err
+	}
+	image, err := conn.StorageVolLookupByName(images, name)
+	if isLibvirtError(err, libvirt.ErrNoStorageVol) {
+		image, err = uploadVolume(conn, images, name, filepath.Join(cfg.Directories.Images, name))
+		if err != nil {
+			return err
+		}
+
+		// Refresh the pool to detect the format and size of the uploaded image
+		err = conn.StoragePoolRefresh(images, 0)
+	}
+	if err != nil {
+		return err
+	}
+	imagePath, err := conn.StorageVolGetPath(image)
+	if err != nil {
+		return err
+	}
+	_, imageSize, _, err := conn.StorageVolGetInfo(image)
+	if err != nil {
+		return err
+	}
+
+	// Create the pool for the disks of the machine
+	pool, err := ensureStoragePool(conn, machine.Name, machine.getDiskDir())
+	if err != nil {
+		return err
+	}
+
+	// Create the machine disk on top of the base image, which can't be smaller than the image
+	size := imageSize
+	if machine.Resources.Disk != "" {
+		size, err = parseSize(machine.Resources.Disk)
+		if err != nil {
+			return fmt.Errorf("invalid disk size: %w", err)
+		}
+		size = max(size, imageSize)
+	}
+	_, err = createVolume(conn, pool, storageVolumeXML{
+		Name:         config.GetFilename(config.DiskFilename),
+		Capacity:     storageCapacity{Unit: "bytes", Value: size},
+		Target:       storageTarget{Format: &storageFormat{Type: "qcow2"}},
+		BackingStore: &storageTarget{Path: imagePath, Format: &storageFormat{Type: "qcow2"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Upload the seed disk
+	seed := config.GetFilename(config.SeedImageFilename)
+	_, err = uploadVolume(conn, pool, seed, filepath.Join(machine.baseDir, machine.Name, seed))
+	if err != nil {
+		return err
+	}
+
+	// Create the data disks
+	disks, err := machine.getDisks()
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		size, err := parseSize(disk.Size)
+		if err != nil {
+			return fmt.Errorf("invalid size for disk %q: %w", disk.Name, err)
+		}
+		_, err = createVolume(conn, pool, storageVolumeXML{
+			Name:     dataDiskFilename(disk),
+			Capacity: storageCapacity{Unit: "bytes", Value: size},
+			Target:   storageTarget{Format: &storageFormat{Type: disk.Format}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resizeVolume grows the disk of the machine in the remote host to the disk
+// size of the machine
+func resizeVolume(conn *libvirt.Libvirt, machine *Machine) error {
+	size, err := parseSize(machine.Resources.Disk)
+	if err != nil {
+		return fmt.Errorf("invalid disk size: %w", err)
+	}
+
+	pool, err := conn.StoragePoolLookupByName(machine.Name)
+	if err != nil {
+		return err
+	}
+	volume, err := conn.StorageVolLookupByName(pool, config.GetFilename(config.DiskFilename))
+	if err != nil {
+		return err
+	}
+	_, capacity, _, err := conn.StorageVolGetInfo(volume)
+	if err != nil || size <= capacity {
+		return err
+	}
+
+	err = conn.StorageVolResize(volume, size, 0)
+	if err != nil {
+		return fmt.Errorf("resizing volume %q: %w", volume.Name, err)
+	}
+	return nil
+}
+
+// deleteVolumes deletes the volumes of the storage pool along with its directory
+func deleteVolumes(conn *libvirt.Libvirt, pool libvirt.StoragePool) error {
+	// Refresh the pool to list the files created by the machine, like the console log
+	err := conn.StoragePoolRefresh(pool, 0)
+	if err != nil {
+		return err
+	}
+
+	volumes, _, err := conn.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		err = conn.StorageVolDelete(volume, 0)
+		if err != nil {
+			return fmt.Errorf("deleting volume %q: %w", volume.Name, err)
+		}
+	}
+
+	return conn.StoragePoolDelete(pool, 0)
+}
+
+// ensureStoragePool gets the directory storage pool with the name, defining,
+// building and starting it when needed
+func ensureStoragePool(conn *libvirt.Libvirt, name string, dir string) (libvirt.StoragePool, error) {
+	pool, err := conn.StoragePoolLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoStoragePool) {
+		definition, err := xml.MarshalIndent(storagePoolXML{Type: "dir", Name: name, Target: storageTarget{Path: dir}}, "", "  ")
+		if err != nil {
+			return pool, err
+		}
+		pool, err = conn.StoragePoolDefineXML(string(definition), 0)
+		if err != nil {
+			return pool, fmt.Errorf("defining storage pool %q: %w", name, err)
+		}
+		err = conn.StoragePoolBuild(pool, 0)
+		if err != nil {
+			return pool, fmt.Errorf("building storage pool %q: %w", name, err)
+		}
+		err = conn.StoragePoolSetAutostart(pool, 1)
+		if err != nil {
+			return pool, err
+		}
+	} else if err != nil {
+		return pool, err
+	}
+
+	active, err := conn.StoragePoolIsActive(pool)
+	if err != nil || active == 1 {
+		return pool, err
+	}
+	err = conn.StoragePoolCreate(pool, 0)
+	if err != nil {
+		return pool, fmt.Errorf("starting storage pool %q: %w", name, err)
+	}
+
+	return pool, nil
+}
+
+// createVolume creates the volume in the storage pool
+func createVolume(conn *libvirt.Libvirt, pool libvirt.StoragePool, volume storageVolumeXML) (libvirt.StorageVol, error) {
+	definition, err := xml.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	vol, err := conn.StorageVolCreateXML(pool, string(definition), 0)
+	if err != nil {
+		return vol, fmt.Errorf("creating volume %q: %w", volume.Name, err)
+	}
+
+	return vol, nil
+}
+
+// uploadVolume creates a volume with the name in the storage pool and
+// uploads the content of the local file to it
+func uploadVolume(conn *libvirt.Libvirt, pool libvirt.StoragePool, name string, file string) (libvirt.StorageVol, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	// The content is copied as is, so the volume is created as raw
+	volume, err := createVolume(conn, pool, storageVolumeXML{
+		Name:     name,
+		Capacity: storageCapacity{Unit: "bytes", Value: uint64(info.Size())},
+		Target:   storageTarget{Format: &storageFormat{Type: "raw"}},
+	})
+	if err != nil {
+		return volume, err
+	}
+
+	err = conn.StorageVolUpload(volume, f, 0, uint64(info.Size()), 0)
+	if err != nil {
+		conn.StorageVolDelete(volume, 0)
+		return volume, fmt.Errorf("uploading %q: %w", name, err)
+	}
+
+	return volume, nil
+}
+
+// parseSize converts a size with an optional K, M, G or T suffix, as used by
+// qemu-img, to bytes
+func parseSize(size string) (uint64, error) {
+	units := map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+	size = strings.ToUpper(strings.TrimSpace(size))
+	multiplier := uint64(1)
+	if len(size) > 0 {
+		if unit, ok := units[size[len(size)-1:]]; ok {
+			multiplier = unit
+			size = size[:len(size)-1]
+		}
+	}
+
+	value, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return value * multiplier, nil
+}
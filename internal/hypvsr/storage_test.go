@@ -0,0 +1,56 @@
+package hypvsr
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	testCases := []struct {
+		size     string
+		expected uint64
+	}{
+		{"1024", 1024},
+		{"512K", 512 << 10},
+		{"512M", 512 << 20},
+		{"20G", 20 << 30},
+		{"20g", 20 << 30},
+		{"2T", 2 << 40},
+	}
+	for _, tc := range testCases {
+		size, err := parseSize(tc.size)
+		assert.NoError(t, err, tc.size)
+		assert.Equal(t, tc.expected, size, tc.size)
+	}
+
+	// Test case: Invalid sizes
+	for _, size := range []string{"", "G", "twoG", "-1G"} {
+		_, err := parseSize(size)
+		assert.Error(t, err, size)
+	}
+}
+
+func TestStorageVolumeXML(t *testing.T) {
+	volume := storageVolumeXML{
+		Name:         "disk.img",
+		Capacity:     storageCapacity{Unit: "bytes", Value: 10 << 30},
+		Target:       storageTarget{Format: &storageFormat{Type: "qcow2"}},
+		BackingStore: &storageTarget{Path: "/images/ubuntu.img", Format: &storageFormat{Type: "qcow2"}},
+	}
+
+	definition, err := xml.MarshalIndent(volume, "", "  ")
+	assert.NoError(t, err)
+	assert.Equal(t, `<volume>
+  <name>disk.img</name>
+  <capacity unit="bytes">10737418240</capacity>
+  <target>
+    <format type="qcow2"></format>
+  </target>
+  <backingStore>
+    <path>/images/ubuntu.img</path>
+    <format type="qcow2"></format>
+  </backingStore>
+</volume>`, string(definition))
+}
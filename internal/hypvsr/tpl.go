@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/enkodr/machina/internal/config"
@@ -130,6 +131,12 @@ func parseTemplate(tpl []byte) (*Instance, error) {
 			return nil, err
 		}
 
+		// Select the image of the architecture
+		err = machine.resolveImage()
+		if err != nil {
+			return nil, err
+		}
+
 		// Set the base directory
 		machine.baseDir = cfg.Directories.Instances
 		// Set the runner
@@ -158,6 +165,12 @@ func parseTemplate(tpl []byte) (*Instance, error) {
 			// Extend the instance
 			machine.extend()
 
+			// Select the image of the architecture
+			err = machine.resolveImage()
+			if err != nil {
+				return nil, err
+			}
+
 			// Set the default number of replicas to 1
 			if machine.Replicas == 0 {
 				machine.Replicas = 1
@@ -177,7 +190,7 @@ func parseTemplate(tpl []byte) (*Instance, error) {
 				// Set the base directory
 				copiedMachine.baseDir = cfg.Directories.Instances
 				// Set the cluster name
-				copiedMachine.clusterName = c.Name
+				copiedMachine.ClusterName = c.Name
 
 				expandedMachines = append(expandedMachines, copiedMachine)
 			}
@@ -221,7 +234,41 @@ func GetMachine(name string) (*Machine, error) {
 	return machine, nil
 }
 
+// GetMachines loads all the created machines
+func GetMachines() ([]*Machine, error) {
+	// Loads the configuration
+	var err error
+	cfg, err = config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(cfg.Directories.Instances)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	machines := []*Machine{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		machine, err := GetMachine(entry.Name())
+		if err != nil {
+			continue
+		}
+		machines = append(machines, machine)
+	}
+
+	return machines, nil
+}
+
 func (vm *Machine) extend() error {
+	// Count the CPUs of the topology, so they are not taken from the base template
+	if topology, err := vm.getCPUTopology(); err == nil && vm.Resources.CPUs == "" && topology.CPUs > 0 {
+		vm.Resources.CPUs = strconv.Itoa(topology.CPUs)
+	}
+
 	for vm.Extends != "" {
 		tplFile := fmt.Sprintf("%s/%s.yaml", endpoint, vm.Extends)
 		baseTpl, err := netutil.Download(tplFile)
@@ -237,6 +284,7 @@ func (vm *Machine) extend() error {
 		vm.Extends = base.Extends
 		base.Scripts = Scripts{}
 		base.Mount = Mount{}
+		base.Mounts = nil
 		mergo.Merge(vm, base)
 	}
 	vm.Resources.Disk = strings.ToUpper(vm.Resources.Disk)
@@ -291,8 +339,13 @@ func GetTemplateList() []string {
 	return files
 }
 
+// GetTemplateURL returns the URL of the template with the given name
+func GetTemplateURL(name string) string {
+	return fmt.Sprintf("%s/%s.yaml", endpoint, name)
+}
+
 func GetTemplate(name string) (string, error) {
-	tpl, err := netutil.Download(fmt.Sprintf("%s/%s.yaml", endpoint, name))
+	tpl, err := netutil.Download(GetTemplateURL(name))
 	if err != nil {
 		return "", err
 	}
@@ -1,13 +1,41 @@
 package imgutil
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 
 	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/osutil"
+	"gopkg.in/yaml.v3"
 )
 
+// The suffix of the file kept next to each cached image with its metadata
+const metadataSuffix = ".yaml"
+
+// The algorithms of the hashes of the checksum files that don't name them,
+// by the length of the hash in hex
+var digestAlgorithms = map[int]string{32: "md5", 40: "sha1", 56: "sha224", 64: "sha256", 96: "sha384", 128: "sha512"}
+
+// Metadata holds where a cached image was downloaded from and its checksum
+type Metadata struct {
+	URL      string   `yaml:"url,omitempty"`      // URL the image was downloaded from
+	Checksum string   `yaml:"checksum,omitempty"` // Checksum of the image in the format 'algorithm:hash'
+	Digests  *Digests `yaml:"digests,omitempty"`  // Digests computed from the content of the image
+}
+
+// Digests holds the digests of an image, which are valid while the size and
+// modification time of the image don't change
+type Digests struct {
+	Size    int64             `yaml:"size"`    // Size of the image when it was hashed
+	ModTime int64             `yaml:"modTime"` // Modification time of the image in nanoseconds when it was hashed
+	Hashes  map[string]string `yaml:"hashes"`  // Hashes of the image, by algorithm
+}
+
 func EnsureDirectories(cfg *config.Config) {
 	// Create directories
 	os.MkdirAll(cfg.Directories.Images, 0755)
@@ -39,3 +67,172 @@ func GetFilenameFromURL(url string) (string, error) {
 
 	return filename, nil
 }
+
+// IsMetadataFile checks if the file of the image cache holds the metadata of an image
+func IsMetadataFile(name string) bool {
+	return strings.HasSuffix(name, metadataSuffix)
+}
+
+// ReadMetadata reads the metadata of the cached image, which is empty for
+// the images downloaded before it was kept
+func ReadMetadata(image string) (Metadata, error) {
+	metadata := Metadata{}
+	data, err := os.ReadFile(image + metadataSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return metadata, nil
+	}
+	if err != nil {
+		return metadata, err
+	}
+
+	err = yaml.Unmarshal(data, &metadata)
+	return metadata, err
+}
+
+// WriteMetadata writes the metadata of the cached image
+func WriteMetadata(image string, metadata Metadata) error {
+	data, err := yaml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(image+metadataSuffix, data, 0644)
+}
+
+// Digest returns the digest of the cached image with the algorithm in the
+// format 'algorithm:hash'. The image is only hashed when it changed since
+// its digest was last computed, and the digest is kept in its metadata.
+func Digest(image, algorithm string) (string, error) {
+	info, err := os.Stat(image)
+	if err != nil {
+		return "", err
+	}
+	metadata, err := ReadMetadata(image)
+	if err != nil {
+		return "", err
+	}
+
+	// Discard the digests of a previous content of the image
+	digests := metadata.Digests
+	if digests == nil || digests.Size != info.Size() || digests.ModTime != info.ModTime().UnixNano() {
+		digests = &Digests{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Hashes: map[string]string{}}
+	}
+	if hash, ok := digests.Hashes[algorithm]; ok {
+		return algorithm + ":" + hash, nil
+	}
+
+	digest, err := osutil.FileDigest(image, algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the digest, failing silently as it is only a cache
+	digests.Hashes[algorithm] = strings.TrimPrefix(digest, algorithm+":")
+	metadata.Digests = digests
+	WriteMetadata(image, metadata)
+
+	return digest, nil
+}
+
+// VerifyChecksum checks if the cached image matches the checksum in the
+// format 'algorithm:hash'
+func VerifyChecksum(image, checksum string) bool {
+	algorithm, hash, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return false
+	}
+
+	digest, err := Digest(image, algorithm)
+	if err != nil {
+		return false
+	}
+	return digest == algorithm+":"+strings.ToLower(hash)
+}
+
+// RemoveImage removes the cached image along with its metadata
+func RemoveImage(image string) error {
+	err := os.Remove(image)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(image + metadataSuffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ParseChecksumFile returns the checksum of the file listed in a checksum file
+// like SHA256SUMS in the format 'algorithm:hash'. The files list a hash per line
+// in the GNU format '<hash>  <file>' or the BSD format 'SHA256 (<file>) = <hash>'.
+func ParseChecksumFile(data []byte, fileName string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var algorithm, name, hash string
+		if tag, rest, ok := strings.Cut(line, " ("); ok && !strings.Contains(tag, " ") {
+			// BSD format
+			name, hash, ok = strings.Cut(rest, ") = ")
+			if !ok {
+				continue
+			}
+			algorithm = strings.ToLower(strings.ReplaceAll(tag, "-", ""))
+		} else {
+			// GNU format, with the file name marked with * when hashed in binary mode
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			hash, name = fields[0], strings.TrimPrefix(fields[1], "*")
+			algorithm = digestAlgorithms[len(hash)]
+		}
+
+		if name != fileName {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); err != nil || algorithm == "" {
+			return "", fmt.Errorf("invalid checksum %q for %s", hash, fileName)
+		}
+		return algorithm + ":" + strings.ToLower(hash), nil
+	}
+
+	return "", fmt.Errorf("%s is not listed in the checksum file", fileName)
+}
+
+// SignedContent returns the text signed in a clearsigned message, so that
+// only the signed lines are trusted, and whether the data is clearsigned
+func SignedContent(data []byte) ([]byte, bool) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	start := -1
+	for i, line := range lines {
+		if line == "-----BEGIN PGP SIGNED MESSAGE-----" {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+
+	// Skip the armor headers, which end with an empty line
+	for start < len(lines) && lines[start] != "" {
+		start++
+	}
+
+	content := []string{}
+	for _, line := range lines[min(start+1, len(lines)):] {
+		if line == "-----BEGIN PGP SIGNATURE-----" {
+			return []byte(strings.Join(content, "\n")), true
+		}
+		// Lines starting with a dash are escaped with '- '
+		content = append(content, strings.TrimPrefix(line, "- "))
+	}
+
+	return nil, true
+}
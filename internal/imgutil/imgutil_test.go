@@ -3,9 +3,11 @@ package imgutil
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/enkodr/machina/internal/config"
+	"github.com/enkodr/machina/internal/osutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -91,3 +93,152 @@ func TestGetFilenameFromURL(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.EqualError(t, err, expectedError)
 }
+
+func TestMetadata(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.img")
+	os.WriteFile(image, []byte("image"), 0644)
+
+	// Test case with an image downloaded before the metadata was kept
+	metadata, err := ReadMetadata(image)
+	assert.NoError(t, err)
+	assert.Equal(t, Metadata{}, metadata)
+
+	want := Metadata{URL: "https://example.com/images/image.img", Checksum: "sha256:1234"}
+	assert.NoError(t, WriteMetadata(image, want))
+	assert.True(t, IsMetadataFile(image+".yaml"))
+	assert.False(t, IsMetadataFile(image))
+	metadata, err = ReadMetadata(image)
+	assert.NoError(t, err)
+	assert.Equal(t, want, metadata)
+
+	// Test case removing the image along with its metadata
+	assert.NoError(t, RemoveImage(image))
+	assert.NoFileExists(t, image)
+	assert.NoFileExists(t, image+".yaml")
+	assert.Error(t, RemoveImage(image))
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	sha256 := "6f2ab4bd9ed4e4bc9a8e8ea1a5f5b7fa3f1ba13a0b4af4dd2b55f5a1b2b4c9e1"
+	sha512 := sha256 + sha256
+
+	// Test case: GNU format, in text and binary mode
+	data := []byte("# comment\n" + sha512 + "  other.img\n" + sha256 + " *noble-server-cloudimg-amd64.img\n")
+	checksum, err := ParseChecksumFile(data, "noble-server-cloudimg-amd64.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+sha256, checksum)
+	checksum, err = ParseChecksumFile(data, "other.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha512:"+sha512, checksum)
+
+	// Test case: BSD format
+	data = []byte("SHA256 (Fedora-Cloud-Base.qcow2) = " + sha256 + "\nSHA512 (other.img) = " + sha512 + "\n")
+	checksum, err = ParseChecksumFile(data, "Fedora-Cloud-Base.qcow2")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+sha256, checksum)
+
+	// Test case: Algorithms of legacy mirrors
+	md5 := "ac79653edeb65ab5563585f2d5f14fe9"
+	checksum, err = ParseChecksumFile([]byte(md5+"  legacy.img\n"), "legacy.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "md5:"+md5, checksum)
+	checksum, err = ParseChecksumFile([]byte("SHA1 (legacy.img) = 3CDDD3926CBB2787AFC183C6DA2B1D56161416AF\n"), "legacy.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha1:3cddd3926cbb2787afc183c6da2b1d56161416af", checksum)
+
+	// Test case: The file is not listed
+	_, err = ParseChecksumFile(data, "missing.img")
+	assert.Error(t, err)
+
+	// Test case: Invalid hash
+	_, err = ParseChecksumFile([]byte("abcd  file.img\n"), "file.img")
+	assert.Error(t, err)
+}
+
+func TestSignedContent(t *testing.T) {
+	data := []byte(`-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+aaaa  signed.img
+- -dashed line
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCAAdFiEE
+-----END PGP SIGNATURE-----
+bbbb  unsigned.img
+`)
+	content, clearsigned := SignedContent(data)
+	assert.True(t, clearsigned)
+	assert.Equal(t, "aaaa  signed.img\n-dashed line", string(content))
+
+	// Test case: The data is not clearsigned
+	_, clearsigned = SignedContent([]byte("aaaa  file.img\n"))
+	assert.False(t, clearsigned)
+}
+
+func TestDigest(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.img")
+	assert.NoError(t, os.WriteFile(image, []byte("Test file content"), 0644))
+	assert.NoError(t, WriteMetadata(image, Metadata{URL: "https://example.com/images/image.img"}))
+	sha256, _ := osutil.FileDigest(image, "sha256")
+
+	digest, err := Digest(image, "sha256")
+	assert.NoError(t, err)
+	assert.Equal(t, sha256, digest)
+	assert.True(t, VerifyChecksum(image, sha256))
+	assert.True(t, VerifyChecksum(image, "sha256:"+strings.ToUpper(sha256[7:])))
+	assert.True(t, VerifyChecksum(image, "sha1:3cddd3926cbb2787afc183c6da2b1d56161416af"))
+	assert.False(t, VerifyChecksum(image, "sha256:1234"))
+	assert.False(t, VerifyChecksum(image, "crc32:1234"))
+
+	// Check that the digests are kept along with the metadata
+	metadata, err := ReadMetadata(image)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/images/image.img", metadata.URL)
+	assert.Len(t, metadata.Digests.Hashes, 2)
+
+	// Test case: The kept digest is used while the image does not change
+	metadata.Digests.Hashes["sha256"] = "cached"
+	assert.NoError(t, WriteMetadata(image, metadata))
+	digest, err = Digest(image, "sha256")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:cached", digest)
+
+	// Test case: The image is hashed again when it changes
+	assert.NoError(t, os.WriteFile(image, []byte("Other file content"), 0644))
+	digest, err = Digest(image, "sha256")
+	assert.NoError(t, err)
+	want, _ := osutil.FileDigest(image, "sha256")
+	assert.Equal(t, want, digest)
+	metadata, err = ReadMetadata(image)
+	assert.NoError(t, err)
+	assert.Len(t, metadata.Digests.Hashes, 1)
+
+	// Test case: The image does not exist
+	_, err = Digest(filepath.Join(t.TempDir(), "missing.img"), "sha256")
+	assert.Error(t, err)
+	assert.False(t, VerifyChecksum(filepath.Join(t.TempDir(), "missing.img"), want))
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.img")
+	assert.NoError(t, os.WriteFile(image, []byte("Test file content"), 0644))
+	sha256, _ := osutil.FileDigest(image, "sha256")
+	sha512, _ := osutil.FileDigest(image, "sha512")
+
+	// Test case: Matching checksums, with the hash in any case
+	assert.True(t, VerifyChecksum(image, sha256))
+	assert.True(t, VerifyChecksum(image, "sha256:"+strings.ToUpper(strings.TrimPrefix(sha256, "sha256:"))))
+	assert.True(t, VerifyChecksum(image, sha512))
+
+	// Test case: Checksums that don't match
+	assert.False(t, VerifyChecksum(image, "sha256:InvalidChecksum"))
+	assert.False(t, VerifyChecksum(image, "sha512:InvalidChecksum"))
+	assert.False(t, VerifyChecksum(image, "md5:InvalidChecksum"))
+
+	// Test case: The checksum has no algorithm
+	assert.False(t, VerifyChecksum(image, strings.TrimPrefix(sha256, "sha256:")))
+
+	// Test case: The image does not exist
+	assert.False(t, VerifyChecksum(filepath.Join(t.TempDir(), "missing.img"), sha256))
+}
@@ -0,0 +1,213 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The suffix of the file where a download is written until it is complete
+const partialSuffix = ".part"
+
+var (
+	// The number of times a download is retried after a transient failure and
+	// the delay before the first retry, which doubles on each retry
+	downloadRetries    = 5
+	downloadRetryDelay = 2 * time.Second
+	// The time to wait for data before a stalled download is retried
+	downloadStallTimeout = time.Minute
+	// The client used for downloads, which has no overall timeout as the
+	// images take long to download
+	downloadClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+	}
+)
+
+// Progress reports the bytes of a file downloaded so far and the size of the
+// file, which is -1 when the server does not send it
+type Progress func(downloaded, total int64)
+
+// IsPartialDownload checks if the file holds a download that is not complete
+func IsPartialDownload(name string) bool {
+	return strings.HasSuffix(name, partialSuffix)
+}
+
+// DownloadFile streams the file in the URL to the path. The file is written
+// next to the path with the .part suffix and only renamed to the path once
+// complete, so an interrupted download is resumed from where it stopped.
+// Transient failures are retried and the progress is reported when set.
+func DownloadFile(url, path string, progress Progress) error {
+	partial := path + partialSuffix
+
+	var err error
+	for attempt := 0; attempt <= downloadRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(downloadRetryDelay << (attempt - 1))
+		}
+
+		var retry bool
+		retry, err = downloadPart(url, partial, progress)
+		if err == nil {
+			return os.Rename(partial, path)
+		}
+		if !retry {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to download %s after %d attempts: %w", url, downloadRetries+1, err)
+}
+
+// downloadPart downloads the file in the URL to the partial file, from the
+// end of the data it already holds when the server supports ranges.
+// It returns if the download can be retried when it fails.
+func downloadPart(url, partial string, progress Progress) (bool, error) {
+	offset := int64(0)
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	total := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, size := parseContentRange(resp.Header.Get("Content-Range"))
+		if start != offset {
+			os.Remove(partial)
+			return true, fmt.Errorf("the server resumed the download of %s from byte %d instead of %d", url, start, offset)
+		}
+		flags |= os.O_APPEND
+		total = size
+	case resp.StatusCode == http.StatusOK:
+		// The whole file is sent again when the server does not support ranges
+		flags |= os.O_TRUNC
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is complete when the range starts at the end of the file
+		_, size := parseContentRange(resp.Header.Get("Content-Range"))
+		if size == offset {
+			return false, nil
+		}
+		os.Remove(partial)
+		return true, fmt.Errorf("the partial download of %s does not match the file", url)
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("failed to download %s with status %q", url, resp.Status)
+	}
+
+	file, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	// Cancel the request when no data arrives for a while
+	timer := time.AfterFunc(downloadStallTimeout, cancel)
+	defer timer.Stop()
+
+	reader := &progressReader{
+		reader:   resp.Body,
+		read:     offset,
+		total:    total,
+		progress: progress,
+		timer:    timer,
+	}
+	_, err = io.Copy(file, reader)
+	closeErr := file.Close()
+
+	// Only the failures reading from the server can be retried
+	if reader.err != nil {
+		if ctx.Err() != nil {
+			return true, fmt.Errorf("the download of %s stalled for %s", url, downloadStallTimeout)
+		}
+		return true, reader.err
+	}
+	if err != nil {
+		return false, err
+	}
+	if closeErr != nil {
+		return false, closeErr
+	}
+	if total >= 0 && reader.read != total {
+		return true, fmt.Errorf("the download of %s ended after %d of %d bytes", url, reader.read, total)
+	}
+
+	return false, nil
+}
+
+// parseContentRange parses the first byte and the size of the file from the
+// Content-Range header, e.g. bytes 100-199/1000 or bytes */1000, returning -1
+// for the values that are unknown
+func parseContentRange(header string) (int64, int64) {
+	start, size := int64(-1), int64(-1)
+
+	span, total, ok := strings.Cut(strings.TrimPrefix(header, "bytes "), "/")
+	if !ok {
+		return start, size
+	}
+	if first, _, ok := strings.Cut(span, "-"); ok {
+		if n, err := strconv.ParseInt(first, 10, 64); err == nil {
+			start = n
+		}
+	}
+	if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+		size = n
+	}
+
+	return start, size
+}
+
+// progressReader reads a download, reporting its progress and keeping the
+// stall timer from expiring while data arrives
+type progressReader struct {
+	reader   io.Reader
+	read     int64       // Bytes of the file downloaded so far
+	total    int64       // Size of the file, -1 when unknown
+	progress Progress    // Reports the progress, if set
+	timer    *time.Timer // Stall timer reset on each read
+	err      error       // Error reading from the server
+}
+
+// Read reads from the download
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(downloadStallTimeout)
+		r.read += int64(n)
+		if r.progress != nil {
+			r.progress(r.read, r.total)
+		}
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,154 @@
+package netutil
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFileServer serves the content with support for ranges, letting the
+// handler fail the requests, and records the Range header of each request
+func newTestFileServer(t *testing.T, content []byte, fail func(attempt int, w http.ResponseWriter) bool) (*httptest.Server, *[]string) {
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if fail != nil && fail(len(ranges), w) {
+			return
+		}
+		http.ServeContent(w, r, "image.qcow2", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	// Retry without waiting
+	delay := downloadRetryDelay
+	downloadRetryDelay = time.Millisecond
+	t.Cleanup(func() { downloadRetryDelay = delay })
+
+	return server, &ranges
+}
+
+func TestDownloadFile(t *testing.T) {
+	content := []byte(strings.Repeat("machina", 1000))
+	server, ranges := newTestFileServer(t, content, nil)
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+
+	downloaded, total := int64(0), int64(0)
+	err := DownloadFile(server.URL+"/image.qcow2", path, func(d, size int64) { downloaded, total = d, size })
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int64(len(content)), downloaded)
+	assert.Equal(t, int64(len(content)), total)
+	assert.Equal(t, []string{""}, *ranges)
+
+	// Check that the partial file is renamed
+	assert.NoFileExists(t, path+partialSuffix)
+}
+
+func TestDownloadFile_Resume(t *testing.T) {
+	content := []byte(strings.Repeat("machina", 1000))
+	server, ranges := newTestFileServer(t, content, nil)
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+
+	// Test case: The download continues from the end of the partial file
+	assert.NoError(t, os.WriteFile(path+partialSuffix, content[:1000], 0644))
+	err := DownloadFile(server.URL+"/image.qcow2", path, nil)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"bytes=1000-"}, *ranges)
+
+	// Test case: A complete partial file is only renamed
+	*ranges = nil
+	assert.NoError(t, os.Rename(path, path+partialSuffix))
+	err = DownloadFile(server.URL+"/image.qcow2", path, nil)
+	assert.NoError(t, err)
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(content))}, *ranges)
+}
+
+func TestDownloadFile_Retry(t *testing.T) {
+	content := []byte(strings.Repeat("machina", 1000))
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+
+	// Test case: Server errors are retried
+	server, ranges := newTestFileServer(t, content, func(attempt int, w http.ResponseWriter) bool {
+		if attempt < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	err := DownloadFile(server.URL+"/image.qcow2", path, nil)
+	assert.NoError(t, err)
+	assert.Len(t, *ranges, 3)
+
+	// Test case: An interrupted download is resumed
+	server, ranges = newTestFileServer(t, content, func(attempt int, w http.ResponseWriter) bool {
+		if attempt == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:2000])
+			return true
+		}
+		return false
+	})
+	path = filepath.Join(t.TempDir(), "image.qcow2")
+	err = DownloadFile(server.URL+"/image.qcow2", path, nil)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"", "bytes=2000-"}, *ranges)
+
+	// Test case: Client errors are not retried
+	server, ranges = newTestFileServer(t, content, func(attempt int, w http.ResponseWriter) bool {
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	})
+	path = filepath.Join(t.TempDir(), "image.qcow2")
+	err = DownloadFile(server.URL+"/image.qcow2", path, nil)
+	assert.Error(t, err)
+	assert.Len(t, *ranges, 1)
+	assert.NoFileExists(t, path)
+
+	// Test case: The retries run out
+	server, ranges = newTestFileServer(t, content, func(attempt int, w http.ResponseWriter) bool {
+		w.WriteHeader(http.StatusBadGateway)
+		return true
+	})
+	err = DownloadFile(server.URL+"/image.qcow2", path, nil)
+	assert.Error(t, err)
+	assert.Len(t, *ranges, downloadRetries+1)
+	assert.NoFileExists(t, path)
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, size := parseContentRange("bytes 100-199/1000")
+	assert.Equal(t, int64(100), start)
+	assert.Equal(t, int64(1000), size)
+
+	start, size = parseContentRange("bytes */1000")
+	assert.Equal(t, int64(-1), start)
+	assert.Equal(t, int64(1000), size)
+
+	start, size = parseContentRange("bytes 100-199/*")
+	assert.Equal(t, int64(100), start)
+	assert.Equal(t, int64(-1), size)
+
+	start, size = parseContentRange("")
+	assert.Equal(t, int64(-1), start)
+	assert.Equal(t, int64(-1), size)
+}
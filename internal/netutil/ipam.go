@@ -0,0 +1,258 @@
+package netutil
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// The offset of the first address of the network that can be leased,
+	// leaving the lower addresses for the gateway and other services
+	firstLease = 10
+	// The port and time to wait for an address to answer when probing it
+	probePort    = "22"
+	probeTimeout = 300 * time.Millisecond
+	// The file with the host ARP table
+	arpTable = "/proc/net/arp"
+)
+
+// IPAM manages the static IP addresses assigned to the instances.
+// Each lease is stored as a file named after the IP address inside the
+// leases directory and holds the name of the instance that owns it.
+type IPAM struct {
+	dir      string               // Directory where the leases are stored
+	subnet   *net.IPNet           // Network from where the addresses are leased
+	reserved []string             // Addresses in use that have no lease
+	inUse    func(ip string) bool // Checks if an address is answering on the network
+}
+
+// NewIPAM creates a new IP address manager that leases addresses from the
+// network in CIDR notation, stores the leases in the given directory and
+// never hands out any of the reserved addresses
+func NewIPAM(dir, cidr string, reserved []string) (*IPAM, error) {
+	// Parse the network
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() == nil {
+		return nil, errors.New("only IPv4 networks are supported")
+	}
+
+	// Ensure the leases directory exists
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPAM{
+		dir:      dir,
+		subnet:   subnet,
+		reserved: reserved,
+		inUse:    IsAddressInUse,
+	}, nil
+}
+
+// Allocate leases a free IP address to the instance.
+// If the instance already holds a lease, the leased address is returned.
+func (ipam *IPAM) Allocate(name string) (string, error) {
+	// Reuse the existing lease of the instance
+	ip, err := ipam.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if ip != "" {
+		return ip, nil
+	}
+
+	// Go through the addresses of the network, skipping the broadcast address
+	base := binary.BigEndian.Uint32(ipam.subnet.IP.To4())
+	ones, bits := ipam.subnet.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	for offset := uint32(firstLease); offset < size-1; offset++ {
+		ip := uint32ToIP(base + offset).String()
+
+		// Skip the addresses used by other instances
+		if slices.Contains(ipam.reserved, ip) {
+			continue
+		}
+
+		// Skip the addresses already leased
+		lease := filepath.Join(ipam.dir, ip)
+		if _, err := os.Stat(lease); err == nil {
+			continue
+		}
+
+		// Skip the addresses answering on the network
+		if ipam.inUse(ip) {
+			continue
+		}
+
+		// Create the lease, failing if another process has taken it meanwhile
+		f, err := os.OpenFile(lease, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		_, err = f.WriteString(name)
+		if err != nil {
+			f.Close()
+			os.Remove(lease)
+			return "", err
+		}
+
+		return ip, f.Close()
+	}
+
+	return "", errors.New("no IP addresses available")
+}
+
+// Subnet returns the network from where the addresses are leased
+func (ipam *IPAM) Subnet() *net.IPNet {
+	return ipam.subnet
+}
+
+// Lookup returns the IP address leased to the instance or an empty string
+// if the instance holds no lease
+func (ipam *IPAM) Lookup(name string) (string, error) {
+	leases, err := ipam.Leases()
+	if err != nil {
+		return "", err
+	}
+
+	for ip, owner := range leases {
+		if owner == name {
+			return ip, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Leases returns all the leases, indexed by IP address
+func (ipam *IPAM) Leases() (map[string]string, error) {
+	entries, err := os.ReadDir(ipam.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !ValidateIPAddress(entry.Name()) {
+			continue
+		}
+
+		owner, err := os.ReadFile(filepath.Join(ipam.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		leases[entry.Name()] = strings.TrimSpace(string(owner))
+	}
+
+	return leases, nil
+}
+
+// Release removes all the leases held by the instance
+func (ipam *IPAM) Release(name string) error {
+	leases, err := ipam.Leases()
+	if err != nil {
+		return err
+	}
+
+	for ip, owner := range leases {
+		if owner != name {
+			continue
+		}
+		err = os.Remove(filepath.Join(ipam.dir, ip))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsAddressInUse checks if an IP address is answering on the network,
+// either by being present in the host ARP table or by replying to a TCP probe.
+// Only addresses on a network attached to the host, like the bridge, are probed.
+func IsAddressInUse(ip string) bool {
+	if inARPTable(ip) {
+		return true
+	}
+
+	if !isOnLink(ip) {
+		return false
+	}
+
+	// A refused connection still means that a host owns the address
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, probePort), probeTimeout)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+
+	return true
+}
+
+// isOnLink checks if the IP address belongs to a network of one of the host interfaces
+func isOnLink(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inARPTable checks if the host has a resolved ARP entry for the IP address
+//
+//	Example:
+//		IP address       HW type     Flags       HW address            Mask     Device
+//		192.168.122.57   0x1         0x2         52:54:00:6b:3c:58     *        virbr0
+func inARPTable(ip string) bool {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Incomplete entries are flagged with 0x0
+		if len(fields) >= 3 && fields[0] == ip && fields[2] != "0x0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uint32ToIP converts a number to its IPv4 address
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,139 @@
+package netutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCIDR = "192.168.122.0/24"
+
+// newTestIPAM creates an IP address manager that never probes the network
+func newTestIPAM(t *testing.T, reserved ...string) *IPAM {
+	ipam, err := NewIPAM(t.TempDir(), testCIDR, reserved)
+	assert.NoError(t, err)
+	ipam.inUse = func(ip string) bool { return false }
+	return ipam
+}
+
+func TestIPAM_Allocate(t *testing.T) {
+	first := "192.168.122.10"
+	second := "192.168.122.11"
+	third := "192.168.122.12"
+
+	// Test case 1: The first address is reserved by an existing instance
+	ipam := newTestIPAM(t, first)
+	ip, err := ipam.Allocate("machine-1")
+	assert.NoError(t, err)
+	assert.Equal(t, second, ip)
+
+	// Test case 2: Different instances get different addresses
+	ip, err = ipam.Allocate("machine-2")
+	assert.NoError(t, err)
+	assert.Equal(t, third, ip)
+
+	// Test case 3: An instance keeps its leased address
+	ip, err = ipam.Allocate("machine-1")
+	assert.NoError(t, err)
+	assert.Equal(t, second, ip)
+
+	// Test case 4: Addresses answering on the network are skipped
+	ipam.inUse = func(ip string) bool { return ip == "192.168.122.13" }
+	ip, err = ipam.Allocate("machine-3")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.122.14", ip)
+
+	// Test case 5: The leases are stored in the leases directory
+	owner, err := os.ReadFile(filepath.Join(ipam.dir, second))
+	assert.NoError(t, err)
+	assert.Equal(t, "machine-1", string(owner))
+}
+
+func TestIPAM_AllocateSubnet(t *testing.T) {
+	// Test case 1: Addresses are leased from a network larger than /24
+	ipam, err := NewIPAM(t.TempDir(), "10.10.0.0/16", []string{"10.10.0.10"})
+	assert.NoError(t, err)
+	ipam.inUse = func(ip string) bool { return false }
+
+	ip, err := ipam.Allocate("machine")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.10.0.11", ip)
+
+	// Test case 2: The broadcast address of a small network is never leased
+	ipam, err = NewIPAM(t.TempDir(), "10.20.0.0/28", nil)
+	assert.NoError(t, err)
+	ipam.inUse = func(ip string) bool { return false }
+
+	for _, want := range []string{"10.20.0.10", "10.20.0.11", "10.20.0.12", "10.20.0.13", "10.20.0.14"} {
+		ip, err := ipam.Allocate(want)
+		assert.NoError(t, err)
+		assert.Equal(t, want, ip)
+	}
+	_, err = ipam.Allocate("machine")
+	assert.Error(t, err)
+
+	// Test case 3: Invalid and IPv6 networks
+	_, err = NewIPAM(t.TempDir(), "10.20.0.0", nil)
+	assert.Error(t, err)
+	_, err = NewIPAM(t.TempDir(), "fd00::/64", nil)
+	assert.Error(t, err)
+}
+
+func TestIPAM_AllocateExhausted(t *testing.T) {
+	ipam := newTestIPAM(t)
+	ipam.inUse = func(ip string) bool { return true }
+
+	_, err := ipam.Allocate("machine")
+	assert.Error(t, err)
+}
+
+func TestIPAM_Release(t *testing.T) {
+	ipam := newTestIPAM(t)
+
+	ip, err := ipam.Allocate("machine-1")
+	assert.NoError(t, err)
+	_, err = ipam.Allocate("machine-2")
+	assert.NoError(t, err)
+
+	// Release the lease of the first machine
+	err = ipam.Release("machine-1")
+	assert.NoError(t, err)
+
+	leases, err := ipam.Leases()
+	assert.NoError(t, err)
+	assert.Len(t, leases, 1)
+	assert.NotContains(t, leases, ip)
+
+	// The released address is handed out again
+	got, err := ipam.Allocate("machine-3")
+	assert.NoError(t, err)
+	assert.Equal(t, ip, got)
+
+	// Releasing an instance without leases is not an error
+	assert.NoError(t, ipam.Release("unknown"))
+}
+
+func TestInARPTable(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "arp")
+	content := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.122.57   0x1         0x2         52:54:00:6b:3c:58     *        virbr0
+192.168.122.58   0x1         0x0         00:00:00:00:00:00     *        virbr0
+`
+	assert.NoError(t, os.WriteFile(table, []byte(content), 0644))
+
+	original := arpTable
+	arpTable = table
+	defer func() { arpTable = original }()
+
+	assert.True(t, inARPTable("192.168.122.57"))
+	assert.False(t, inARPTable("192.168.122.58"))
+	assert.False(t, inARPTable("192.168.122.59"))
+}
+
+func TestIsOnLink(t *testing.T) {
+	assert.True(t, isOnLink("127.0.0.1"))
+	assert.False(t, isOnLink("203.0.113.10"))
+	assert.False(t, isOnLink("invalid"))
+}
@@ -2,35 +2,46 @@ package netutil
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	rnd "math/rand"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/enkodr/machina/internal/config"
 	"github.com/enkodr/machina/internal/imgutil"
 )
 
+// Network is the cloud-init network configuration, with the ethernet
+// interfaces indexed by their name
 type Network struct {
-	Ethernets Ethernets `yaml:"ethernets"`
-	Version   int       `yaml:"version"`
+	Ethernets map[string]*Ethernet `yaml:"ethernets"`
+	Version   int                  `yaml:"version"`
 }
 
-type Ethernets struct {
-	VirtNet VirtNet `yaml:"virtnet"`
-}
-
-type VirtNet struct {
+// Ethernet holds the configuration of an ethernet interface
+type Ethernet struct {
 	Name        string      `yaml:"set-name"`
-	Addresses   []string    `yaml:"addresses"`
+	Addresses   []string    `yaml:"addresses,omitempty"`
 	DHCP4       bool        `yaml:"dhcp4"`
-	Gateway4    string      `yaml:"gateway4"`
+	Gateway4    string      `yaml:"gateway4,omitempty"`
 	Match       Match       `yaml:"match"`
-	Nameservers Nameservers `yaml:"nameservers"`
+	Nameservers Nameservers `yaml:"nameservers,omitempty"`
+}
+
+// Interface holds the settings of an additional network interface
+type Interface struct {
+	Name       string   // Name of the interface inside the instance
+	MacAddress string   // MAC address of the interface, generated when empty
+	Address    string   // Static IP address in CIDR notation, DHCP is used when empty
+	Gateway    string   // Gateway of the interface
+	DNS        []string // DNS servers
+	Search     []string // DNS search domains
 }
 
 // Match is used to match the MAC address of the interface
@@ -40,34 +51,173 @@ type Match struct {
 
 // Nameservers is used to set the DNS servers
 type Nameservers struct {
-	Addresses []string `yaml:"addresses"`
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
 }
 
-var (
-	// The IP range to use for the virtual network
-	ipRange = "192.168.122"
-	// The DNS servers to use
-	nameservers = []string{"1.1.1.1", "8.8.8.8"}
-)
+// The name of the primary interface of the instances
+const PrimaryInterface = "virtnet"
 
-// NewNetwork creates a new network
-func NewNetwork() *Network {
-	net := &Network{}
-	// Generate a random IP address
-	ipAddress := GenerateIPAddress()
-	// Get the gateway address from the IP address
-	gwAddress, _ := GetGatewayFromIP(ipAddress)
+// NewNetwork creates a new network for the instance with an IP address
+// allocated from the IP address manager and the given network settings
+func NewNetwork(ipam *IPAM, name string, settings config.Network) (*Network, error) {
+	net := &Network{Ethernets: map[string]*Ethernet{}}
+	// Allocate the IP address
+	ipAddress, err := ipam.Allocate(name)
+	if err != nil {
+		return nil, err
+	}
+	// Use the first address of the network as gateway if none is set
+	gwAddress := settings.Gateway
+	if gwAddress == "" {
+		gwAddress = GetFirstHost(ipam.Subnet())
+	}
 	// Generate a random MAC address
 	macAddress, _ := RandomMacAddress()
 	// Set the network properties
+	ones, _ := ipam.Subnet().Mask.Size()
 	net.Version = 2
-	net.Ethernets.VirtNet.Name = "virtnet"
-	net.Ethernets.VirtNet.Addresses = append(net.Ethernets.VirtNet.Addresses, fmt.Sprintf("%s/24", ipAddress))
-	net.Ethernets.VirtNet.Gateway4 = gwAddress
-	net.Ethernets.VirtNet.DHCP4 = false
-	net.Ethernets.VirtNet.Match.MacAddress = macAddress
-	net.Ethernets.VirtNet.Nameservers.Addresses = append(net.Ethernets.VirtNet.Nameservers.Addresses, nameservers...)
-	return net
+	net.Ethernets[PrimaryInterface] = &Ethernet{
+		Name:      PrimaryInterface,
+		Addresses: []string{fmt.Sprintf("%s/%d", ipAddress, ones)},
+		Gateway4:  gwAddress,
+		DHCP4:     false,
+		Match:     Match{MacAddress: macAddress},
+		Nameservers: Nameservers{
+			Addresses: settings.DNS,
+			Search:    settings.Search,
+		},
+	}
+	return net, nil
+}
+
+// NewUserNetwork creates a new network for an instance attached to the
+// user-mode network of the hypervisor, where the primary interface gets its
+// address, gateway and DNS servers from the DHCP server of the hypervisor
+func NewUserNetwork(settings config.Network) *Network {
+	// Generate a random MAC address
+	macAddress, _ := RandomMacAddress()
+	return &Network{
+		Version: 2,
+		Ethernets: map[string]*Ethernet{
+			PrimaryInterface: {
+				Name:  PrimaryInterface,
+				DHCP4: true,
+				Match: Match{MacAddress: macAddress},
+				Nameservers: Nameservers{
+					Search: settings.Search,
+				},
+			},
+		},
+	}
+}
+
+// Primary returns the primary interface of the network
+func (net *Network) Primary() *Ethernet {
+	return net.Ethernets[PrimaryInterface]
+}
+
+// AddInterface adds an ethernet interface to the network and returns its
+// MAC address. The interface uses DHCP unless a static address is set.
+func (net *Network) AddInterface(iface Interface) (string, error) {
+	// Check if the name is unique
+	if _, ok := net.Ethernets[iface.Name]; ok || iface.Name == "" {
+		return "", fmt.Errorf("invalid or duplicated interface name %q", iface.Name)
+	}
+
+	// Generate a random MAC address if none is set
+	if iface.MacAddress == "" {
+		iface.MacAddress, _ = RandomMacAddress()
+	}
+
+	eth := &Ethernet{
+		Name:  iface.Name,
+		DHCP4: iface.Address == "",
+		Match: Match{MacAddress: iface.MacAddress},
+		Nameservers: Nameservers{
+			Addresses: iface.DNS,
+			Search:    iface.Search,
+		},
+	}
+
+	// Set the static address
+	if iface.Address != "" {
+		if _, err := GetIPFromNetworkAddress(iface.Address); err != nil {
+			return "", err
+		}
+		eth.Addresses = []string{iface.Address}
+		eth.Gateway4 = iface.Gateway
+	}
+
+	net.Ethernets[iface.Name] = eth
+	return iface.MacAddress, nil
+}
+
+// FreePort returns a port of the protocol, tcp or udp, that is free on the
+// host address and is not one of the used ports
+func FreePort(protocol, address string, used []int) (int, error) {
+	for range 100 {
+		var port int
+		switch protocol {
+		case "tcp":
+			listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+			if err != nil {
+				return 0, err
+			}
+			port = listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+		case "udp":
+			conn, err := net.ListenPacket("udp", net.JoinHostPort(address, "0"))
+			if err != nil {
+				return 0, err
+			}
+			port = conn.LocalAddr().(*net.UDPAddr).Port
+			conn.Close()
+		default:
+			return 0, fmt.Errorf("invalid protocol %q", protocol)
+		}
+
+		if !slices.Contains(used, port) {
+			return port, nil
+		}
+	}
+
+	return 0, errors.New("no free port found")
+}
+
+// CheckPort checks that the port of the protocol, tcp or udp, can be bound
+// on the host address
+func CheckPort(protocol, address string, port int) error {
+	hostPort := net.JoinHostPort(address, strconv.Itoa(port))
+	switch protocol {
+	case "tcp":
+		listener, err := net.Listen("tcp", hostPort)
+		if err != nil {
+			return err
+		}
+		return listener.Close()
+	case "udp":
+		conn, err := net.ListenPacket("udp", hostPort)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		return fmt.Errorf("invalid protocol %q", protocol)
+	}
+}
+
+// GetFirstHost returns the first host address of a network
+//
+//	Example:
+//		Network: 192.168.122.0/24
+//		Host:    192.168.122.1
+func GetFirstHost(subnet *net.IPNet) string {
+	ip := subnet.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	return uint32ToIP(binary.BigEndian.Uint32(ip) + 1).String()
 }
 
 // getGatewayFromIP will return the gateway from the IPv4 addres
@@ -105,17 +255,6 @@ func RandomMacAddress() (string, error) {
 	return mac, nil
 }
 
-// Generate a random IP address
-func GenerateIPAddress() string {
-	rnd.New(rnd.NewSource(0))
-
-	min := 10
-	max := 254
-	octet := rnd.Intn(max-min) + min
-	return fmt.Sprintf("%s.%d", ipRange, octet)
-
-}
-
 // Download fetches a file from the internet
 func Download(url string) ([]byte, error) {
 	// Get the data
@@ -133,28 +272,15 @@ func Download(url string) ([]byte, error) {
 
 }
 
-// Download fetches a file from the internet
+// DownloadAndSave downloads the file in the URL to the destination directory
 func DownloadAndSave(url, destination string) error {
-	// Get the data
-	data, err := Download(url)
-	if err != nil {
-		return err
-	}
-
 	// get the filename from the URl
 	fileName, err := imgutil.GetFilenameFromURL(url)
 	if err != nil {
 		return err
 	}
 
-	// Create the file
-	err = os.WriteFile(filepath.Join(destination, fileName), data, 0644)
-	if err != nil {
-		return err
-	}
-
-	return nil
-
+	return DownloadFile(url, filepath.Join(destination, fileName), nil)
 }
 
 // GetIPFromNetworkAddress returns the IP address from a network address
@@ -3,43 +3,181 @@ package netutil
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/enkodr/machina/internal/config"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestNewNetwork(t *testing.T) {
+	ipam := newTestIPAM(t)
+
+	settings := config.DefaultNetwork()
+	settings.Gateway = ""
+	settings.Search = []string{"lab.internal"}
+
 	// Test case 1: Not nill
-	net := NewNetwork()
+	net, err := NewNetwork(ipam, "test-machine", settings)
+	assert.NoError(t, err)
 	assert.NotNil(t, net)
 
 	// Test case 2: Valid Data
 	// Check that the interface has the expected name
-	assert.Equal(t, "virtnet", net.Ethernets.VirtNet.Name)
+	assert.Equal(t, "virtnet", net.Primary().Name)
 
 	// Check that the interface has the expected IP address and subnet mask
-	got := net.Ethernets.VirtNet.Addresses[0]
-	want := ipRange
-	assert.True(t, strings.Contains(got, want))
+	got := net.Primary().Addresses[0]
+	assert.True(t, strings.HasPrefix(got, "192.168.122."))
+	assert.True(t, strings.HasSuffix(got, "/24"))
 
 	// Check that the interface has the expected gateway address
-	baseIp := strings.Split(net.Ethernets.VirtNet.Addresses[0], "/")[0]
-	want, _ = GetGatewayFromIP(baseIp)
-	got = net.Ethernets.VirtNet.Gateway4
+	baseIp := strings.Split(net.Primary().Addresses[0], "/")[0]
+	want, _ := GetGatewayFromIP(baseIp)
+	got = net.Primary().Gateway4
 	assert.Equal(t, want, got)
 
 	// Check that DHCP is disabled
-	assert.False(t, net.Ethernets.VirtNet.DHCP4)
+	assert.False(t, net.Primary().DHCP4)
 
 	// Check that the interface has a random MAC address
-	assert.NotEmpty(t, net.Ethernets.VirtNet.Match.MacAddress)
+	assert.NotEmpty(t, net.Primary().Match.MacAddress)
 
 	// Check that the interface has the expected nameserver addresses
-	assert.Equal(t, nameservers, net.Ethernets.VirtNet.Nameservers.Addresses)
+	assert.Equal(t, settings.DNS, net.Primary().Nameservers.Addresses)
+	assert.Equal(t, settings.Search, net.Primary().Nameservers.Search)
+
+	// Test case 3: The address is leased to the instance
+	ip, err := ipam.Lookup("test-machine")
+	assert.NoError(t, err)
+	assert.Equal(t, baseIp, ip)
+}
+
+func TestNewNetworkSettings(t *testing.T) {
+	ipam, err := NewIPAM(t.TempDir(), "10.10.0.0/16", nil)
+	assert.NoError(t, err)
+	ipam.inUse = func(ip string) bool { return false }
+
+	settings := config.Network{
+		CIDR:    "10.10.0.0/16",
+		Gateway: "10.10.0.254",
+		DNS:     []string{"10.10.0.53"},
+	}
+	net, err := NewNetwork(ipam, "test-machine", settings)
+	assert.NoError(t, err)
+
+	// Check that the settings are used
+	assert.Equal(t, []string{"10.10.0.10/16"}, net.Primary().Addresses)
+	assert.Equal(t, "10.10.0.254", net.Primary().Gateway4)
+	assert.Equal(t, []string{"10.10.0.53"}, net.Primary().Nameservers.Addresses)
+	assert.Empty(t, net.Primary().Nameservers.Search)
+}
+
+func TestNewUserNetwork(t *testing.T) {
+	settings := config.DefaultNetwork()
+	settings.Search = []string{"lab.internal"}
+	net := NewUserNetwork(settings)
+
+	// Check that the primary interface uses DHCP
+	assert.Equal(t, "virtnet", net.Primary().Name)
+	assert.True(t, net.Primary().DHCP4)
+	assert.Empty(t, net.Primary().Addresses)
+	assert.Empty(t, net.Primary().Gateway4)
+	assert.NotEmpty(t, net.Primary().Match.MacAddress)
+
+	// Check that the DNS servers of the bridge network are not used
+	assert.Empty(t, net.Primary().Nameservers.Addresses)
+	assert.Equal(t, settings.Search, net.Primary().Nameservers.Search)
+}
+
+func TestFreePort(t *testing.T) {
+	// Test case 1: TCP port that can be listened on
+	port, err := FreePort("tcp", "127.0.0.1", nil)
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+	listener.Close()
+
+	// Test case 2: UDP port
+	port, err = FreePort("udp", "127.0.0.1", nil)
+	assert.NoError(t, err)
+	assert.NotZero(t, port)
+
+	// Test case 3: Invalid protocol
+	_, err = FreePort("sctp", "127.0.0.1", nil)
+	assert.Error(t, err)
+}
+
+func TestCheckPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Test case 1: The port is held by another listener
+	assert.Error(t, CheckPort("tcp", "127.0.0.1", port))
+
+	// Test case 2: The port is free
+	listener.Close()
+	assert.NoError(t, CheckPort("tcp", "127.0.0.1", port))
+
+	// Test case 3: Invalid protocol
+	assert.Error(t, CheckPort("sctp", "127.0.0.1", port))
+}
+
+func TestNetwork_AddInterface(t *testing.T) {
+	net, err := NewNetwork(newTestIPAM(t), "test-machine", config.DefaultNetwork())
+	assert.NoError(t, err)
+
+	// Test case 1: Interface with a static address
+	mac, err := net.AddInterface(Interface{
+		Name:    "lan",
+		Address: "10.0.0.5/24",
+		Gateway: "10.0.0.1",
+		DNS:     []string{"10.0.0.53"},
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, mac)
+	lan := net.Ethernets["lan"]
+	assert.Equal(t, []string{"10.0.0.5/24"}, lan.Addresses)
+	assert.Equal(t, "10.0.0.1", lan.Gateway4)
+	assert.False(t, lan.DHCP4)
+	assert.Equal(t, mac, lan.Match.MacAddress)
+
+	// Test case 2: Interface using DHCP keeps the given MAC address
+	mac, err = net.AddInterface(Interface{Name: "wan", MacAddress: "52:54:00:aa:bb:cc", Gateway: "10.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "52:54:00:aa:bb:cc", mac)
+	wan := net.Ethernets["wan"]
+	assert.True(t, wan.DHCP4)
+	assert.Empty(t, wan.Addresses)
+	assert.Empty(t, wan.Gateway4)
+
+	// Test case 3: Duplicated, empty names and invalid addresses are rejected
+	_, err = net.AddInterface(Interface{Name: PrimaryInterface})
+	assert.Error(t, err)
+	_, err = net.AddInterface(Interface{})
+	assert.Error(t, err)
+	_, err = net.AddInterface(Interface{Name: "dmz", Address: "10.0.0.5"})
+	assert.Error(t, err)
+
+	// Test case 4: The DHCP interfaces are rendered without addresses
+	data, err := yaml.Marshal(net)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "    wan:\n        set-name: wan\n        dhcp4: true\n        match:\n            macaddress: 52:54:00:aa:bb:cc\n")
+}
+
+func TestGetFirstHost(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/16")
+	assert.Equal(t, "10.10.0.1", GetFirstHost(subnet))
+
+	_, subnet, _ = net.ParseCIDR("fd00::/64")
+	assert.Equal(t, "", GetFirstHost(subnet))
 }
 
 func TestGetGatewayFromIP(t *testing.T) {
@@ -68,13 +206,6 @@ func TestValidateIPAddress(t *testing.T) {
 	}
 }
 
-func TestGenerateIpAddress(t *testing.T) {
-	ip := GenerateIPAddress()
-	if !ValidateIPAddress(ip) {
-		t.Errorf("failed to generate IP address")
-	}
-}
-
 func TestRandomMacAddress(t *testing.T) {
 	// Test Case 1: Unable to generate MacAddress
 	_, err := RandomMacAddress()
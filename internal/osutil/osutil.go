@@ -1,14 +1,16 @@
 package osutil
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
+	"fmt"
 	"hash"
 	"io"
 	"os"
 	"os/exec"
-	"strings"
 )
 
 type Runner interface {
@@ -60,6 +62,11 @@ func (c CommandRunner) RunCommand(command string, args []string, options ...Opti
 	cmd.Stdout = opts.stdout
 	cmd.Stderr = opts.stderr
 
+	// The output is streamed instead of returned when stdout is set
+	if opts.stdout != nil {
+		return "", cmd.Run()
+	}
+
 	output, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -68,33 +75,65 @@ func (c CommandRunner) RunCommand(command string, args []string, options ...Opti
 	return string(output), nil
 }
 
-// Checksum checks if the checksum of a file matches the specified checksum
-func Checksum(path, checksum string) bool {
-	var hasher hash.Hash
-	// Split the checksum into the algorithm and the hash
-	sha := strings.Split(checksum, ":")
-	// Return false if the algorithm is not specified
-	if len(sha) == 1 {
-		return false
+// CopyFile copies the content and permissions of the file in src to dst
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
 
-	// Select the correct halgorithm based on the
-	switch sha[0] {
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// FileDigest hashes the content of the file, read as a stream, with the md5,
+// sha1, sha224, sha256, sha384 or sha512 algorithm and returns it in the
+// format 'algorithm:hash'
+func FileDigest(path, algorithm string) (string, error) {
+	var hasher hash.Hash
+	switch algorithm {
+	case "md5":
+		hasher = md5.New()
+	case "sha1":
+		hasher = sha1.New()
+	case "sha224":
+		hasher = sha256.New224()
 	case "sha256":
 		hasher = sha256.New()
+	case "sha384":
+		hasher = sha512.New384()
 	case "sha512":
 		hasher = sha512.New()
 	default:
-		return false
+		return "", fmt.Errorf("unsupported checksum algorithm %q", algorithm)
 	}
 
-	// Get the hash from the file
-	s, err := os.ReadFile(path)
-	hasher.Write(s)
+	f, err := os.Open(path)
 	if err != nil {
-		return false
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", err
 	}
 
-	// Check and return if the match
-	return sha[1] == hex.EncodeToString(hasher.Sum(nil))
+	return algorithm + ":" + hex.EncodeToString(hasher.Sum(nil)), nil
 }
@@ -2,11 +2,10 @@ package osutil
 
 import (
 	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/hex"
-	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -29,6 +28,18 @@ func TestCommandRunner_RunCommand(t *testing.T) {
 	}
 }
 
+func TestCommandRunner_RunCommandWithStdout(t *testing.T) {
+	runner := CommandRunner{}
+	var stdout, stderr strings.Builder
+
+	output, err := runner.RunCommand("sh", []string{"-c", "echo out; echo err >&2"}, WithStdout(&stdout), WithStderr(&stderr))
+
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+}
+
 func TestCommandRunner_RunNonExisingCommand(t *testing.T) {
 	runner := CommandRunner{}
 	command := "nonexistent"
@@ -54,74 +65,6 @@ func TestCommandRunner_RunCommandNonExistingFile(t *testing.T) {
 	assert.Error(t, err, "Expected an error, got nil")
 }
 
-func TestChecksum(t *testing.T) {
-	// Create a temporary file for testing
-	fileContent := []byte("Test file content")
-	tmpFile, err := ioutil.TempFile("", "testfile")
-	assert.Nil(t, err)
-	tmpFilePath := tmpFile.Name()
-	defer os.Remove(tmpFilePath)
-	defer tmpFile.Close()
-	_, err = tmpFile.Write(fileContent)
-	assert.Nil(t, err)
-
-	// Test case with a matching SHA256 checksum
-	checksum := "sha256:" + sha256Checksum(fileContent)
-	result := Checksum(tmpFilePath, checksum)
-	assert.True(t, result)
-
-	// Test case with a non-matching SHA256 checksum
-	checksum = "sha256:InvalidChecksum"
-	result = Checksum(tmpFilePath, checksum)
-	assert.False(t, result)
-
-	// Test case with an unsupported algorithm (MD5)
-	checksum = "md5:InvalidChecksum"
-	result = Checksum(tmpFilePath, checksum)
-	assert.False(t, result)
-
-	// Test case with an invalid checksum format
-	checksum = "InvalidChecksum"
-	result = Checksum(tmpFilePath, checksum)
-	assert.False(t, result)
-
-	// Test case with a non-existing file
-	nonExistingFilePath := "/path/to/nonexistingfile"
-	checksum = "sha256:" + sha256Checksum(fileContent)
-	result = Checksum(nonExistingFilePath, checksum)
-	assert.False(t, result)
-
-	// Test case with a matching SHA512 checksum
-	checksum = "sha512:" + sha512Checksum(fileContent)
-	result = Checksum(tmpFilePath, checksum)
-	assert.True(t, result)
-
-	// Test case with a non-matching SHA512 checksum
-	checksum = "sha512:InvalidChecksum"
-	result = Checksum(tmpFilePath, checksum)
-	assert.False(t, result)
-}
-
-// Helper function to calculate SHA256 checksum
-func sha256Checksum(data []byte) string {
-	// Calculate the SHA256 hash of the image data
-	hasher := sha256.New()
-	hasher.Write(data)
-
-	// Return the SHA256 checksum
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
-// Helper function to calculate SHA512 checksum
-func sha512Checksum(data []byte) string {
-	// Calculate the SHA512 hash of the image data
-	hasher := sha512.New()
-	hasher.Write(data)
-
-	// Return the SHA512 checksum
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
 // MockRunner is a mock implementation of the Runner interface.
 type MockRunner struct {
 	Command string
@@ -141,50 +84,55 @@ func (m *MockRunner) RunCommand(command string, args []string, options ...Option
 	return m.Output, m.Error
 }
 
-func TestChecksumWithValidChecksum(t *testing.T) {
-	// Create a temporary file for testing
-	tmpFile := createTempFile(t, "Hello, World!")
-
-	// Calculate the SHA256 checksum of the file
-	hash := sha256.New()
-	hash.Write([]byte("Hello, World!"))
-	checksum := "sha256:" + hex.EncodeToString(hash.Sum(nil))
-
-	// Verify the checksum
-	result := Checksum(tmpFile, checksum)
-
-	// Assert that the result is true
-	assert.True(t, result, "Expected checksum verification to pass")
-}
-
-func TestChecksumWithInvalidChecksum(t *testing.T) {
-	// Create a temporary file for testing
-	tmpFile := createTempFile(t, "Hello, World!")
+func TestCopyFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	dst := filepath.Join(tmpDir, "dst")
+	err := os.WriteFile(src, []byte("Test file content"), 0600)
+	assert.NoError(t, err)
+
+	// Test case with an existing file
+	err = CopyFile(src, dst)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "Test file content", string(data))
+	info, err := os.Stat(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
 
-	// Specify an incorrect checksum
-	incorrectChecksum := "sha256:123456789"
-
-	// Verify the checksum
-	result := Checksum(tmpFile, incorrectChecksum)
-
-	// Assert that the result is false
-	assert.False(t, result, "Expected checksum verification to fail")
+	// Test case with a non-existing file
+	err = CopyFile(filepath.Join(tmpDir, "nonexistent"), dst)
+	assert.Error(t, err)
 }
 
-func createTempFile(t *testing.T, content string) string {
-	// Create a temporary file for testing
-	tmpFile, err := ioutil.TempFile("", "tempfile")
-	if err != nil {
-		t.Fatal("Failed to create temporary file:", err)
+func TestFileDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	err := os.WriteFile(path, []byte("Test file content"), 0600)
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256([]byte("Test file content"))
+	digest, err := FileDigest(path, "sha256")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), digest)
+
+	// Test case with the algorithms of legacy mirrors
+	for algorithm, want := range map[string]string{
+		"md5":    "ac79653edeb65ab5563585f2d5f14fe9",
+		"sha1":   "3cddd3926cbb2787afc183c6da2b1d56161416af",
+		"sha224": "e46b6d2d99362ba9df4ca050567fe50d49e88ba3f8ff60ee35ccdd56",
+		"sha384": "3b70ccc8412e3e5de828fb15aa94624161553a78565a0777a12ce85ea26e97ec94936880c45cb24af0b87ed0a872353e",
+	} {
+		digest, err := FileDigest(path, algorithm)
+		assert.NoError(t, err)
+		assert.Equal(t, algorithm+":"+want, digest)
 	}
 
-	// defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
-
-	// Write the content to the temporary file
-	_, err = io.WriteString(tmpFile, content)
-	assert.Nil(t, err)
+	// Test case with an unsupported algorithm
+	_, err = FileDigest(path, "crc32")
+	assert.Error(t, err)
 
-	// Return the path to the temporary file
-	return tmpFile.Name()
+	// Test case with a non-existing file
+	_, err = FileDigest(filepath.Join(t.TempDir(), "nonexistent"), "sha256")
+	assert.Error(t, err)
 }
@@ -0,0 +1,181 @@
+package qmputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// The time to wait for the connection and for each command to reply
+	timeout = 5 * time.Second
+)
+
+// Client is a client of the QEMU Machine Protocol (QMP) over a unix socket
+type Client struct {
+	conn    net.Conn
+	decoder *json.Decoder
+	encoder *json.Encoder
+}
+
+// Error is an error returned by QEMU for a command
+type Error struct {
+	Class string `json:"class"` // Class of the error, like GenericError
+	Desc  string `json:"desc"`  // Description of the error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// Status holds the run state of the machine
+type Status struct {
+	Status  string `json:"status"`  // Run state of the machine, like running, paused or shutdown
+	Running bool   `json:"running"` // Whether the CPUs of the machine are running
+}
+
+// MigrationStatus holds the progress of the outgoing migration
+type MigrationStatus struct {
+	Status    string `json:"status"`     // Status of the migration, like active, completed or failed
+	ErrorDesc string `json:"error-desc"` // Description of the error when the migration failed
+}
+
+// command is a command sent to QEMU
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+// response is a reply or an asynchronous event sent by QEMU
+type response struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event  string          `json:"event"`
+}
+
+// Dial connects to the QMP socket and negotiates the capabilities,
+// leaving the connection ready to run commands
+func Dial(socket string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+		encoder: json.NewEncoder(conn),
+	}
+
+	// Read the greeting sent by QEMU when connecting
+	conn.SetDeadline(time.Now().Add(timeout))
+	greeting := map[string]json.RawMessage{}
+	err = c.decoder.Decode(&greeting)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, ok := greeting["QMP"]; !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+
+	// Leave the capabilities negotiation mode
+	err = c.Execute("qmp_capabilities", nil, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Execute runs the command with the arguments and decodes its return value into result.
+// The events received while waiting for the reply are discarded.
+func (c *Client) Execute(name string, arguments any, result any) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	err := c.encoder.Encode(command{Execute: name, Arguments: arguments})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res := response{}
+		err := c.decoder.Decode(&res)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case res.Event != "":
+			continue
+		case res.Error != nil:
+			return res.Error
+		case result == nil:
+			return nil
+		default:
+			return json.Unmarshal(res.Return, result)
+		}
+	}
+}
+
+// QueryStatus returns the run state of the machine
+func (c *Client) QueryStatus() (Status, error) {
+	status := Status{}
+	err := c.Execute("query-status", nil, &status)
+	return status, err
+}
+
+// SystemPowerdown requests the guest to power down, like pressing the power button
+func (c *Client) SystemPowerdown() error {
+	return c.Execute("system_powerdown", nil, nil)
+}
+
+// SystemReset resets the machine, like pressing the reset button
+func (c *Client) SystemReset() error {
+	return c.Execute("system_reset", nil, nil)
+}
+
+// Quit stops the machine immediately, exiting QEMU
+func (c *Client) Quit() error {
+	return c.Execute("quit", nil, nil)
+}
+
+// Stop pauses the CPUs of the machine
+func (c *Client) Stop() error {
+	return c.Execute("stop", nil, nil)
+}
+
+// Cont resumes the CPUs of the paused machine
+func (c *Client) Cont() error {
+	return c.Execute("cont", nil, nil)
+}
+
+// Migrate starts migrating the state of the machine to the URI, like
+// exec:cat > file, which runs in the background
+func (c *Client) Migrate(uri string) error {
+	return c.Execute("migrate", map[string]string{"uri": uri}, nil)
+}
+
+// QueryMigrate returns the progress of the outgoing migration
+func (c *Client) QueryMigrate() (MigrationStatus, error) {
+	status := MigrationStatus{}
+	err := c.Execute("query-migrate", nil, &status)
+	return status, err
+}
+
+// HumanMonitorCommand runs a command of the human monitor, which has no QMP
+// equivalent, and returns its output. The human monitor reports most of the
+// errors in the output instead of failing the command.
+func (c *Client) HumanMonitorCommand(commandLine string) (string, error) {
+	output := ""
+	err := c.Execute("human-monitor-command", map[string]string{"command-line": commandLine}, &output)
+	return output, err
+}
@@ -0,0 +1,129 @@
+package qmputil
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer starts a fake QMP server that replies to the commands with the
+// given responses and returns the path of its socket and the received commands
+func startServer(t *testing.T, replies map[string]string) (string, *[]string) {
+	socket := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := []string{}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintln(conn, `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}}, "capabilities": []}}`)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			cmd := command{}
+			json.Unmarshal(scanner.Bytes(), &cmd)
+			received = append(received, cmd.Execute)
+
+			reply, ok := replies[cmd.Execute]
+			if !ok {
+				reply = `{"return": {}}`
+			}
+			fmt.Fprintln(conn, reply)
+		}
+	}()
+
+	return socket, &received
+}
+
+func TestDial(t *testing.T) {
+	socket, received := startServer(t, nil)
+
+	client, err := Dial(socket)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, []string{"qmp_capabilities"}, *received)
+
+	// Test case: The socket does not exist
+	_, err = Dial(filepath.Join(t.TempDir(), "missing.sock"))
+	assert.Error(t, err)
+}
+
+func TestClient_QueryStatus(t *testing.T) {
+	socket, _ := startServer(t, map[string]string{
+		// The events sent before the reply are discarded
+		"query-status": `{"event": "RESUME", "data": {}, "timestamp": {"seconds": 1, "microseconds": 0}}
+{"return": {"status": "running", "singlestep": false, "running": true}}`,
+	})
+
+	client, err := Dial(socket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	status, err := client.QueryStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, Status{Status: "running", Running: true}, status)
+}
+
+func TestClient_Commands(t *testing.T) {
+	socket, received := startServer(t, map[string]string{
+		"cont": `{"error": {"class": "GenericError", "desc": "Resetting the Virtual Machine is required"}}`,
+	})
+
+	client, err := Dial(socket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.NoError(t, client.SystemPowerdown())
+	assert.NoError(t, client.SystemReset())
+	assert.NoError(t, client.Stop())
+
+	// Test case: QEMU returns an error
+	err = client.Cont()
+	qmpErr := &Error{}
+	assert.ErrorAs(t, err, &qmpErr)
+	assert.Equal(t, "GenericError", qmpErr.Class)
+
+	assert.NoError(t, client.Quit())
+	assert.Equal(t, []string{"qmp_capabilities", "system_powerdown", "system_reset", "stop", "cont", "quit"}, *received)
+}
+
+func TestClient_HumanMonitorCommand(t *testing.T) {
+	socket, received := startServer(t, map[string]string{
+		"human-monitor-command": `{"return": "Could not set up host forwarding rule\r\n"}`,
+	})
+
+	client, err := Dial(socket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	output, err := client.HumanMonitorCommand("hostfwd_add virtnet tcp:127.0.0.1:8080-:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "Could not set up host forwarding rule\r\n", output)
+	assert.Equal(t, []string{"qmp_capabilities", "human-monitor-command"}, *received)
+}
+
+func TestClient_Migrate(t *testing.T) {
+	socket, received := startServer(t, map[string]string{
+		"query-migrate": `{"return": {"status": "failed", "error-desc": "Unable to write to command"}}`,
+	})
+
+	client, err := Dial(socket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.NoError(t, client.Migrate("exec:cat > /tmp/state.sav"))
+	status, err := client.QueryMigrate()
+	assert.NoError(t, err)
+	assert.Equal(t, MigrationStatus{Status: "failed", ErrorDesc: "Unable to write to command"}, status)
+	assert.Equal(t, []string{"qmp_capabilities", "migrate", "query-migrate"}, *received)
+}
@@ -5,23 +5,45 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
 )
 
 var (
 	bitSize = 2048
 	port    = "22"
+	// The time to wait for the connection to be established
+	timeout = 10 * time.Second
 )
 
+// ErrNoExitStatus is returned when the connection is closed before the
+// command returns its exit status, like when the machine is shut down
+var ErrNoExitStatus = errors.New("the command exited without an exit status")
+
 // SSHClient is a wrapper around the ssh.Client
 type SSHClient struct {
 	conn   *ssh.Client
 	config *ssh.ClientConfig
+	agent  net.Conn   // Connection to the SSH agent used to authenticate
+	jump   *SSHClient // Client of the host the connection goes through
 }
 
+// The private keys of the user tried by default, like ssh does
+var identityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
 // GenerateNewSSHKeys generates a new SSH key pair
 func GenerateNewSSHKeys() ([]byte, []byte, error) {
 	// Generate private key
@@ -53,18 +75,401 @@ func GenerateNewSSHKeys() ([]byte, []byte, error) {
 	return privateKeyPEM, publicKeyBytes, nil
 }
 
-// Check if host is responding
-func IsResponding(ip string) bool {
+// NewSSHClient creates a client that authenticates the user with the private key in PEM format.
+// As the machines get a new host key on every creation, the host key is not verified.
+func NewSSHClient(username string, privateKey []byte) (*SSHClient, error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHClient{
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         timeout,
+		},
+	}, nil
+}
+
+// NewHostClient creates a client for a remote host that authenticates the
+// user, or the current user when empty, with the keys of the SSH agent and the
+// unencrypted default keys of the user. Unlike the machines, the host key is
+// verified against the known_hosts file of the user.
+func NewHostClient(username string) (*SSHClient, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+
+	hostKeyCallback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("loading the known hosts: %w", err)
+	}
+
+	// Use the keys of the agent, when running, followed by the default keys
+	client := &SSHClient{}
+	var signers []ssh.Signer
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		client.agent, err = net.Dial("unix", socket)
+		if err == nil {
+			agentSigners, _ := agent.NewClient(client.agent).Signers()
+			signers = append(signers, agentSigners...)
+		}
+	}
+	for _, name := range identityFiles {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		client.Close()
+		return nil, errors.New("no SSH keys found in the SSH agent or in ~/.ssh")
+	}
+
+	client.config = &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}
+	return client, nil
+}
+
+// Connect opens the connection to the address of the host, using the
+// default SSH port when the address has no port
+func (c *SSHClient) Connect(address string) error {
+	conn, err := ssh.Dial("tcp", withPort(address), c.config)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	return nil
+}
+
+// ConnectThrough opens the connection to the address of the host through the
+// connection of the jump host, which is closed along with the client
+func (c *SSHClient) ConnectThrough(jump *SSHClient, address string) error {
+	address = withPort(address)
+	conn, err := jump.Dial(address)
+	if err != nil {
+		return err
+	}
+
+	// Limit the time of the handshake as the dial timeout does not apply
+	conn.SetDeadline(time.Now().Add(timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, c.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.conn = ssh.NewClient(sshConn, chans, reqs)
+	c.jump = jump
+	return nil
+}
+
+// Dial opens a TCP connection to the address as seen from the host,
+// tunnelled through the SSH connection
+func (c *SSHClient) Dial(address string) (net.Conn, error) {
+	return c.conn.Dial("tcp", address)
+}
+
+// DialUnix opens a connection to the unix socket of the host,
+// tunnelled through the SSH connection
+func (c *SSHClient) DialUnix(socket string) (net.Conn, error) {
+	return c.conn.Dial("unix", socket)
+}
+
+// IsResponding checks if the host at the address, as seen from the host of
+// the client, is responding to SSH
+func (c *SSHClient) IsResponding(address string) bool {
+	conn, err := c.Dial(withPort(address))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	return hasBanner(conn)
+}
+
+// Close closes the connection to the host
+func (c *SSHClient) Close() error {
+	if c.agent != nil {
+		c.agent.Close()
+	}
+	if c.jump != nil {
+		defer c.jump.Close()
+	}
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Run runs the command line in the host, streaming its input and output,
+// and returns the exit code of the command
+func (c *SSHClient) Run(command string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	session, err := c.conn.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	return exitCode(session.Run(command))
+}
+
+// Shell opens an interactive shell in the host, attaching the terminal of
+// the standard input and output to it
+func (c *SSHClient) Shell() error {
+	session, err := c.conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	// Request a terminal with the size of the local one when attached to it
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		err = session.RequestPty(termType, height, width, modes)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = session.Shell()
+	if err != nil {
+		return err
+	}
+
+	// The exit code of the shell is the one of the last command run in it
+	_, err = exitCode(session.Wait())
+	return err
+}
+
+// Upload copies the local file or directory to the remote path.
+// Like scp, when the remote path is an existing directory the content is
+// copied inside of it.
+func (c *SSHClient) Upload(local, remote string) error {
+	client, err := sftp.NewClient(c.conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if info, err := client.Stat(remote); err == nil && info.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+
+	return filepath.Walk(local, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(local, src)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(remote, filepath.ToSlash(rel))
+
+		// Create the directories, keeping the permissions
+		if info.IsDir() {
+			err = client.MkdirAll(dst)
+			if err != nil {
+				return err
+			}
+			return client.Chmod(dst, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := client.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dst, err)
+		}
+
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		// The remote file is only complete once it is closed
+		err = out.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", dst, err)
+		}
+
+		return client.Chmod(dst, info.Mode().Perm())
+	})
+}
+
+// Download copies the remote file or directory to the local path.
+// Like scp, when the local path is an existing directory the content is
+// copied inside of it.
+func (c *SSHClient) Download(remote, local string) error {
+	client, err := sftp.NewClient(c.conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+
+	walker := client.Walk(remote)
+	for walker.Step() {
+		if walker.Err() != nil {
+			return walker.Err()
+		}
+
+		info := walker.Stat()
+		rel, err := filepath.Rel(remote, walker.Path())
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(local, filepath.FromSlash(rel))
+
+		// Create the directories, keeping the permissions
+		if info.IsDir() {
+			err = os.MkdirAll(dst, info.Mode().Perm()|0700)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		err = c.downloadFile(client, walker.Path(), dst, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downloadFile copies a single remote file to the local path
+func (c *SSHClient) downloadFile(client *sftp.Client, src, dst string, perm os.FileMode) error {
+	in, err := client.Open(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// exitCode converts the error of a finished command into its exit code
+func exitCode(err error) (int, error) {
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus(), nil
+	case errors.As(err, &missingErr), errors.Is(err, io.EOF):
+		return -1, ErrNoExitStatus
+	default:
+		return -1, err
+	}
+}
+
+// Check if host is responding, using the default SSH port when the address
+// has no port. The SSH banner is read as the port forwards of the user-mode
+// network accept connections before the SSH server of the machine is up.
+func IsResponding(address string) bool {
 	// Set timeout to 5 seconds
 	timeout := time.Second * 5
 
 	// Try to connect to the host
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), timeout)
+	conn, err := net.DialTimeout("tcp", withPort(address), timeout)
 	if err != nil {
 		return false
 	}
 	defer conn.Close()
 
-	// Return true if the connection is established
-	return conn != nil
+	return hasBanner(conn)
+}
+
+// Checks if the server of the connection identifies itself as an SSH server
+func hasBanner(conn net.Conn) bool {
+	banner := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(conn, banner)
+	return err == nil && string(banner) == "SSH-"
+}
+
+// Returns the address with the default SSH port when it has no port
+func withPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, port)
 }
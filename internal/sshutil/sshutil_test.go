@@ -1,12 +1,19 @@
 package sshutil
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	sshsrv "github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,3 +41,252 @@ func TestGenerateNewSSHKeys(t *testing.T) {
 	assert.NotNil(t, publicKeyBytes)
 	assert.Nil(t, err)
 }
+
+// startTestServer starts an SSH server that runs the commands with the local
+// shell, serves SFTP and forwards TCP connections, returning the private key accepted by the server
+func startTestServer(t *testing.T) []byte {
+	privateKeyPEM, publicKeyBytes, err := GenerateNewSSHKeys()
+	assert.NoError(t, err)
+	authorized, _, _, _, err := sshsrv.ParseAuthorizedKey(publicKeyBytes)
+	assert.NoError(t, err)
+
+	s := &sshsrv.Server{
+		Handler: func(s sshsrv.Session) {
+			cmd := exec.Command("sh", "-c", s.RawCommand())
+			cmd.Stdout = s
+			cmd.Stderr = s.Stderr()
+			err := cmd.Run()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				s.Exit(exitErr.ExitCode())
+				return
+			}
+			s.Exit(0)
+		},
+		PublicKeyHandler: func(ctx sshsrv.Context, key sshsrv.PublicKey) bool {
+			return sshsrv.KeysEqual(key, authorized)
+		},
+		LocalPortForwardingCallback: func(ctx sshsrv.Context, host string, port uint32) bool {
+			return true
+		},
+		ChannelHandlers: map[string]sshsrv.ChannelHandler{
+			"session":      sshsrv.DefaultSessionHandler,
+			"direct-tcpip": sshsrv.DirectTCPIPHandler,
+		},
+		SubsystemHandlers: map[string]sshsrv.SubsystemHandler{
+			"sftp": func(s sshsrv.Session) {
+				server, err := sftp.NewServer(s)
+				if err != nil {
+					return
+				}
+				server.Serve()
+				server.Close()
+			},
+		},
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(serverAddr, "0"))
+	assert.NoError(t, err)
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+
+	// Point the client to the port of the server
+	defaultPort := port
+	_, port, _ = net.SplitHostPort(listener.Addr().String())
+	t.Cleanup(func() { port = defaultPort })
+
+	return privateKeyPEM
+}
+
+// newTestClient connects a client to a new test server
+func newTestClient(t *testing.T) *SSHClient {
+	key := startTestServer(t)
+	client, err := NewSSHClient("test-user", key)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Connect(serverAddr))
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestNewSSHClient(t *testing.T) {
+	// Test case: Invalid private key
+	_, err := NewSSHClient("test-user", []byte("invalid"))
+	assert.Error(t, err)
+
+	// Test case: Key not accepted by the server
+	startTestServer(t)
+	otherKey, _, _ := GenerateNewSSHKeys()
+	client, err := NewSSHClient("test-user", otherKey)
+	assert.NoError(t, err)
+	assert.Error(t, client.Connect(serverAddr))
+}
+
+func TestSSHClient_Run(t *testing.T) {
+	client := newTestClient(t)
+
+	// Test case: The output of the command is streamed
+	var stdout, stderr bytes.Buffer
+	code, err := client.Run("echo out; echo err >&2", nil, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+
+	// Test case: The exit code of the command is returned
+	code, err = client.Run("exit 3", nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, code)
+}
+
+func TestSSHClient_UploadDownload(t *testing.T) {
+	client := newTestClient(t)
+
+	// Create a local directory with a file and a sub directory
+	local := filepath.Join(t.TempDir(), "bin")
+	os.MkdirAll(filepath.Join(local, "sub"), 0755)
+	os.WriteFile(filepath.Join(local, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(local, "sub", "data.txt"), []byte("data"), 0644)
+
+	// Test case: Upload the directory to a new path
+	remote := filepath.Join(t.TempDir(), "machina")
+	err := client.Upload(local, remote)
+	assert.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(remote, "sub", "data.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+	info, err := os.Stat(filepath.Join(remote, "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// Test case: Upload the directory into an existing directory
+	err = client.Upload(local, remote)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(remote, "bin", "run.sh"))
+
+	// Test case: Download a single file
+	dst := filepath.Join(t.TempDir(), "run.sh")
+	err = client.Download(filepath.Join(remote, "run.sh"), dst)
+	assert.NoError(t, err)
+	content, err = os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\n", string(content))
+
+	// Test case: Download the directory into an existing directory
+	dir := t.TempDir()
+	err = client.Download(remote, dir)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "machina", "sub", "data.txt"))
+
+	// Test case: The remote path does not exist
+	err = client.Download(filepath.Join(remote, "missing"), dir)
+	assert.Error(t, err)
+}
+
+func TestIsResponding(t *testing.T) {
+	// Test case: The SSH server sends its banner
+	startTestServer(t)
+	assert.True(t, IsResponding(serverAddr))
+	assert.True(t, IsResponding(net.JoinHostPort(serverAddr, port)))
+
+	// Test case: The connection is accepted and closed without a banner
+	listener, err := net.Listen("tcp", net.JoinHostPort(serverAddr, "0"))
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	assert.False(t, IsResponding(listener.Addr().String()))
+
+	// Test case: Nothing is listening on the port
+	address := listener.Addr().String()
+	listener.Close()
+	assert.False(t, IsResponding(address))
+}
+
+func TestWithPort(t *testing.T) {
+	assert.Equal(t, "10.0.0.2:22", withPort("10.0.0.2"))
+	assert.Equal(t, "127.0.0.1:2222", withPort("127.0.0.1:2222"))
+}
+
+func TestSSHClient_Dial(t *testing.T) {
+	client := newTestClient(t)
+
+	// Start a server that echoes a line back
+	listener, err := net.Listen("tcp", net.JoinHostPort(serverAddr, "0"))
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// Test case: The connection is tunnelled to the server
+	conn, err := client.Dial(listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "ping")
+	assert.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+}
+
+func TestSSHClient_ConnectThrough(t *testing.T) {
+	key := startTestServer(t)
+	jump, err := NewSSHClient("test-user", key)
+	assert.NoError(t, err)
+	assert.NoError(t, jump.Connect(serverAddr))
+
+	// Test case: The server is checked from the jump host
+	assert.True(t, jump.IsResponding(serverAddr))
+
+	// Test case: The connection goes through the jump host
+	client, err := NewSSHClient("test-user", key)
+	assert.NoError(t, err)
+	assert.NoError(t, client.ConnectThrough(jump, serverAddr))
+	var stdout bytes.Buffer
+	code, err := client.Run("echo through", nil, &stdout, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "through\n", stdout.String())
+
+	// Test case: Closing the client closes the jump host
+	assert.NoError(t, client.Close())
+	_, err = jump.Dial(net.JoinHostPort(serverAddr, port))
+	assert.Error(t, err)
+}
+
+func TestNewHostClient(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	// Test case: No known hosts
+	_, err := NewHostClient("test-user")
+	assert.Error(t, err)
+
+	// Test case: No keys
+	os.MkdirAll(filepath.Join(home, ".ssh"), 0700)
+	os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), nil, 0600)
+	_, err = NewHostClient("test-user")
+	assert.Error(t, err)
+
+	// Test case: The host key of the server is not known
+	key := startTestServer(t)
+	os.WriteFile(filepath.Join(home, ".ssh", "id_rsa"), key, 0600)
+	client, err := NewHostClient("test-user")
+	assert.NoError(t, err)
+	assert.ErrorContains(t, client.Connect(serverAddr), "key is unknown")
+}
@@ -1,6 +1,8 @@
 package usrutil
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"strings"
 
@@ -9,21 +11,49 @@ import (
 
 // CloudConfig is a struct that holds the configuration for the cloud-config file
 type CloudConfig struct {
-	Hostname   string   // Hostname is the hostname of the instance
-	Username   string   // Username is the username of the instance
-	Password   string   // Password is the password of the instance
-	Groups     []string //	Groups is the groups of the instance
-	PrivateKey []byte   // PrivateKey is the private key of the instance
+	Hostname    string       // Hostname is the hostname of the instance
+	Username    string       // Username is the username of the instance
+	Password    string       // Password is the password of the instance
+	Groups      []string     //	Groups is the groups of the instance
+	PrivateKey  []byte       // PrivateKey is the private key of the instance
+	Filesystems []Filesystem // Filesystems is the filesystems to create and mount in the instance
+}
+
+// Filesystem is a struct that holds a filesystem to create on a disk and where to mount it
+type Filesystem struct {
+	Label      string // Label is the label of the filesystem
+	Device     string // Device is the path of the disk inside the instance
+	Type       string // Type is the type of the filesystem, e.g. ext4 or xfs
+	MountPoint string // MountPoint is the path where the filesystem is mounted
 }
 
 // UserData is a struct that holds the configuration for the user-data file
 type UserData struct {
-	Hostname       string     `yaml:"hostname"`         // Hostname is the hostname of the userdata
-	ManageEtcHosts bool       `yaml:"manage_etc_hosts"` // ManageEtcHosts is a boolean that determines if the /etc/hosts file should be managed
-	Users          []User     `yaml:"users"`            // Users is a slice of users
-	SSHPwAuth      bool       `yaml:"ssh_pwauth"`       // SSHPwAuth is a boolean that determines if password authentication is allowed
-	DisableRoot    bool       `yaml:"disable_root"`     // DisableRoot is a boolean that determines if the root user should be disabled
-	ChPassword     ChPassword `yaml:"chpasswd"`         // ChPassword is a struct that holds the configuration for the chpasswd module
+	Hostname       string     `yaml:"hostname"`           // Hostname is the hostname of the userdata
+	ManageEtcHosts bool       `yaml:"manage_etc_hosts"`   // ManageEtcHosts is a boolean that determines if the /etc/hosts file should be managed
+	Users          []User     `yaml:"users"`              // Users is a slice of users
+	SSHPwAuth      bool       `yaml:"ssh_pwauth"`         // SSHPwAuth is a boolean that determines if password authentication is allowed
+	DisableRoot    bool       `yaml:"disable_root"`       // DisableRoot is a boolean that determines if the root user should be disabled
+	ChPassword     ChPassword `yaml:"chpasswd"`           // ChPassword is a struct that holds the configuration for the chpasswd module
+	FsSetup        []FsSetup  `yaml:"fs_setup,omitempty"` // FsSetup is a slice of filesystems to create
+	Mounts         [][]string `yaml:"mounts,omitempty"`   // Mounts is a slice of fstab entries
+	Growpart       Growpart   `yaml:"growpart"`           // Growpart is a struct that holds the configuration for the growpart module
+	ResizeRootfs   bool       `yaml:"resize_rootfs"`      // ResizeRootfs is a boolean that determines if the root filesystem should be grown to its partition
+}
+
+// Growpart is a struct that holds the configuration for the growpart module,
+// which grows the partitions to the size of their disk on every boot
+type Growpart struct {
+	Mode    string   `yaml:"mode"`    // Mode is the tool used to grow the partitions, auto to detect it
+	Devices []string `yaml:"devices"` // Devices is a slice of the devices or mount points to grow
+}
+
+// FsSetup is a struct that holds the configuration for the fs_setup module
+type FsSetup struct {
+	Label      string `yaml:"label"`      // Label is the label of the filesystem
+	Filesystem string `yaml:"filesystem"` // Filesystem is the type of the filesystem
+	Device     string `yaml:"device"`     // Device is the path of the disk
+	Partition  string `yaml:"partition"`  // Partition is the partition to use, 'none' for the whole disk
 }
 
 // User is a struct that holds the configuration for the user-data file
@@ -38,6 +68,12 @@ type User struct {
 	LockPassword      bool     `yaml:"lock_passwd"`         // LockPassword is a boolean that determines if the password should be locked
 }
 
+// MetaData is a struct that holds the configuration for the meta-data file
+type MetaData struct {
+	InstanceID    string `yaml:"instance-id"`    // InstanceID is the unique id cloud-init uses to detect a new instance
+	LocalHostname string `yaml:"local-hostname"` // LocalHostname is the hostname of the instance
+}
+
 // ChPassword is a struct that holds the configuration for the chpasswd module
 type ChPassword struct {
 	List   string `yaml:"list"`   // List is a list of users and passwords
@@ -79,7 +115,40 @@ func NewUserData(cfg *CloudConfig) (*UserData, error) {
 			List:   fmt.Sprintf("%s:%s", cfg.Username, cfg.Username),
 			Expire: false,
 		},
+		// Grow the root filesystem when the disk is resized
+		Growpart:     Growpart{Mode: "auto", Devices: []string{"/"}},
+		ResizeRootfs: true,
+	}
+
+	// Create the filesystems and mount them
+	for _, fs := range cfg.Filesystems {
+		usr.FsSetup = append(usr.FsSetup, FsSetup{
+			Label:      fs.Label,
+			Filesystem: fs.Type,
+			Device:     fs.Device,
+			Partition:  "none",
+		})
+		if fs.MountPoint != "" {
+			usr.Mounts = append(usr.Mounts, []string{fs.Device, fs.MountPoint, fs.Type, "defaults,nofail", "0", "2"})
+		}
 	}
 
 	return usr, nil
 }
+
+// NewMetaData creates a new MetaData struct with a unique instance id, so
+// cloud-init configures the instance on its first boot, even when its disk
+// is a copy of another instance
+func NewMetaData(hostname string) (*MetaData, error) {
+	// Generate a random suffix for the instance id
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetaData{
+		InstanceID:    fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(buf)),
+		LocalHostname: hostname,
+	}, nil
+}
@@ -41,4 +41,45 @@ func TestNewUserData(t *testing.T) {
 	assert.Equal(t, got.Users[0].Groups, want.Users[0].Groups)
 	assert.Equal(t, got.Users[0].Home, want.Users[0].Home)
 	assert.Equal(t, got.Users[0].Shell, want.Users[0].Shell)
+
+	// Check that the root filesystem is grown on boot
+	assert.Equal(t, Growpart{Mode: "auto", Devices: []string{"/"}}, got.Growpart)
+	assert.True(t, got.ResizeRootfs)
+}
+
+func TestNewUserDataFilesystems(t *testing.T) {
+	cfg := &CloudConfig{
+		Hostname: "example.com",
+		Username: "john",
+		Filesystems: []Filesystem{
+			{Label: "data", Device: "/dev/disk/by-id/virtio-data", Type: "xfs", MountPoint: "/data"},
+			{Label: "raw", Device: "/dev/disk/by-id/virtio-raw", Type: "ext4"},
+		},
+	}
+
+	got, err := NewUserData(cfg)
+	assert.NoError(t, err)
+
+	// Check that both filesystems are created
+	assert.Equal(t, []FsSetup{
+		{Label: "data", Filesystem: "xfs", Device: "/dev/disk/by-id/virtio-data", Partition: "none"},
+		{Label: "raw", Filesystem: "ext4", Device: "/dev/disk/by-id/virtio-raw", Partition: "none"},
+	}, got.FsSetup)
+
+	// Check that only the filesystem with a mount point is mounted
+	assert.Equal(t, [][]string{
+		{"/dev/disk/by-id/virtio-data", "/data", "xfs", "defaults,nofail", "0", "2"},
+	}, got.Mounts)
+}
+
+func TestNewMetaData(t *testing.T) {
+	first, err := NewMetaData("example")
+	assert.NoError(t, err)
+	assert.Equal(t, "example", first.LocalHostname)
+	assert.Regexp(t, "^example-[0-9a-f]{8}$", first.InstanceID)
+
+	// Check that every call generates a new instance id
+	second, err := NewMetaData("example")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.InstanceID, second.InstanceID)
 }